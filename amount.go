@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+//账本中的金额统一使用int64的最小单位表示，避免float64累积舍入误差
+//1个币 = CoinUnit个最小单位
+const CoinUnit = 100000000
+
+//金额的小数位数
+const amountDecimals = 8
+
+//以最小单位表示的金额
+type Amount int64
+
+var ErrAmountOverflow = errors.New("金额溢出！")
+
+//把"1.5"这样的字符串解析为最小单位的金额（150000000）
+func ParseAmount(str string) (Amount, error) {
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return 0, errors.New("金额不能为空！")
+	}
+	if strings.HasPrefix(str, "-") {
+		return 0, fmt.Errorf("金额不能为负数：%s", str)
+	}
+
+	parts := strings.SplitN(str, ".", 2)
+	intPart := parts[0]
+	fracPart := ""
+	if len(parts) == 2 {
+		fracPart = parts[1]
+	}
+	if intPart == "" && fracPart == "" {
+		return 0, fmt.Errorf("无效的金额：%s", str)
+	}
+	if len(fracPart) > amountDecimals {
+		return 0, fmt.Errorf("金额最多只能有%d位小数：%s", amountDecimals, str)
+	}
+
+	if intPart == "" {
+		intPart = "0"
+	}
+	whole, err := strconv.ParseUint(intPart, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("无效的金额：%s", str)
+	}
+	//补齐到8位小数
+	fracPart += strings.Repeat("0", amountDecimals-len(fracPart))
+	frac, err := strconv.ParseUint(fracPart, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("无效的金额：%s", str)
+	}
+
+	if whole > uint64(math.MaxInt64-frac)/CoinUnit {
+		return 0, ErrAmountOverflow
+	}
+	return Amount(whole*CoinUnit + frac), nil
+}
+
+//格式化为"1.5"这样的字符串，去掉末尾多余的0
+func (a Amount) String() string {
+	sign := ""
+	value := uint64(a)
+	if a < 0 {
+		sign = "-"
+		value = uint64(-(a + 1)) + 1
+	}
+	str := fmt.Sprintf("%s%d.%08d", sign, value/CoinUnit, value%CoinUnit)
+	str = strings.TrimRight(str, "0")
+	return strings.TrimSuffix(str, ".")
+}
+
+//带溢出检查的加法，金额不允许为负数
+func AddAmount(a, b Amount) (Amount, error) {
+	if a < 0 || b < 0 {
+		return 0, fmt.Errorf("金额不能为负数：%s, %s", a, b)
+	}
+	if a > math.MaxInt64-b {
+		return 0, ErrAmountOverflow
+	}
+	return a + b, nil
+}
+
+//统计交易所有output的总额，带溢出检查
+func (tx *Transaction) OutputSum() (Amount, error) {
+	var total Amount
+	for _, output := range tx.TXOutputs {
+		var err error
+		total, err = AddAmount(total, output.Value)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return total, nil
+}
+
+//数据库元数据，用来记录存储格式，便于旧数据库的迁移
+const metaBucket = "metaBucket"
+
+//金额格式的key，value为"int64"表示区块中已经是最小单位的整数金额
+const amountFormatKey = "AmountFormat"
+const amountFormatInt64 = "int64"
+
+//共识引擎名称的key，旧数据库中没有这个key，都是pow
+const consensusKey = "Consensus"
+
+//旧版本（Value为float64）的交易输出、交易和区块，只在migrateEncoding中使用
+type legacyTXOutput struct {
+	Value      float64
+	PubKeyHash []byte
+}
+
+type legacyTransaction struct {
+	TXID      []byte
+	TXInputs  []TXInput
+	TXOutputs []legacyTXOutput
+}
+
+type legacyBlock struct {
+	Version        uint64
+	PreHash        []byte
+	MerKerTreeRoot []byte
+	Nonce          uint64
+	Difficulty     uint64
+	TimeStamp      uint64
+	Height         uint64
+
+	NowHash      []byte
+	Transactions []*legacyTransaction
+}
+
+//把旧格式的区块转换为新格式，金额四舍五入到最小单位
+//注意：交易ID保持不变，旧交易的签名是对float64格式做的，迁移后无法再用Verify重新校验
+func (legacy *legacyBlock) convert() *Block {
+	block := Block{
+		Version:        legacy.Version,
+		PreHash:        legacy.PreHash,
+		MerKerTreeRoot: legacy.MerKerTreeRoot,
+		Nonce:          legacy.Nonce,
+		Difficulty:     legacy.Difficulty,
+		TimeStamp:      legacy.TimeStamp,
+		Height:         legacy.Height,
+		NowHash:        legacy.NowHash,
+	}
+	for _, legacyTx := range legacy.Transactions {
+		tx := Transaction{TXID: legacyTx.TXID, TXInputs: legacyTx.TXInputs}
+		for _, output := range legacyTx.TXOutputs {
+			value := Amount(math.Round(output.Value * CoinUnit))
+			tx.TXOutputs = append(tx.TXOutputs, TXOutput{value, output.PubKeyHash})
+		}
+		block.Transactions = append(block.Transactions, &tx)
+	}
+	return &block
+}
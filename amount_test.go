@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		str  string
+		want Amount
+	}{
+		{"0", 0},
+		{"1", CoinUnit},
+		{"1.5", 150000000},
+		{"0.00000001", 1},
+		{".5", 50000000},
+		{"2.", 2 * CoinUnit},
+		{" 3.25 ", 325000000},
+		{"12.34567890", 1234567890},
+		{"92233720368.54775807", math.MaxInt64},
+	}
+	for _, test := range tests {
+		got, err := ParseAmount(test.str)
+		if err != nil {
+			t.Errorf("ParseAmount(%q)：%v", test.str, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseAmount(%q) = %d，应该为%d", test.str, got, test.want)
+		}
+	}
+}
+
+func TestParseAmountInvalid(t *testing.T) {
+	for _, str := range []string{"", " ", ".", "-1", "+1", "1.123456789", "abc", "1.2.3", "1,5", "0x10", "1e8", "1.-5"} {
+		if got, err := ParseAmount(str); err == nil {
+			t.Errorf("ParseAmount(%q) = %d，应该返回错误", str, got)
+		}
+	}
+	for _, str := range []string{"92233720368.54775808", "92233720369", "18446744073709551616"} {
+		_, err := ParseAmount(str)
+		if err == nil {
+			t.Errorf("ParseAmount(%q)应该溢出", str)
+		}
+	}
+	if _, err := ParseAmount("92233720368.54775808"); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("超过最大值时应该返回ErrAmountOverflow：%v", err)
+	}
+}
+
+func TestAmountString(t *testing.T) {
+	tests := []struct {
+		amount Amount
+		want   string
+	}{
+		{0, "0"},
+		{1, "0.00000001"},
+		{CoinUnit, "1"},
+		{150000000, "1.5"},
+		{1234567890, "12.3456789"},
+		{-150000000, "-1.5"},
+		{math.MaxInt64, "92233720368.54775807"},
+		{math.MinInt64, "-92233720368.54775808"},
+	}
+	for _, test := range tests {
+		if got := test.amount.String(); got != test.want {
+			t.Errorf("Amount(%d).String() = %q，应该为%q", int64(test.amount), got, test.want)
+		}
+	}
+}
+
+//格式化之后再解析得到原来的金额
+func TestAmountRoundTrip(t *testing.T) {
+	for _, amount := range []Amount{0, 1, 10, CoinUnit - 1, CoinUnit, 50 * CoinUnit, 123456789012345, math.MaxInt64} {
+		got, err := ParseAmount(amount.String())
+		if err != nil || got != amount {
+			t.Errorf("%d格式化为%q，解析得到%d：%v", int64(amount), amount.String(), got, err)
+		}
+	}
+}
+
+func TestAddAmount(t *testing.T) {
+	sum, err := AddAmount(CoinUnit, 1)
+	if err != nil || sum != CoinUnit+1 {
+		t.Errorf("AddAmount = %d：%v", sum, err)
+	}
+	if _, err = AddAmount(math.MaxInt64, 1); !errors.Is(err, ErrAmountOverflow) {
+		t.Errorf("溢出时应该返回ErrAmountOverflow：%v", err)
+	}
+	if _, err = AddAmount(-1, 1); err == nil {
+		t.Error("负数金额应该返回错误")
+	}
+}
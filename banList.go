@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+//封禁的ip保存在这个文件中，运行中的节点和banPeer/unbanPeer命令都会读写
+//每次修改都先重新读取文件再写回，所以节点运行时用命令修改也不会覆盖节点自己加的封禁
+const banListFile = "banlist.dat"
+
+//违规分数达到上限以及banPeer没有指定时间时，封禁的时间
+const defaultBanDuration = 24 * time.Hour
+
+type Ban struct {
+	//封禁的截止时间，过期后自动解除
+	Until time.Time
+	//封禁的原因
+	Reason string
+}
+
+type BanList struct {
+	//map[ip]封禁信息
+	Bans map[string]*Ban
+}
+
+//读取封禁列表，文件不存在时为空，已经过期的封禁不会读出
+func LoadBanList() (*BanList, error) {
+	bl := &BanList{make(map[string]*Ban)}
+	content, err := ioutil.ReadFile(banListFile)
+	if os.IsNotExist(err) {
+		return bl, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w：%v", ErrPeerFile, err)
+	}
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(bl)
+	if err != nil {
+		return nil, fmt.Errorf("%w：%s已损坏：%v", ErrPeerFile, banListFile, err)
+	}
+	if bl.Bans == nil {
+		bl.Bans = make(map[string]*Ban)
+	}
+	now := time.Now()
+	for host, ban := range bl.Bans {
+		if !now.Before(ban.Until) {
+			delete(bl.Bans, host)
+		}
+	}
+	return bl, nil
+}
+
+//写回文件
+func (bl *BanList) Save() error {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(bl)
+	if err != nil {
+		return fmt.Errorf("%w：%v", ErrPeerFile, err)
+	}
+	return writeFileAtomic(banListFile, buffer.Bytes())
+}
+
+//先写临时文件再改名，另一个进程同时读取时不会读到一半的内容
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	err := ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return fmt.Errorf("%w：%v", ErrPeerFile, err)
+	}
+	err = os.Rename(tmp, name)
+	if err != nil {
+		return fmt.Errorf("%w：%v", ErrPeerFile, err)
+	}
+	return nil
+}
+
+//封禁host，已经封禁时更新截止时间和原因
+func (bl *BanList) Ban(host string, duration time.Duration, reason string) {
+	bl.Bans[host] = &Ban{time.Now().Add(duration), reason}
+}
+
+//解除封禁，host没有被封禁时返回false
+func (bl *BanList) Unban(host string) bool {
+	if _, ok := bl.Bans[host]; !ok {
+		return false
+	}
+	delete(bl.Bans, host)
+	return true
+}
+
+//host是否被封禁，封禁过期时视为没有封禁
+func (bl *BanList) Banned(host string) (*Ban, bool) {
+	ban, ok := bl.Bans[host]
+	if !ok || !time.Now().Before(ban.Until) {
+		return nil, false
+	}
+	return ban, true
+}
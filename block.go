@@ -2,11 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
-	"encoding/gob"
+	"errors"
 	"fmt"
-	"github.com/boltdb/bolt"
 	"log"
 	"time"
 )
@@ -20,6 +20,14 @@ type Block struct {
 	Nonce          uint64
 	Difficulty     uint64
 	TimeStamp      uint64
+	//区块高度，创世区块为0
+	Height uint64
+
+	//以下字段只在poa共识中使用，pow区块中为空
+	Signer    []byte //出块签名者的公钥（X与Y拼接）
+	Vote      []byte //投票增加或删除的签名者的公钥哈希，为空表示不投票
+	VoteAdd   bool   //true为投票增加签名者，false为投票删除
+	Signature []byte //签名者对区块哈希的签名，不参与区块哈希的计算
 
 	NowHash []byte
 	//Data    []byte
@@ -27,124 +35,186 @@ type Block struct {
 	Transactions []*Transaction
 }
 
-//创建区块
-func NewBlock(txs []*Transaction, preHsh []byte) *Block {
+//区块版本，决定区块头的拼装方式（见HeaderBytes）
+//1：各字段直接拼接，只有旧区块使用
+//2：字节数组加上长度前缀，与encoding.go中的编码相同
+const blockVersionConcat = 1
+const blockVersionPrefixed = 2
+
+//新区块使用的版本
+const blockVersion = blockVersionPrefixed
+
+//创建区块，还需要由共识引擎Seal之后才是一个完整的区块
+//bits为紧凑格式的难度目标值，由CalcNextDifficulty计算
+func NewBlock(txs []*Transaction, preHsh []byte, height uint64, bits uint64) *Block {
 	block := Block{
-		Version:        1,
+		Version:        blockVersion,
 		PreHash:        preHsh,
 		MerKerTreeRoot: []byte{},
 		Nonce:          0,
-		Difficulty:     0,
+		Difficulty:     bits,
 		TimeStamp:      uint64(time.Now().Unix()),
+		Height:         height,
 
 		//Data: data,
 		Transactions: txs,
 	}
-	//创建一个pow对象
-	pow := newProofOfWork(&block)
-	//查找随机数，不停的进行hash运算
-	hash, nonce := pow.run()
-	block.NowHash = hash
-	block.Nonce = nonce
+	//先计算默克尔树根，区块哈希通过它对所有交易做出承诺
 	block.MerKerTreeRoot = block.MakeMerkelTreeRoot()
 
 	return &block
 }
 
 //添加区块
-func (blockChain *BlockChain) AddBlock(txs []*Transaction) {
+//挖矿在写数据库之前完成，不会长时间占用bolt的写事务，中途取消也不会留下写了一半的数据
+//挖出的区块与收到的区块一样由AcceptBlock校验并加入区块链，返回区块以及主链的变化
+//ctx被取消时返回ErrMiningCancelled，挖矿期间主链已经被其他区块延长时返回ErrStaleBlock
+func (blockChain *BlockChain) AddBlock(ctx context.Context, txs []*Transaction) (*Block, *ChainUpdate, error) {
+	//同一个区块中后面的交易可以花费前面交易的output
+	pending := make(map[string]Transaction)
 	for i, tx := range txs {
-		//铸币交易不用验证
-		if i > 0 {
-			if !blockChain.VerifyTransaction(tx) {
-				fmt.Printf("矿工发现无效失败！")
-				return
+		//铸币交易不用验证，铸币交易的位置在ValidateBlock中校验
+		if i > 0 && !tx.IsCoinbase() {
+			prevTXs, err := blockChain.findPrevTransactions(tx, pending)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !tx.Verify(prevTXs) {
+				return nil, nil, errors.New("矿工发现无效交易！")
 			}
 		}
+		pending[string(tx.TXID)] = *tx
 	}
 
 	//获取前区块hash
-	db := blockChain.db
-	lastHash := blockChain.tail
-	db.Update(func(tx *bolt.Tx) error {
-		//完成数据添加
-		bucket := tx.Bucket([]byte(blockBucket))
-		if bucket == nil {
-			log.Panic("bucket 不应该为空，请检查！")
+	lastHash := blockChain.Tip()
+	lastBlock, err := blockChain.GetBlockByHash(lastHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	height := lastBlock.Height + 1
+	//根据前面的区块计算新区块的难度
+	bits, err := blockChain.CalcNextDifficulty(lastBlock)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	//同一高度有其他区块加入时，mineCtx会被取消
+	mineCtx, cancel := blockChain.watchHeight(ctx, height)
+	defer cancel()
+	block := NewBlock(txs, lastHash, height, bits)
+	//由共识引擎封装区块（pow中就是挖矿）
+	err = blockChain.engine.Seal(mineCtx, blockChain, block)
+	if err != nil {
+		if err == ErrMiningCancelled && ctx.Err() == nil {
+			return nil, nil, ErrStaleBlock
 		}
-		block := NewBlock(txs, lastHash)
-
-		//hash作为key，block的字节流作为value，尚未实现
-		bucket.Put(block.NowHash, block.Serialize())
-		bucket.Put([]byte("LastHashKey"), block.NowHash)
-		lastHash = block.NowHash
-		//更新一下内存中的区块链，指的是把最后的小尾巴tail更新一下
-		blockChain.tail = block.NowHash
-		return nil
-	})
+		return nil, nil, err
+	}
+
+	update, err := blockChain.AcceptBlock(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	//挖矿期间主链已经被延长，区块只保存在了侧链上
+	if len(update.Connected) == 0 {
+		return nil, nil, ErrStaleBlock
+	}
+	return block, update, nil
 }
 
 //uint64ToByte
 func uint64ToByte(num uint64) []byte {
-	var buffer bytes.Buffer
-	err := binary.Write(&buffer, binary.BigEndian, num)
-	if err != nil {
-		log.Panic(err)
-	}
-	return buffer.Bytes()
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, num)
+	return buf
 }
 
-//生成hash
-func (block *Block) setHash() {
+//拼装区块头数据，nonce单独传入，挖矿时不停修改nonce即可
+//默克尔树根包含在区块头中，所以区块哈希同时承诺了所有交易
+//版本1直接拼接，PreHash、MerKerTreeRoot、Signer、Vote长度可变，不同的字段划分可能拼出相同的数据
+//版本2给每个字节数组加上长度前缀，并且总是包含poa的字段
+func (block *Block) HeaderBytes(nonce uint64) []byte {
+	if block.Version >= blockVersionPrefixed {
+		var buffer bytes.Buffer
+		e := encoder{w: &buffer}
+		e.uint64(block.Version)
+		e.bytes(block.PreHash)
+		e.bytes(block.MerKerTreeRoot)
+		e.uint64(nonce)
+		e.uint64(block.Difficulty)
+		e.uint64(block.TimeStamp)
+		e.uint64(block.Height)
+		e.bytes(block.Signer)
+		e.bytes(block.Vote)
+		e.bool(block.VoteAdd)
+		if e.err != nil {
+			log.Panic("拼装区块头出错！", e.err)
+		}
+		return buffer.Bytes()
+	}
 
 	tmp := [][]byte{
 		uint64ToByte(block.Version),
 		block.PreHash,
 		block.MerKerTreeRoot,
-		uint64ToByte(block.Nonce),
+		uint64ToByte(nonce),
 		uint64ToByte(block.Difficulty),
 		uint64ToByte(block.TimeStamp),
+		uint64ToByte(block.Height),
 		//block.Data,
 	}
-	blockInfo := bytes.Join(tmp, []byte{})
-	hash := sha256.Sum256(blockInfo)
-	block.NowHash = hash[:]
+	//poa的签名者和投票也要包含在区块哈希中，pow区块中这些字段为空，哈希不受影响
+	if len(block.Signer) != 0 {
+		voteAdd := byte(0)
+		if block.VoteAdd {
+			voteAdd = 1
+		}
+		tmp = append(tmp, block.Signer, block.Vote, []byte{voteAdd})
+	}
+	return bytes.Join(tmp, []byte{})
 }
 
-//模拟使用txs生成MerKerTreeRoot（简单拼接）
-func (block *Block) MakeMerkelTreeRoot() []byte {
-	var info []byte
-	for _, tx := range block.Transactions {
-		//将交易的哈希值拼接起来，再整体做hash
-		info = append(info, tx.TXID...)
+//nonce在HeaderBytes结果中的偏移，挖矿时直接改写这8个字节
+func (block *Block) NonceOffset() int {
+	if block.Version >= blockVersionPrefixed {
+		return 8 + 4 + len(block.PreHash) + 4 + len(block.MerKerTreeRoot)
 	}
-	hash := sha256.Sum256(info)
+	return 8 + len(block.PreHash) + len(block.MerKerTreeRoot)
+}
+
+//计算区块头的hash
+func (block *Block) CalcHash() []byte {
+	hash := sha256.Sum256(block.HeaderBytes(block.Nonce))
 	return hash[:]
 }
 
-//编码(序列化)
+//使用txs生成MerKerTreeRoot（二叉默克尔树）
+func (block *Block) MakeMerkelTreeRoot() []byte {
+	return NewMerkleRoot(block.Transactions)
+}
+
+//编码(序列化)，格式见encoding.go
+//内存中的区块只有在字段超长时才会编码失败，属于程序错误，直接panic
 func (block *Block) Serialize() []byte {
 	var buffer bytes.Buffer
-	//1.定义一个编码器
-	encoder := gob.NewEncoder(&buffer)
-	//2.使用编码器编码
-	err := encoder.Encode(&block)
+	err := block.Encode(&buffer)
 	if err != nil {
-		log.Panic("编码出错了！")
+		log.Panic("编码出错了！", err)
 	}
 	return buffer.Bytes()
 }
 
-//解码(反序列化)
-func Deserialize(data []byte) Block {
-	//1.定义一个解码器
-	decoder := gob.NewDecoder(bytes.NewReader(data))
+//解码(反序列化)，数据损坏时返回ErrCorruptBlock
+func Deserialize(data []byte) (Block, error) {
 	var block Block
-	//2.使用解码器解码
-	err := decoder.Decode(&block)
+	reader := bytes.NewReader(data)
+	err := block.Decode(reader)
+	if err == nil && reader.Len() != 0 {
+		err = errors.New("编码后面有多余的数据")
+	}
 	if err != nil {
-		log.Panic("解码器出错！")
+		return Block{}, fmt.Errorf("%w：%v", ErrCorruptBlock, err)
 	}
-
-	return block
+	return block, nil
 }
@@ -2,12 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
 	_ "github.com/boltdb/bolt"
-	"log"
+	"sync"
 )
 
 //定义区块链
@@ -16,223 +17,589 @@ type BlockChain struct {
 	//用bolt数据库改写
 	db   *bolt.DB
 	tail []byte //存储最后一个区块的哈希
+	//共识引擎
+	engine Consensus
+	//加入区块时持有，保证数据库中的主链与tail一起更新
+	chainLock sync.Mutex
+
+	//正在进行的挖矿，key是挖矿的高度，用于同一高度出现竞争区块时放弃挖矿
+	miningLock sync.Mutex
+	miningJobs map[uint64][]*miningJob
+
+	//挖矿奖励计划，创建区块链时写入数据库
+	subsidy SubsidySchedule
 }
 
 const blockChainDb = "blockChain.db"
 const blockBucket = "blockBucket"
 
-//初始化区块链
-func NewBlockChain() *BlockChain {
+//高度索引，key是区块高度（8字节大端），value是区块哈希
+const heightBucket = "heightBucket"
+
+//初始化区块链，engine为区块链使用的共识引擎
+//数据库是旧格式时返回ErrOutdatedDatabase，与创建时的共识引擎不同时返回ErrConsensusMismatch
+func NewBlockChain(engine Consensus) (*BlockChain, error) {
 	//return &BlockChain{
 	//	blocks: []*Block{genisisBlock},
 	var lastHash []byte
+	var needReindex bool
+	var needHeightIndex bool
+	var needTxIndex bool
+	var needChainWork bool
+	var subsidy SubsidySchedule
 	//1.打开数据库
 	db, err := bolt.Open(blockChainDb, 0600, nil)
 	//defer db.Close()
 	if err != nil {
-		log.Panic("打开数据库失败！")
+		return nil, fmt.Errorf("%w：打开%s失败：%v", ErrDatabase, blockChainDb, err)
 	}
 	//将要操作数据库（改写）
-	db.Update(func(tx *bolt.Tx) error {
+	err = db.Update(func(tx *bolt.Tx) error {
 		//2.找到抽屉ducket（如果没有就创建）
 		bucket := tx.Bucket([]byte(blockBucket))
 		if bucket == nil {
 			bucket, err = tx.CreateBucket([]byte(blockBucket))
 			if err != nil {
-				log.Panic("创建bucket(b1)失败")
+				return err
+			}
+			//奖励计划在创建时确定，之后不能修改
+			subsidy, err = newChainSubsidySchedule()
+			if err != nil {
+				return err
 			}
 			//创建一个创世区块，并作为第一个区块添加到区块链
-			wallet := NewWallets()
-			address := wallet.CreateWallet()
-			genisisBlock := GenisisBlock(address)
+			wallet, err := NewWallets()
+			if err != nil {
+				return err
+			}
+			address, err := wallet.CreateWallet()
+			if err != nil {
+				return err
+			}
+			genisisBlock, err := GenisisBlock(engine, address, subsidy)
+			if err != nil {
+				return err
+			}
 			//3.写数据
 			//hash作为key，block的字节流作为value
-			bucket.Put(genisisBlock.NowHash, genisisBlock.Serialize())
-			bucket.Put([]byte("LastHashKey"), genisisBlock.NowHash)
+			err = bucket.Put(genisisBlock.NowHash, genisisBlock.Serialize())
+			if err != nil {
+				return err
+			}
+			err = bucket.Put([]byte("LastHashKey"), genisisBlock.NowHash)
+			if err != nil {
+				return err
+			}
 			lastHash = genisisBlock.NowHash
+
+			//创世区块的高度为0
+			heights, err := tx.CreateBucket([]byte(heightBucket))
+			if err != nil {
+				return err
+			}
+			err = heights.Put(uint64ToByte(0), genisisBlock.NowHash)
+			if err != nil {
+				return err
+			}
+
+			//累计工作量从创世区块开始计算
+			works, err := tx.CreateBucket([]byte(chainWorkBucket))
+			if err != nil {
+				return err
+			}
+			err = works.Put(genisisBlock.NowHash, engine.BlockWork(genisisBlock).Bytes())
+			if err != nil {
+				return err
+			}
+			_, err = tx.CreateBucket([]byte(invalidBlockBucket))
+			if err != nil {
+				return err
+			}
+			_, err = tx.CreateBucket([]byte(headerBucket))
+			if err != nil {
+				return err
+			}
+
+			//交易索引默认启用，之后可以用setTxIndex关闭
+			_, err = tx.CreateBucket([]byte(txIndexBucket))
+			if err != nil {
+				return err
+			}
+			err = updateTxIndex(tx, genisisBlock)
+			if err != nil {
+				return err
+			}
+
+			//新数据库直接使用整数金额
+			meta, err := tx.CreateBucket([]byte(metaBucket))
+			if err != nil {
+				return err
+			}
+			for key, value := range map[string]string{
+				amountFormatKey: amountFormatInt64,
+				consensusKey:    engine.Name(),
+				txIndexKey:      txIndexOn,
+				blockFormatKey:  blockFormatBinary,
+				utxoFormatKey:   utxoFormatMaturity,
+			} {
+				err = meta.Put([]byte(key), []byte(value))
+				if err != nil {
+					return err
+				}
+			}
+			err = meta.Put([]byte(subsidyKey), subsidy.Serialize())
+			if err != nil {
+				return err
+			}
+			err = putPoASigners(tx, engine)
+			if err != nil {
+				return err
+			}
+
+			//创世区块的output直接写入UTXO集合
+			_, err = tx.CreateBucket([]byte(utxoBucket))
+			if err != nil {
+				return err
+			}
+			_, err = tx.CreateBucket([]byte(undoBucket))
+			if err != nil {
+				return err
+			}
+			err = updateUTXOSet(tx, genisisBlock)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.CreateBucket([]byte(mempoolBucket))
+			if err != nil {
+				return err
+			}
 			fmt.Printf("使用了铸币交易")
 		} else {
-			lastHash = bucket.Get([]byte("LastHashKey"))
+			//bolt返回的切片只在事务内有效，需要拷贝一份
+			lastHash = append([]byte{}, bucket.Get([]byte("LastHashKey"))...)
+			//旧的数据库中区块是gob格式（更旧的还有float64金额），需要先执行migrateEncoding
+			meta := tx.Bucket([]byte(metaBucket))
+			if meta == nil || string(meta.Get([]byte(blockFormatKey))) != blockFormatBinary {
+				return ErrOutdatedDatabase
+			}
+			//不能用与创建时不同的共识引擎打开区块链
+			name := "pow"
+			if meta.Get([]byte(consensusKey)) != nil {
+				name = string(meta.Get([]byte(consensusKey)))
+			}
+			if name != engine.Name() {
+				return fmt.Errorf("%w：区块链使用的是%s共识，当前配置的是%s共识", ErrConsensusMismatch, name, engine.Name())
+			}
+			err = loadPoASigners(tx, engine)
+			if err != nil {
+				return err
+			}
+			//旧的数据库中没有UTXO集合，或者UTXO中没有记录区块高度，需要重建
+			needReindex = tx.Bucket([]byte(utxoBucket)) == nil ||
+				string(meta.Get([]byte(utxoFormatKey))) != utxoFormatMaturity
+			//旧的数据库中没有高度索引，需要重建
+			needHeightIndex = tx.Bucket([]byte(heightBucket)) == nil
+			//启用交易索引但数据库中还没有时需要重建，关闭时删除旧索引以免过期
+			if txIndexEnabled(tx) {
+				needTxIndex = tx.Bucket([]byte(txIndexBucket)) == nil
+			} else if tx.Bucket([]byte(txIndexBucket)) != nil {
+				err = tx.DeleteBucket([]byte(txIndexBucket))
+				if err != nil {
+					return err
+				}
+			}
+			//旧的数据库中没有交易池，创建一个空的
+			_, err = tx.CreateBucketIfNotExists([]byte(mempoolBucket))
+			if err != nil {
+				return err
+			}
+			//旧的数据库中只有主链，没有记录累计工作量
+			needChainWork = tx.Bucket([]byte(chainWorkBucket)) == nil
+			_, err = tx.CreateBucketIfNotExists([]byte(invalidBlockBucket))
+			if err != nil {
+				return err
+			}
+			//旧的数据库中没有撤销记录，之前的区块断开时在主链上查找被花费的交易
+			_, err = tx.CreateBucketIfNotExists([]byte(undoBucket))
+			if err != nil {
+				return err
+			}
+			_, err = tx.CreateBucketIfNotExists([]byte(headerBucket))
+			if err != nil {
+				return err
+			}
+			subsidy, err = getSubsidySchedule(tx)
+			if err != nil {
+				return err
+			}
 		}
 		return nil
 	})
-	return &BlockChain{db, lastHash}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	blockChain := &BlockChain{db: db, tail: lastHash, engine: engine, subsidy: subsidy}
+	if needHeightIndex {
+		err = blockChain.reindexHeight()
+	}
+	if err == nil && needReindex {
+		_, err = blockChain.ReindexUTXO()
+	}
+	if err == nil && needTxIndex {
+		err = blockChain.reindexTx()
+	}
+	if err == nil && needChainWork {
+		err = blockChain.reindexChainWork()
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return blockChain, nil
 }
 
-//创建创世区块
-func GenisisBlock(address string) *Block {
-	coinbase := NewCoinbaseTX(address, "我是第一个块")
-	block := NewBlock([]*Transaction{coinbase}, []byte{})
-	block.setHash()
-	return block
+//关闭数据库
+func (blockChain *BlockChain) Close() {
+	blockChain.db.Close()
 }
 
-func (blockChain *BlockChain) FindUTXO(senderPubKeyHash []byte) []TXOutput {
-	var UTXO []TXOutput
-	//我们定义一个map来保存消费过的output，key是这个output的交易id，value是这个交易中索引的数组
+//创建创世区块
+func GenisisBlock(engine Consensus, address string, subsidy SubsidySchedule) (*Block, error) {
+	coinbase, err := NewCoinbaseTX(address, "我是第一个块", 0, subsidy.Subsidy(0), 0)
+	if err != nil {
+		return nil, err
+	}
+	bits, err := engine.CalcDifficulty(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	block := NewBlock([]*Transaction{coinbase}, []byte{}, 0, bits)
+	err = engine.Seal(context.Background(), nil, block)
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
 
-	txs := blockChain.FindUTXOTransaction(senderPubKeyHash)
+//为旧数据库重建高度索引
+//旧区块中没有存储高度，从尾部遍历到创世区块后倒序编号，同时把高度写回区块
+func (blockChain *BlockChain) reindexHeight() error {
+	var hashes [][]byte
+	it := blockChain.NewIterator()
+	for {
+		block, err := it.Next()
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, block.NowHash)
+		if len(block.PreHash) == 0 {
+			break
+		}
+	}
 
-	for _, tx := range txs {
-		for _, output := range tx.TXOutputs {
-			if bytes.Equal(senderPubKeyHash, output.PubKeyHash) {
-				UTXO = append(UTXO, output)
+	err := blockChain.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(blockBucket))
+		heights, err := tx.CreateBucketIfNotExists([]byte(heightBucket))
+		if err != nil {
+			return err
+		}
+		for i, hash := range hashes {
+			height := uint64(len(hashes) - 1 - i)
+			block, err := Deserialize(bucket.Get(hash))
+			if err != nil {
+				return err
+			}
+			block.Height = height
+			err = bucket.Put(hash, block.Serialize())
+			if err != nil {
+				return err
+			}
+			err = heights.Put(uint64ToByte(height), hash)
+			if err != nil {
+				return err
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("重建高度索引失败：%w", err)
 	}
-
-	return UTXO
+	return nil
 }
 
-func (blockChain *BlockChain) FindNeedUTXOs(senderPubKeyHash []byte, amount float64) (map[string][]uint64, float64) {
-	//找到合理的utxos集合
-	utxos := make(map[string][]uint64)
-	//我们定义一个map来保存消费过的output，key是这个output的交易id，value是这个交易中索引的数组
-	var calc float64
-
-	txs := blockChain.FindUTXOTransaction(senderPubKeyHash)
+//根据哈希获取区块，找不到时返回ErrBlockNotFound
+//侧链上的区块也保存在区块bucket中，同样可以找到
+func (blockChain *BlockChain) GetBlockByHash(hash []byte) (*Block, error) {
+	var block *Block
+	err := blockChain.db.View(func(tx *bolt.Tx) error {
+		var err error
+		block, err = getBlock(tx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return block, nil
+}
 
-	for _, tx := range txs {
-		for i, output := range tx.TXOutputs {
-			//两个[]byte比较
-			if bytes.Equal(senderPubKeyHash, output.PubKeyHash) {
-				if calc < amount {
-					//1.把utxo加进来
-					//array := utxos[string(tx.TXID)]
-					//array = append(array, uint64(i))
-					utxos[string(tx.TXID)] = append(utxos[string(tx.TXID)], uint64(i))
-					//2.统计一下当前utxo得总额
-					calc += output.Value
+//在bolt事务中根据哈希读取区块
+func getBlock(tx *bolt.Tx, hash []byte) (*Block, error) {
+	bucket := tx.Bucket([]byte(blockBucket))
+	if bucket == nil {
+		return nil, fmt.Errorf("%w：区块bucket不存在", ErrDatabase)
+	}
+	data := bucket.Get(hash)
+	if data == nil {
+		return nil, fmt.Errorf("%w：没有找到哈希为%x的区块", ErrBlockNotFound, hash)
+	}
+	block, err := Deserialize(data)
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
+}
 
-					//3.比较一下是否满足转账需求
-					//	a.满足的话，直接返回 utxos，calc
-					//  b.不满足继续统计
-					if calc >= amount {
-						return utxos, calc
-					}
-				} else {
-					fmt.Printf("不满足转账金额。当前金额：%f,目前金额：%f\n", calc, amount)
-				}
-			}
+//根据高度获取区块，找不到时返回ErrBlockNotFound
+func (blockChain *BlockChain) GetBlockByHeight(height uint64) (*Block, error) {
+	var hash []byte
+	err := blockChain.db.View(func(tx *bolt.Tx) error {
+		heights := tx.Bucket([]byte(heightBucket))
+		if heights == nil {
+			return fmt.Errorf("%w：高度索引bucket不存在", ErrDatabase)
 		}
+		hash = append([]byte{}, heights.Get(uint64ToByte(height))...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-
-	return utxos, calc
+	if len(hash) == 0 {
+		best, err := blockChain.BestHeight()
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w：没有找到高度为%d的区块，当前最大高度：%d", ErrBlockNotFound, height, best)
+	}
+	return blockChain.GetBlockByHash(hash)
 }
 
-func (blockChain *BlockChain) FindUTXOTransaction(senderPubKeyHash []byte) []*Transaction {
-	//var UTXO []TXOutput
-	//存储所有包含utxo交易集合
-	var txs []*Transaction
-	//我们定义一个map来保存消费过的output，key是这个output的交易id，value是这个交易中索引的数组
-	spendOutputs := make(map[string][]int64)
-	//1.遍历区块
-	//2.遍历交易
-	//3.遍历output，找到和自己相关的utxo（在添加output之前检查一下是否已经消耗过）
-	//4.遍历input，找到自己花费过的utxo的集合（把自己小号过的标识出来）
+//返回主链尾部区块的哈希
+//节点中收到区块和挖矿在不同的协程中进行，tail与加入区块时一样用chainLock保护
+func (blockChain *BlockChain) Tip() []byte {
+	blockChain.chainLock.Lock()
+	defer blockChain.chainLock.Unlock()
+	return blockChain.tail
+}
 
-	//创建迭代器
-	it := blockChain.NewIterator()
-	for {
-		//1.遍历区块
-		block := it.Next()
+//返回最后一个区块的高度
+func (blockChain *BlockChain) BestHeight() (uint64, error) {
+	block, err := blockChain.GetBlockByHash(blockChain.Tip())
+	if err != nil {
+		return 0, err
+	}
+	return block.Height, nil
+}
 
-		//2.遍历交易
-		for _, tx := range block.Transactions {
+//区块定位器：主链上从尾部开始的一组区块哈希，最近的10个逐个列出，之后间隔加倍，最后是创世区块
+//对方在自己的主链上找到第一个存在的哈希就是两条链的分叉点，分叉再远也只需要O(log n)个哈希
+func (blockChain *BlockChain) BlockLocator() ([][]byte, error) {
+	bestHeight, err := blockChain.BestHeight()
+	if err != nil {
+		return nil, err
+	}
+	var locator [][]byte
+	err = blockChain.db.View(func(tx *bolt.Tx) error {
+		heights := tx.Bucket([]byte(heightBucket))
+		step := uint64(1)
+		height := bestHeight
+		for {
+			hash := heights.Get(uint64ToByte(height))
+			if hash == nil {
+				return fmt.Errorf("%w：高度索引中没有高度%d", ErrDatabase, height)
+			}
+			locator = append(locator, append([]byte{}, hash...))
+			if height == 0 {
+				return nil
+			}
+			if len(locator) >= 10 {
+				step *= 2
+			}
+			if height < step {
+				height = 0
+			} else {
+				height -= step
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return locator, nil
+}
 
-			//3.遍历output
-		OUTPUT:
-			for i, output := range tx.TXOutputs {
-				//这个output和我们目标的地址相同，满足条件，加到返回UTXO的数组中
-				//在这里进行过滤，将所有消耗过的outputs和当前的所即将添加的output对比
-				//如果相同，则跳过，否则添加
-				if spendOutputs[string(tx.TXID)] != nil {
-					for _, j := range spendOutputs[string(tx.TXID)] {
-						if int64(i) == j {
-							//当前准备添加output已经消耗过了，不再添加
-							continue OUTPUT
-						}
-					}
-				}
-				if bytes.Equal(output.PubKeyHash, senderPubKeyHash) {
-					//UTXO = append(UTXO, output)
-					txs = append(txs, tx)
-				}
+//在主链上找到定位器中第一个存在的区块，返回它之后的主链区块哈希，最多max个，遇到stop时停止（包含stop）
+//定位器中的区块都不在主链上时从创世区块之后开始
+func (blockChain *BlockChain) BlocksAfter(locator [][]byte, stop []byte, max int) ([][]byte, error) {
+	var hashes [][]byte
+	err := blockChain.db.View(func(tx *bolt.Tx) error {
+		heights := tx.Bucket([]byte(heightBucket))
+		start := uint64(0)
+		for _, hash := range locator {
+			block, err := getBlock(tx, hash)
+			if errors.Is(err, ErrBlockNotFound) {
+				continue
 			}
-			//如果当前交易是挖矿交易的话，那么不做遍历，直接跳过
-			if !tx.IsCoinbase() {
-				//4.遍历input
-				for _, input := range tx.TXInputs {
-					//判断一下当前这个input和目标是否一致，如果相同就是已经被花费，加入map
-					if bytes.Equal(HashPubKey(input.PubKey), senderPubKeyHash) {
-						spendOutputs[string(input.TXid)] = append(spendOutputs[string(input.TXid)], input.Index)
-					}
-				}
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(heights.Get(uint64ToByte(block.Height)), hash) {
+				start = block.Height
+				break
 			}
 		}
-		if len(block.PreHash) == 0 {
-			break
-			fmt.Printf("区块链遍历完成退出!")
+		for height := start + 1; len(hashes) < max; height++ {
+			hash := heights.Get(uint64ToByte(height))
+			if hash == nil {
+				break
+			}
+			hashes = append(hashes, append([]byte{}, hash...))
+			if bytes.Equal(hash, stop) {
+				break
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
 
+//根据id查找主链上的交易本身以及交易所在的区块
+//启用了交易索引时直接通过索引定位，否则需要遍历整个区块链
+func (bc *BlockChain) FindTransactionWithBlock(id []byte) (Transaction, *Block, error) {
+	var tx *Transaction
+	var block *Block
+	err := bc.db.View(func(boltTx *bolt.Tx) error {
+		var err error
+		tx, block, err = findTransaction(boltTx, id)
+		return err
+	})
+	if err != nil {
+		return Transaction{}, nil, err
 	}
-	return txs
+	return *tx, block, nil
 }
 
-//根据id查找交易本身，需要遍历整个区块链
-func (bc *BlockChain) FindTransactionByTXid(id []byte) (Transaction, error) {
-	it := bc.NewIterator()
-	//1.遍历区块链
-	for {
-		block := it.Next()
+//在bolt事务中查找主链上的交易，在写事务中调用时可以看到事务中尚未提交的修改
+func findTransaction(boltTx *bolt.Tx, id []byte) (*Transaction, *Block, error) {
+	if index := boltTx.Bucket([]byte(txIndexBucket)); index != nil {
+		data := index.Get(id)
+		if data == nil {
+			return nil, nil, fmt.Errorf("%w：%x", ErrTxNotFound, id)
+		}
+		location, err := DeserializeTxLocation(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		block, err := getBlock(boltTx, location.BlockHash)
+		if err != nil {
+			return nil, nil, err
+		}
+		if location.Position >= uint64(len(block.Transactions)) {
+			return nil, nil, fmt.Errorf("%w：交易索引中的位置超出了区块的交易个数", ErrDatabase)
+		}
+		return block.Transactions[location.Position], block, nil
+	}
+
+	//1.从尾部开始遍历区块链
+	hash := boltTx.Bucket([]byte(blockBucket)).Get([]byte("LastHashKey"))
+	for len(hash) != 0 {
+		block, err := getBlock(boltTx, hash)
+		if err != nil {
+			return nil, nil, err
+		}
 		//2.遍历交易
 		for _, tx := range block.Transactions {
 			//3.比较交易，找到了直接退出
 			if bytes.Equal(tx.TXID, id) {
-				return *tx, nil
+				return tx, block, nil
 			}
 		}
-		if len(block.PreHash) == 0 {
-			break
-			fmt.Printf("区块链遍历结束！\n")
-		}
+		hash = block.PreHash
+	}
+	//4.如果没找到，返回错误状态
+	return nil, nil, fmt.Errorf("%w：%x", ErrTxNotFound, id)
+}
+
+//根据id查找交易本身
+func (bc *BlockChain) FindTransactionByTXid(id []byte) (Transaction, error) {
+	tx, _, err := bc.FindTransactionWithBlock(id)
+	return tx, err
+}
 
+//找到交易所有input引用的交易
+//pending中是尚未上链的交易（同一个区块中前面的交易或者交易池中的交易），先在其中查找，找不到再查区块链
+func (bc *BlockChain) findPrevTransactions(tx *Transaction, pending map[string]Transaction) (map[string]Transaction, error) {
+	prevTXs := make(map[string]Transaction)
+	for _, input := range tx.TXInputs {
+		prevTX, ok := pending[string(input.TXid)]
+		if !ok {
+			var err error
+			prevTX, err = bc.FindTransactionByTXid(input.TXid)
+			if err != nil {
+				return nil, fmt.Errorf("找不到input引用的交易：%w", err)
+			}
+		}
+		if input.Index < 0 || input.Index >= int64(len(prevTX.TXOutputs)) {
+			return nil, fmt.Errorf("input引用的output不存在：%x[%d]", input.TXid, input.Index)
+		}
+		prevTXs[string(input.TXid)] = prevTX
 	}
-	//4.如果没找到，返回空Transaction，同时返回错误状态
-	return Transaction{}, errors.New("无效的交易id，请自查!")
+	return prevTXs, nil
 }
 
-func (bc *BlockChain) SignTransaction(tx *Transaction, privateKey *ecdsa.PrivateKey) {
+//找到交易引用的所有交易后签名，引用的交易不存在时返回ErrTxNotFound
+//pending中是交易池中还没有上链的交易，花费未确认的output时从这里找
+func (bc *BlockChain) SignTransaction(tx *Transaction, privateKey *ecdsa.PrivateKey, pending map[string]Transaction) error {
 	prevTXs := make(map[string]Transaction)
 	//找到所有的input交易
 	//1.根据inputs来找，有多少input，就遍历多少次
 	//2.找到目标交易，（根据TXid来找）
 	//3.添加到prevTXs
 	for _, input := range tx.TXInputs {
-		//根据TXid去找交易,需要遍历所有的区块链
+		if prevTX, ok := pending[string(input.TXid)]; ok {
+			prevTXs[string(input.TXid)] = prevTX
+			continue
+		}
+		//根据TXid去找交易,启用交易索引时不需要遍历区块链
 		tx, err := bc.FindTransactionByTXid(input.TXid)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 		prevTXs[string(input.TXid)] = tx
 	}
 
-	tx.Sign(privateKey, prevTXs)
+	return tx.Sign(privateKey, prevTXs)
 }
 
-func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
+//校验交易的签名，引用的交易不存在时返回ErrTxNotFound
+func (bc *BlockChain) VerifyTransaction(tx *Transaction) (bool, error) {
 	prevTXs := make(map[string]Transaction)
 	//找到所有的input交易
 	//1.根据inputs来找，有多少input，就遍历多少次
 	//2.找到目标交易，（根据TXid来找）
 	//3.添加到prevTXs
 	for _, input := range tx.TXInputs {
-		//根据TXid去找交易,需要遍历所有的区块链
+		//根据TXid去找交易,启用交易索引时不需要遍历区块链
 		tx, err := bc.FindTransactionByTXid(input.TXid)
 		if err != nil {
-			log.Panic(err)
+			return false, err
 		}
 		prevTXs[string(input.TXid)] = tx
 	}
-	return tx.Verify(prevTXs)
+	return tx.Verify(prevTXs), nil
 }
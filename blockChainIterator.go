@@ -1,8 +1,8 @@
 package main
 
 import (
+	"fmt"
 	"github.com/boltdb/bolt"
-	"log"
 )
 
 type BlockChainIterator struct {
@@ -14,27 +14,38 @@ type BlockChainIterator struct {
 func (blockChain *BlockChain) NewIterator() *BlockChainIterator {
 	return &BlockChainIterator{
 		blockChain.db,
-		blockChain.tail,
+		blockChain.Tip(),
 	}
 }
 
 //迭代器属于区块链，next属于迭代器
 //1.返回当前的区块
 //2.指针前移
-func (blockChainIterator *BlockChainIterator) Next() *Block {
+//区块不存在或者无法解码时返回错误
+func (blockChainIterator *BlockChainIterator) Next() (*Block, error) {
 	var block Block
-	blockChainIterator.db.View(func(tx *bolt.Tx) error {
+	err := blockChainIterator.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(blockBucket))
 		if bucket == nil {
-			log.Panic("迭代器遍历时bucket不应该为空，请自查！")
+			return fmt.Errorf("%w：区块bucket不存在", ErrDatabase)
 		}
 		blockTmp := bucket.Get(blockChainIterator.currentHshPointer)
+		if blockTmp == nil {
+			return fmt.Errorf("%w：%x", ErrBlockNotFound, blockChainIterator.currentHshPointer)
+		}
 		//解码
-		block = Deserialize(blockTmp)
+		var err error
+		block, err = Deserialize(blockTmp)
+		if err != nil {
+			return err
+		}
 		//游标左移
 		blockChainIterator.currentHshPointer = block.PreHash
 
 		return nil
 	})
-	return &block
+	if err != nil {
+		return nil, err
+	}
+	return &block, nil
 }
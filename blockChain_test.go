@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"github.com/boltdb/bolt"
+	"math/big"
+	"os"
+	"testing"
+)
+
+//测试用的共识引擎：不需要挖矿，区块哈希就是区块头的哈希，每个区块的工作量都是1
+type testEngine struct{}
+
+func (engine *testEngine) Name() string {
+	return "test"
+}
+
+func (engine *testEngine) Seal(ctx context.Context, chain *BlockChain, block *Block) error {
+	block.NowHash = block.CalcHash()
+	return nil
+}
+
+func (engine *testEngine) VerifySeal(chain HeaderReader, block *Block) error {
+	return nil
+}
+
+func (engine *testEngine) CalcDifficulty(chain HeaderReader, prev *Block) (uint64, error) {
+	return initialBits, nil
+}
+
+func (engine *testEngine) BlockWork(block *Block) *big.Int {
+	return big.NewInt(1)
+}
+
+//数据库、钱包和配置文件都使用相对路径，所以测试期间切换到临时目录，测试结束后切换回来
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+}
+
+//在当前目录中打开区块链，测试结束时关闭
+func openTestChain(t *testing.T) *BlockChain {
+	t.Helper()
+	bc, err := NewBlockChain(&testEngine{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//测试不需要每次提交都写盘
+	bc.db.NoSync = true
+	t.Cleanup(bc.Close)
+	return bc
+}
+
+//在临时目录中创建区块链，返回区块链和创世区块奖励的地址
+func newTestChain(t *testing.T) (*BlockChain, string) {
+	t.Helper()
+	chdirTemp(t)
+	bc := openTestChain(t)
+	ws, err := NewWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bc, ws.ListAddresses()[0]
+}
+
+//把交易池中的交易打包，连续挖n个区块，奖励给miner
+func mineBlocks(t *testing.T, bc *BlockChain, pool *Mempool, miner string, n int) *Block {
+	t.Helper()
+	var block *Block
+	for i := 0; i < n; i++ {
+		var err error
+		block, err = bc.MineBlock(context.Background(), pool, miner, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return block
+}
+
+//在parent之后创建一个只有铸币交易的区块，不加入区块链，data用来区分同一高度的不同区块
+func newTestBlock(t *testing.T, parent *Block, miner, data string) *Block {
+	t.Helper()
+	coinbase, err := NewCoinbaseTX(miner, data, parent.Height+1, defaultSubsidySchedule.Subsidy(parent.Height+1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := NewBlock([]*Transaction{coinbase}, parent.NowHash, parent.Height+1, initialBits)
+	block.NowHash = block.CalcHash()
+	return block
+}
+
+//读取UTXO集合的全部内容，key是交易ID
+func readUTXOSet(t *testing.T, bc *BlockChain) map[string][]byte {
+	t.Helper()
+	set := make(map[string][]byte)
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(utxoBucket)).ForEach(func(k, v []byte) error {
+			set[string(k)] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func headerTestBlock(version uint64) *Block {
+	return &Block{
+		Version:        version,
+		PreHash:        bytes.Repeat([]byte{1}, 32),
+		MerKerTreeRoot: bytes.Repeat([]byte{2}, 32),
+		Nonce:          3,
+		Difficulty:     initialBits,
+		TimeStamp:      1665064000,
+		Height:         5,
+	}
+}
+
+//版本1直接拼接时，把一个字段末尾的字节移到下一个字段开头得到相同的区块头，版本2不会
+func TestHeaderBytesFieldBoundaries(t *testing.T) {
+	tests := []struct {
+		name  string
+		shift func(block *Block)
+	}{
+		{"PreHash与MerKerTreeRoot", func(block *Block) {
+			block.MerKerTreeRoot = append(block.PreHash[31:], block.MerKerTreeRoot...)
+			block.PreHash = block.PreHash[:31]
+		}},
+		{"Signer与Vote", func(block *Block) {
+			block.Vote = append(block.Signer[63:], block.Vote...)
+			block.Signer = block.Signer[:63]
+		}},
+	}
+	for _, version := range []uint64{blockVersionConcat, blockVersionPrefixed} {
+		for _, test := range tests {
+			block := headerTestBlock(version)
+			block.Signer = bytes.Repeat([]byte{4}, 64)
+			block.Vote = bytes.Repeat([]byte{5}, 20)
+			shifted := *block
+			shifted.PreHash = append([]byte{}, block.PreHash...)
+			shifted.Signer = append([]byte{}, block.Signer...)
+			test.shift(&shifted)
+
+			same := bytes.Equal(block.HeaderBytes(block.Nonce), shifted.HeaderBytes(shifted.Nonce))
+			if version == blockVersionConcat && !same {
+				t.Errorf("版本1 %s：直接拼接的区块头应该相同", test.name)
+			}
+			if version == blockVersionPrefixed && same {
+				t.Errorf("版本2 %s：移动字段边界之后区块头相同", test.name)
+			}
+		}
+	}
+}
+
+//版本1保持原来的拼接方式，已有区块的哈希不变
+func TestHeaderBytesLegacyLayout(t *testing.T) {
+	block := headerTestBlock(blockVersionConcat)
+	want := bytes.Join([][]byte{
+		uint64ToByte(block.Version),
+		block.PreHash,
+		block.MerKerTreeRoot,
+		uint64ToByte(block.Nonce),
+		uint64ToByte(block.Difficulty),
+		uint64ToByte(block.TimeStamp),
+		uint64ToByte(block.Height),
+	}, nil)
+	if !bytes.Equal(block.HeaderBytes(block.Nonce), want) {
+		t.Fatal("版本1的区块头与原来的拼接方式不同")
+	}
+}
+
+//挖矿时直接改写NonceOffset处的8个字节，结果必须与HeaderBytes(nonce)相同
+func TestNonceOffset(t *testing.T) {
+	for _, version := range []uint64{blockVersionConcat, blockVersionPrefixed} {
+		for _, signer := range [][]byte{nil, bytes.Repeat([]byte{4}, 64)} {
+			block := headerTestBlock(version)
+			block.Signer = signer
+			data := block.HeaderBytes(0)
+			binary.BigEndian.PutUint64(data[block.NonceOffset():], 12345)
+			if !bytes.Equal(data, block.HeaderBytes(12345)) {
+				t.Errorf("版本%d：NonceOffset不正确", version)
+			}
+		}
+	}
+}
+
+func TestNewBlockVersion(t *testing.T) {
+	block := NewBlock(nil, nil, 0, initialBits)
+	if block.Version != blockVersion {
+		t.Fatalf("新区块的版本为%d，应该为%d", block.Version, blockVersion)
+	}
+}
+
+//不支持的版本以及低于上一个区块的版本都不接受
+func TestAcceptBlockVersion(t *testing.T) {
+	bc, miner := newTestChain(t)
+	pool, err := bc.LoadMempool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip := mineBlocks(t, bc, pool, miner, 1)
+	for _, version := range []uint64{0, blockVersionConcat, blockVersion + 1} {
+		block := newTestBlock(t, tip, miner, "version")
+		block.Version = version
+		block.NowHash = block.CalcHash()
+		_, err = bc.AcceptBlock(block)
+		if !errors.Is(err, ErrInvalidBlock) {
+			t.Errorf("版本为%d的区块应该被拒绝：%v", version, err)
+		}
+	}
+}
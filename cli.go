@@ -1,32 +1,59 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 //这是一个用来接受命令行参数并且控制区块链操作的文件
 
 type CLI struct {
 	bc *BlockChain
+	//用户按下Ctrl-C时被取消，用于中断挖矿
+	ctx context.Context
 }
 
 const Usage = `
 	printChain 				   "打印区块链"
 	getBalance --address ADDRESS "获取指定地址的余额"
-	send FROM TO AMOUNT MINER DATA   "由FROM转AMOUNT给TO，由MINER挖矿，同时写入DATA"
+	send FROM TO AMOUNT MINER DATA [--fee FEE | --feerate RATE]   "由FROM转AMOUNT给TO，由MINER挖矿，同时写入DATA，手续费为FEE个币或每字节RATE个最小单位"
+	submitTx FROM TO AMOUNT [--fee FEE | --feerate RATE]   "创建转账交易并放入交易池"
+	listMempool "打印交易池中的交易"
+	dropTx --id TXID "从交易池中删除交易"
+	mine --miner ADDRESS [--data DATA] "把交易池中的交易打包挖矿"
+	supply "打印当前高度实际发行的币的总量和奖励计划"
+	migrateEncoding "把旧数据库中gob格式的区块转换为二进制格式"
 	newWallet 	"创建一个钱包（私钥、公钥对）"
 	listAddresses "列举所有的钱包地址"
+	reindexUTXO "重建UTXO集合"
+	verifyChain "从创世区块开始校验整个区块链"
+	rollback --blocks N "删除主链尾部的N个区块，交易放回交易池"
+	propose --add ADDRESS | --remove ADDRESS "poa：投票增加或删除签名者"
+	listSigners "poa：打印当前的授权签名者"
+	getBlock --height N | --hash HASH "根据高度或哈希打印区块"
+	getTransaction --id TXID "打印交易以及所在区块和确认数"
+	setTxIndex --on | --off "打开或关闭交易索引，关闭后查找交易需要遍历主链"
+	getMerkleProof --tx TXID "生成交易的默克尔证明并验证"
+	startNode --port PORT [--peers HOST:PORT,...] [--miner ADDRESS] [--maxInbound N] [--maxOutbound N] "启动p2p节点，同步区块并转发交易，指定MINER时打包交易池中的交易挖矿，被动和主动连接默认最多32和8个"
+	listPeers "打印运行中的节点连接的节点，以及封禁的ip"
+	banPeer --address IP [--duration DURATION] "封禁ip（默认24h），运行中的节点会断开它的连接"
+	unbanPeer --address IP "解除对ip的封禁"
 `
 
 //接受参数的动作，我们放在一个函数中
-func (cli *CLI) Run() {
+//命令执行失败时返回错误，参数不正确时返回ErrUsage
+func (cli *CLI) Run() error {
 	//1.得到所有的命令
 	args := os.Args
 	if len(args) < 2 {
-		fmt.Printf(Usage)
-		return
+		return fmt.Errorf("%w：缺少命令", ErrUsage)
 	}
 
 	//2.分析命令
@@ -36,40 +63,292 @@ func (cli *CLI) Run() {
 	case "printChain":
 		//打印区块
 		//fmt.Printf("打印区块")
-		cli.FmtBlockChain()
+		return cli.FmtBlockChain()
 	case "getBalance":
 		//获取余额
-		if len(args) == 4 && args[2] == "--address" {
-			address := args[3]
-			cli.GetBalance(address)
-		} else {
-			fmt.Println("获取余额参数使用不当，请自查！")
-			fmt.Println(Usage)
+		if len(args) != 4 || args[2] != "--address" {
+			return fmt.Errorf("%w：getBalance", ErrUsage)
 		}
+		address := args[3]
+		return cli.GetBalance(address)
 	case "send":
 		fmt.Printf("转账开始...\n")
-		if len(args) != 7 {
-			fmt.Printf("参数个数错误，请检查！\n")
-			fmt.Printf(Usage)
-			return
+		if len(args) != 7 && len(args) != 9 {
+			return fmt.Errorf("%w：send参数个数错误", ErrUsage)
 		}
-		//.block send FROM TO AMOUNT MINER DATA   "由FROM转AMOUNT给TO，由MINER挖矿，同时写入DATA"
+		//.block send FROM TO AMOUNT MINER DATA [--fee FEE | --feerate RATE]
 		from := args[2]
 		to := args[3]
-		amount, _ := strconv.ParseFloat(args[4], 64)
+		amount, err := ParseAmount(args[4])
+		if err != nil {
+			return fmt.Errorf("%w：%v", ErrUsage, err)
+		}
 		miner := args[5]
 		data := args[6]
-		cli.Send(from, to, amount, miner, data)
+		fee, feeRate, err := parseFeeOption(args[7:])
+		if err != nil {
+			return err
+		}
+		return cli.Send(from, to, amount, fee, feeRate, miner, data)
+	case "submitTx":
+		if len(args) != 5 && len(args) != 7 {
+			return fmt.Errorf("%w：submitTx", ErrUsage)
+		}
+		amount, err := ParseAmount(args[4])
+		if err != nil {
+			return fmt.Errorf("%w：%v", ErrUsage, err)
+		}
+		fee, feeRate, err := parseFeeOption(args[5:])
+		if err != nil {
+			return err
+		}
+		return cli.SubmitTx(args[2], args[3], amount, fee, feeRate)
+	case "listMempool":
+		return cli.ListMempool()
+	case "dropTx":
+		if len(args) != 4 || args[2] != "--id" {
+			return fmt.Errorf("%w：dropTx", ErrUsage)
+		}
+		id, err := hex.DecodeString(args[3])
+		if err != nil {
+			return fmt.Errorf("%w：无效的交易ID：%s", ErrUsage, args[3])
+		}
+		return cli.DropTx(id)
+	case "mine":
+		if (len(args) != 4 && len(args) != 6) || args[2] != "--miner" || (len(args) == 6 && args[4] != "--data") {
+			return fmt.Errorf("%w：mine", ErrUsage)
+		}
+		data := ""
+		if len(args) == 6 {
+			data = args[5]
+		}
+		return cli.Mine(args[3], data)
 	case "newWallet":
 		//fmt.Printf("创建一个新的钱包")
-		cli.NewWallet()
+		return cli.NewWallet()
 	case "listAddresses":
 		//打印区块
 		//fmt.Printf("打印钱包地址")
-		cli.listAddresses()
+		return cli.listAddresses()
+	case "getBlock":
+		if len(args) != 4 {
+			return fmt.Errorf("%w：getBlock", ErrUsage)
+		}
+		switch args[2] {
+		case "--height":
+			height, err := strconv.ParseUint(args[3], 10, 64)
+			if err != nil {
+				return fmt.Errorf("%w：无效的高度：%s", ErrUsage, args[3])
+			}
+			return cli.GetBlockByHeight(height)
+		case "--hash":
+			hash, err := hex.DecodeString(args[3])
+			if err != nil {
+				return fmt.Errorf("%w：无效的哈希：%s", ErrUsage, args[3])
+			}
+			return cli.GetBlockByHash(hash)
+		default:
+			return fmt.Errorf("%w：getBlock", ErrUsage)
+		}
+	case "getTransaction":
+		if len(args) != 4 || args[2] != "--id" {
+			return fmt.Errorf("%w：getTransaction", ErrUsage)
+		}
+		id, err := hex.DecodeString(args[3])
+		if err != nil {
+			return fmt.Errorf("%w：无效的交易ID：%s", ErrUsage, args[3])
+		}
+		return cli.GetTransaction(id)
+	case "setTxIndex":
+		if len(args) != 3 || (args[2] != "--on" && args[2] != "--off") {
+			return fmt.Errorf("%w：setTxIndex", ErrUsage)
+		}
+		return cli.SetTxIndex(args[2] == "--on")
+	case "getMerkleProof":
+		if len(args) != 4 || args[2] != "--tx" {
+			return fmt.Errorf("%w：getMerkleProof", ErrUsage)
+		}
+		id, err := hex.DecodeString(args[3])
+		if err != nil {
+			return fmt.Errorf("%w：无效的交易ID：%s", ErrUsage, args[3])
+		}
+		return cli.GetMerkleProof(id)
+	case "reindexUTXO":
+		return cli.ReindexUTXO()
+	case "verifyChain":
+		return cli.VerifyChain()
+	case "rollback":
+		if len(args) != 4 || args[2] != "--blocks" {
+			return fmt.Errorf("%w：rollback", ErrUsage)
+		}
+		n, err := strconv.ParseUint(args[3], 10, 64)
+		if err != nil || n == 0 {
+			return fmt.Errorf("%w：无效的区块个数：%s", ErrUsage, args[3])
+		}
+		return cli.Rollback(n)
+	case "propose":
+		if len(args) != 4 || (args[2] != "--add" && args[2] != "--remove") {
+			return fmt.Errorf("%w：propose", ErrUsage)
+		}
+		return cli.Propose(args[3], args[2] == "--add")
+	case "listSigners":
+		return cli.ListSigners()
+	case "supply":
+		return cli.Supply()
+	case "startNode":
+		return cli.parseStartNode(args[2:])
+	case "listPeers":
+		return cli.ListPeers()
+	case "banPeer":
+		if (len(args) != 4 && len(args) != 6) || args[2] != "--address" {
+			return fmt.Errorf("%w：banPeer", ErrUsage)
+		}
+		host, err := parsePeerHost(args[3])
+		if err != nil {
+			return err
+		}
+		duration := defaultBanDuration
+		if len(args) == 6 {
+			if args[4] != "--duration" {
+				return fmt.Errorf("%w：banPeer", ErrUsage)
+			}
+			duration, err = time.ParseDuration(args[5])
+			if err != nil || duration <= 0 {
+				return fmt.Errorf("%w：无效的封禁时间：%s", ErrUsage, args[5])
+			}
+		}
+		return cli.BanPeer(host, duration)
+	case "unbanPeer":
+		if len(args) != 4 || args[2] != "--address" {
+			return fmt.Errorf("%w：unbanPeer", ErrUsage)
+		}
+		host, err := parsePeerHost(args[3])
+		if err != nil {
+			return err
+		}
+		return cli.UnbanPeer(host)
 	default:
-		fmt.Printf("出错了")
-		fmt.Printf(Usage)
+		return fmt.Errorf("%w：未知的命令%s", ErrUsage, cmd)
 	}
+}
+
+//解析startNode的参数：--port PORT [--peers HOST:PORT,...] [--miner ADDRESS] [--maxInbound N] [--maxOutbound N]，顺序任意
+func (cli *CLI) parseStartNode(args []string) error {
+	if len(args)%2 != 0 {
+		return fmt.Errorf("%w：startNode", ErrUsage)
+	}
+	port := 0
+	var peers []string
+	miner := ""
+	maxInbound, maxOutbound := defaultMaxInbound, defaultMaxOutbound
+	for i := 0; i < len(args); i += 2 {
+		switch args[i] {
+		case "--port":
+			p, err := strconv.Atoi(args[i+1])
+			if err != nil || p <= 0 || p > 65535 {
+				return fmt.Errorf("%w：无效的端口：%s", ErrUsage, args[i+1])
+			}
+			port = p
+		case "--peers":
+			for _, addr := range strings.Split(args[i+1], ",") {
+				if addr != "" {
+					peers = append(peers, addr)
+				}
+			}
+		case "--miner":
+			miner = args[i+1]
+		case "--maxInbound", "--maxOutbound":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return fmt.Errorf("%w：无效的连接数：%s", ErrUsage, args[i+1])
+			}
+			if args[i] == "--maxInbound" {
+				maxInbound = n
+			} else {
+				maxOutbound = n
+			}
+		default:
+			return fmt.Errorf("%w：startNode不支持参数%s", ErrUsage, args[i])
+		}
+	}
+	if port == 0 {
+		return fmt.Errorf("%w：startNode缺少--port", ErrUsage)
+	}
+	return cli.StartNode(port, peers, miner, maxInbound, maxOutbound)
+}
+
+//解析banPeer/unbanPeer的地址，可以带端口，返回ip
+func parsePeerHost(addr string) (string, error) {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("%w：无效的ip：%s", ErrUsage, addr)
+	}
+	return ip.String(), nil
+}
 
+//解析可选的手续费参数：--fee FEE（币）或 --feerate RATE（每字节的最小单位个数），都没有时手续费为0
+func parseFeeOption(args []string) (Amount, Amount, error) {
+	if len(args) == 0 {
+		return 0, 0, nil
+	}
+	if len(args) != 2 {
+		return 0, 0, fmt.Errorf("%w：手续费参数", ErrUsage)
+	}
+	switch args[0] {
+	case "--fee":
+		fee, err := ParseAmount(args[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("%w：%v", ErrUsage, err)
+		}
+		return fee, 0, nil
+	case "--feerate":
+		rate, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || rate <= 0 {
+			return 0, 0, fmt.Errorf("%w：无效的手续费费率：%s", ErrUsage, args[1])
+		}
+		return 0, Amount(rate), nil
+	default:
+		return 0, 0, fmt.Errorf("%w：手续费参数", ErrUsage)
+	}
+}
+
+//进程的退出码：成功为0，命令执行失败为1，参数不正确为2
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+//打印错误以及对应的提示，返回进程的退出码
+func reportError(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	fmt.Printf("出错了：%v\n", err)
+	switch {
+	case errors.Is(err, ErrUsage):
+		fmt.Print(Usage)
+		return exitUsage
+	case errors.Is(err, ErrInvalidAddress):
+		fmt.Println("请检查地址是否完整，可以执行listAddresses查看本地钱包中的地址")
+	case errors.Is(err, ErrWalletNotFound):
+		fmt.Println("只能从本地钱包中的地址转账，可以执行listAddresses查看")
+	case errors.Is(err, ErrInsufficientFunds):
+		fmt.Println("可以执行getBalance查看可用余额，未成熟的挖矿奖励暂时不能花费")
+	case errors.Is(err, ErrTxNotFound), errors.Is(err, ErrBlockNotFound):
+		fmt.Println("请检查ID或哈希是否正确")
+	case errors.Is(err, ErrWalletFile):
+		fmt.Printf("请检查%s是否可以读写\n", walletFile)
+	case errors.Is(err, ErrPeerFile):
+		fmt.Printf("请检查%s和%s是否可以读写\n", banListFile, peersFile)
+	case errors.Is(err, ErrCorruptBlock), errors.Is(err, ErrCorruptTx), errors.Is(err, ErrDatabase):
+		fmt.Printf("%s可能已经损坏，可以执行verifyChain检查，或者执行reindexUTXO重建UTXO集合\n", blockChainDb)
+	case errors.Is(err, ErrConsensusMismatch):
+		fmt.Printf("请检查工作目录中的%s是否与创建区块链时一致\n", poaConfigFile)
+	}
+	return exitError
 }
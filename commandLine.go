@@ -1,91 +1,538 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"github.com/boltdb/bolt"
+	"sort"
 	"time"
 )
 
 //打印
-func (cli *CLI) FmtBlockChain() {
+func (cli *CLI) FmtBlockChain() error {
 	//创建迭代器
 	it := cli.bc.NewIterator()
 	//调用迭代器，返回每一个区块数据
 	for {
-		block := it.Next()
+		block, err := it.Next()
+		if err != nil {
+			return err
+		}
 
-		fmt.Println("========================================")
-		fmt.Printf("版本号：%d\n", block.Version)
-		fmt.Printf("前区块哈希值：%x\n", block.PreHash)
-		fmt.Printf("默克尔树根：%x\n", block.MerKerTreeRoot)
-		fmt.Printf("当前区块哈希值：%x\n", block.NowHash)
-		fmt.Printf("区块数据：%s\n", block.Transactions[0].TXInputs[0].PubKey)
-		timeFormat := time.Unix(int64(block.TimeStamp), 0).Format("2006-01-02 15:04:05")
-		fmt.Printf("时间戳：%s\n", timeFormat)
+		printBlock(block)
 
 		if len(block.PreHash) == 0 {
 			fmt.Printf("区块链遍历结束")
-			break
+			return nil
+		}
+	}
+}
+
+//打印单个区块
+func printBlock(block *Block) {
+	fmt.Println("========================================")
+	fmt.Printf("版本号：%d\n", block.Version)
+	fmt.Printf("区块高度：%d\n", block.Height)
+	fmt.Printf("前区块哈希值：%x\n", block.PreHash)
+	fmt.Printf("默克尔树根：%x\n", block.MerKerTreeRoot)
+	fmt.Printf("难度：%08x\n", block.Difficulty)
+	fmt.Printf("当前区块哈希值：%x\n", block.NowHash)
+	if len(block.Signer) != 0 {
+		fmt.Printf("签名者：%s\n", PubKeyHashToAddress(HashPubKey(block.Signer)))
+		if len(block.Vote) != 0 && block.VoteAdd {
+			fmt.Printf("投票增加签名者：%s\n", PubKeyHashToAddress(block.Vote))
+		} else if len(block.Vote) != 0 {
+			fmt.Printf("投票删除签名者：%s\n", PubKeyHashToAddress(block.Vote))
 		}
 	}
+	fmt.Printf("区块数据：%s\n", block.Transactions[0].CoinbaseData(block.Height))
+	timeFormat := time.Unix(int64(block.TimeStamp), 0).Format("2006-01-02 15:04:05")
+	fmt.Printf("时间戳：%s\n", timeFormat)
+}
+
+//根据高度或哈希打印区块
+func (cli *CLI) GetBlockByHeight(height uint64) error {
+	block, err := cli.bc.GetBlockByHeight(height)
+	if err != nil {
+		return err
+	}
+	printBlock(block)
+	return nil
+}
+
+func (cli *CLI) GetBlockByHash(hash []byte) error {
+	block, err := cli.bc.GetBlockByHash(hash)
+	if err != nil {
+		return err
+	}
+	printBlock(block)
+	return nil
+}
+
+//根据交易ID打印交易以及所在区块、确认数
+func (cli *CLI) GetTransaction(id []byte) error {
+	tx, block, err := cli.bc.FindTransactionWithBlock(id)
+	if err != nil {
+		return err
+	}
+	bestHeight, err := cli.bc.BestHeight()
+	if err != nil {
+		return err
+	}
+	confirmations := bestHeight - block.Height + 1
+
+	printTransaction(&tx, block.Height)
+	if !tx.IsCoinbase() {
+		fee, err := cli.bc.TransactionFee(&tx)
+		if err != nil {
+			fmt.Printf("计算手续费失败：%v\n", err)
+		} else {
+			fmt.Printf("手续费：%s\n", fee)
+		}
+	}
+	fmt.Printf("所在区块哈希值：%x\n", block.NowHash)
+	fmt.Printf("所在区块高度：%d\n", block.Height)
+	fmt.Printf("确认数：%d\n", confirmations)
+	return nil
+}
+
+//打印单个交易
+func printTransaction(tx *Transaction, height uint64) {
+	fmt.Println("========================================")
+	fmt.Printf("交易ID：%x\n", tx.TXID)
+	for i, input := range tx.TXInputs {
+		if tx.IsCoinbase() {
+			fmt.Printf("input[%d]：铸币交易，数据：%s\n", i, tx.CoinbaseData(height))
+			continue
+		}
+		fmt.Printf("input[%d]：引用交易%x的output[%d]，付款地址：%s\n", i, input.TXid, input.Index, PubKeyHashToAddress(HashPubKey(input.PubKey)))
+	}
+	for i, output := range tx.TXOutputs {
+		fmt.Printf("output[%d]：金额%s，收款地址：%s\n", i, output.Value, PubKeyHashToAddress(output.PubKeyHash))
+	}
+}
+
+//生成交易的默克尔证明，并用所在区块头中的默克尔树根验证
+func (cli *CLI) GetMerkleProof(id []byte) error {
+	_, block, err := cli.bc.FindTransactionWithBlock(id)
+	if err != nil {
+		return err
+	}
+	proof, err := GenerateMerkleProof(block.Transactions, id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("交易ID：%x\n", proof.TXID)
+	fmt.Printf("交易位置：%d\n", proof.Index)
+	for i, hash := range proof.Hashes {
+		fmt.Printf("第%d层兄弟节点：%x\n", i, hash)
+	}
+	fmt.Printf("所在区块哈希值：%x\n", block.NowHash)
+	fmt.Printf("默克尔树根：%x\n", block.MerKerTreeRoot)
+	if !VerifyMerkleProof(block.MerKerTreeRoot, proof) {
+		return errors.New("默克尔证明验证失败")
+	}
+	fmt.Printf("验证通过！\n")
+	return nil
 }
 
 //获取地址的余额
-func (cli *CLI) GetBalance(address string) {
+func (cli *CLI) GetBalance(address string) error {
 
-	//1.校验地址
-	if !IsValidAddress(address) {
-		fmt.Printf("地址无效：%s\n", address)
-		return
+	//1.校验地址，生成公钥哈希
+	pubKeyHash, err := GetPubKeyFromAddress(address)
+	if err != nil {
+		return err
 	}
-	//2.生成公钥哈希
-	pubKeyHash := GetPubKeyFromAddress(address)
 
-	utxos := cli.bc.FindUTXO(pubKeyHash)
-	total := 0.0
-	for _, utxo := range utxos {
-		total += utxo.Value
+	mature, immature, err := cli.bc.Balance(pubKeyHash)
+	if err != nil {
+		return fmt.Errorf("统计余额出错：%w", err)
 	}
-	fmt.Printf("\"%s\"余额为：%f\n", address, total)
+	total, err := AddAmount(mature, immature)
+	if err != nil {
+		return fmt.Errorf("统计余额出错：%w", err)
+	}
+	fmt.Printf("\"%s\"余额为：%s（可用：%s，未成熟：%s）\n", address, total, mature, immature)
+	return nil
 }
 
 //发送交易
-func (cli *CLI) Send(from, to string, amount float64, miner, data string) {
+//fee为指定的手续费，feeRate大于0时按每字节feeRate计算手续费
+//交易先放入交易池，挖矿时交易池中已经排队的交易也一起打包
+func (cli *CLI) Send(from, to string, amount, fee, feeRate Amount, miner, data string) error {
+	if !IsValidAddress(miner) {
+		return fmt.Errorf("miner%w：%s", ErrInvalidAddress, miner)
+	}
+	//1.加载交易池，创建交易时不能选中交易池中已经花费的output
+	pool, err := cli.bc.LoadMempool()
+	if err != nil {
+		return err
+	}
+	//2.创建一个普遍交易并放入交易池
+	tx, err := cli.createTransaction(from, to, amount, fee, feeRate, pool)
+	if err != nil {
+		return err
+	}
+	err = pool.Add(cli.bc, tx)
+	if err != nil {
+		return fmt.Errorf("交易无效：%w", err)
+	}
+	//3.从交易池中打包交易挖矿，矿工领取挖矿奖励和手续费
+	_, err = cli.bc.MineBlock(cli.ctx, pool, miner, data)
+	if err != nil {
+		return fmt.Errorf("添加区块失败：%w", err)
+	}
+	fmt.Printf("转账结束！\n")
+	return nil
+}
 
-	//1.校验地址
+//校验地址并创建转账交易，pool为将要加入的交易池
+func (cli *CLI) createTransaction(from, to string, amount, fee, feeRate Amount, pool *Mempool) (*Transaction, error) {
 	if !IsValidAddress(from) {
-		fmt.Printf("from地址无效：%s\n", from)
-		return
+		return nil, fmt.Errorf("from%w：%s", ErrInvalidAddress, from)
 	}
 	if !IsValidAddress(to) {
-		fmt.Printf("to地址无效：%s\n", to)
-		return
+		return nil, fmt.Errorf("to%w：%s", ErrInvalidAddress, to)
 	}
-	if !IsValidAddress(miner) {
-		fmt.Printf("miner地址无效：%s\n", miner)
-		return
+
+	var tx *Transaction
+	var err error
+	if feeRate > 0 {
+		tx, fee, err = NewTransactionWithFeeRate(from, to, amount, feeRate, cli.bc, pool)
+	} else {
+		tx, err = NewTransaction(from, to, amount, fee, cli.bc, pool)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("创建交易失败：%w", err)
 	}
+	fmt.Printf("手续费：%s\n", fee)
+	return tx, nil
+}
 
-	//1.创建挖矿交易
-	coinbase := NewCoinbaseTX(miner, data)
-	//2.创建一个普遍交易
-	tx := NewTransaction(from, to, amount, cli.bc)
-	//3.添加到区块
-	cli.bc.AddBlock([]*Transaction{coinbase, tx})
-	fmt.Printf("转账结束！\n")
+//创建转账交易并放入交易池，等待之后挖矿打包
+func (cli *CLI) SubmitTx(from, to string, amount, fee, feeRate Amount) error {
+	//先加载交易池，交易池中排队的交易花费的output不会被再次选中
+	pool, err := cli.bc.LoadMempool()
+	if err != nil {
+		return err
+	}
+	tx, err := cli.createTransaction(from, to, amount, fee, feeRate, pool)
+	if err != nil {
+		return err
+	}
+	err = pool.Add(cli.bc, tx)
+	if err != nil {
+		return fmt.Errorf("交易无效：%w", err)
+	}
+	fmt.Printf("交易已加入交易池：%x\n", tx.TXID)
+	return nil
+}
+
+//按手续费费率从高到低打印交易池中的交易
+func (cli *CLI) ListMempool() error {
+	pool, err := cli.bc.LoadMempool()
+	if err != nil {
+		return err
+	}
+	entries := pool.List()
+	for _, entry := range entries {
+		fmt.Printf("%x  手续费：%s  大小：%d字节  费率：%.2f/字节\n", entry.tx.TXID, entry.fee, entry.size, entry.feeRate())
+	}
+	fmt.Printf("交易池中共有%d个交易\n", len(entries))
+	return nil
+}
+
+//从交易池中删除交易，花费它的output的交易也一起删除
+func (cli *CLI) DropTx(id []byte) error {
+	pool, err := cli.bc.LoadMempool()
+	if err != nil {
+		return err
+	}
+	removed, err := pool.Remove(id)
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return fmt.Errorf("%w：交易池中没有该交易：%x", ErrTxNotFound, id)
+	}
+	fmt.Printf("从交易池中删除了%d个交易\n", removed)
+	return nil
+}
+
+//把交易池中的交易打包挖矿
+func (cli *CLI) Mine(miner, data string) error {
+	if !IsValidAddress(miner) {
+		return fmt.Errorf("miner%w：%s", ErrInvalidAddress, miner)
+	}
+	pool, err := cli.bc.LoadMempool()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("交易池中有%d个交易\n", pool.Count())
+	block, err := cli.bc.MineBlock(cli.ctx, pool, miner, data)
+	if err != nil {
+		return fmt.Errorf("添加区块失败：%w", err)
+	}
+	fmt.Printf("区块高度：%d，打包了%d个交易，交易池中还剩%d个交易\n", block.Height, len(block.Transactions)-1, pool.Count())
+	return nil
 }
 
 //创建一个新的钱包
 
-func (cli *CLI) NewWallet() {
-	ws := NewWallets()
-	address := ws.CreateWallet()
+func (cli *CLI) NewWallet() error {
+	ws, err := NewWallets()
+	if err != nil {
+		return err
+	}
+	address, err := ws.CreateWallet()
+	if err != nil {
+		return err
+	}
 	fmt.Printf("地址：%s\n", address)
+	return nil
 }
 
-func (cli *CLI) listAddresses() {
-	ws := NewWallets()
+func (cli *CLI) listAddresses() error {
+	ws, err := NewWallets()
+	if err != nil {
+		return err
+	}
 	addresses := ws.ListAddresses()
 	for _, address := range addresses {
 		fmt.Printf("地址：%s\n", address)
 	}
+	return nil
+}
+
+//重建UTXO集合
+func (cli *CLI) ReindexUTXO() error {
+	count, err := cli.bc.ReindexUTXO()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("重建UTXO集合完成，共有%d个交易包含未花费的output\n", count)
+	return nil
+}
+
+//打开或关闭交易索引
+func (cli *CLI) SetTxIndex(enabled bool) error {
+	err := cli.bc.SetTxIndex(enabled)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		fmt.Println("交易索引已打开并重建")
+	} else {
+		fmt.Println("交易索引已关闭并删除，getTransaction等查找交易的命令需要遍历主链")
+	}
+	return nil
+}
+
+//删除主链尾部的n个区块
+func (cli *CLI) Rollback(n uint64) error {
+	removed, pruned, err := cli.bc.Rollback(n)
+	if err != nil {
+		return err
+	}
+	for _, block := range removed {
+		fmt.Printf("删除区块%d：%x\n", block.Height, block.NowHash)
+	}
+	if pruned > 0 {
+		fmt.Printf("同时删除了%d个保存在侧链上的后代区块和区块头\n", pruned)
+	}
+	//重新加载交易池，与回退后的主链冲突的交易会被删除
+	pool, err := cli.bc.LoadMempool()
+	if err != nil {
+		return err
+	}
+	bestHeight, err := cli.bc.BestHeight()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("回退完成，当前高度为%d，交易池中有%d个交易\n", bestHeight, pool.Count())
+	return nil
+}
+
+//启动p2p节点，直到按下Ctrl-C
+func (cli *CLI) StartNode(port int, peers []string, miner string, maxInbound, maxOutbound int) error {
+	if miner != "" && !IsValidAddress(miner) {
+		return fmt.Errorf("miner%w：%s", ErrInvalidAddress, miner)
+	}
+	node, err := NewNode(cli.bc, port, miner, maxInbound, maxOutbound)
+	if err != nil {
+		return err
+	}
+	return node.Run(cli.ctx, peers)
+}
+
+//打印运行中的节点连接的节点，以及封禁的ip，不需要打开区块链
+func (cli *CLI) ListPeers() error {
+	snapshot, err := LoadPeerSnapshot()
+	if err != nil {
+		return err
+	}
+	if snapshot == nil {
+		fmt.Printf("节点没有运行\n")
+	} else {
+		fmt.Printf("节点监听端口%d，更新于%s\n", snapshot.Port, snapshot.Time.Format("2006-01-02 15:04:05"))
+		//节点每隔几秒更新一次，很久没有更新说明节点没有正常退出
+		if time.Since(snapshot.Time) > time.Minute {
+			fmt.Printf("很久没有更新，节点可能已经停止\n")
+		}
+		sort.Slice(snapshot.Peers, func(i, j int) bool {
+			return snapshot.Peers[i].Addr < snapshot.Peers[j].Addr
+		})
+		for _, peer := range snapshot.Peers {
+			direction := "主动"
+			if peer.Inbound {
+				direction = "被动"
+			}
+			connected := time.Since(peer.ConnTime).Round(time.Second)
+			fmt.Printf("%s  %s连接  高度：%d  违规分数：%d  已连接%s\n", peer.Addr, direction, peer.Height, peer.Score, connected)
+		}
+		fmt.Printf("共连接了%d个节点\n", len(snapshot.Peers))
+	}
+
+	bans, err := LoadBanList()
+	if err != nil {
+		return err
+	}
+	var hosts []string
+	for host := range bans.Bans {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		ban := bans.Bans[host]
+		fmt.Printf("已封禁：%s  到%s解除  原因：%s\n", host, ban.Until.Format("2006-01-02 15:04:05"), ban.Reason)
+	}
+	fmt.Printf("共封禁了%d个ip\n", len(bans.Bans))
+	return nil
+}
+
+//封禁ip，运行中的节点重新读取封禁列表后断开它的连接
+func (cli *CLI) BanPeer(host string, duration time.Duration) error {
+	bans, err := LoadBanList()
+	if err != nil {
+		return err
+	}
+	bans.Ban(host, duration, "手动封禁")
+	err = bans.Save()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("已封禁%s，到%s解除\n", host, bans.Bans[host].Until.Format("2006-01-02 15:04:05"))
+	return nil
+}
+
+//解除对ip的封禁
+func (cli *CLI) UnbanPeer(host string) error {
+	bans, err := LoadBanList()
+	if err != nil {
+		return err
+	}
+	if !bans.Unban(host) {
+		return fmt.Errorf("%s没有被封禁", host)
+	}
+	err = bans.Save()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("已解除对%s的封禁\n", host)
+	return nil
+}
+
+//校验整个区块链
+func (cli *CLI) VerifyChain() error {
+	err := cli.bc.Validate()
+	if err != nil {
+		return fmt.Errorf("区块链校验失败！%w", err)
+	}
+	bestHeight, err := cli.bc.BestHeight()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("区块链校验通过，共%d个区块\n", bestHeight+1)
+	return nil
+}
+
+//poa：投票增加或删除签名者，写入poa.conf，本节点之后出块时会带上这个投票
+func (cli *CLI) Propose(address string, add bool) error {
+	if _, ok := cli.bc.engine.(*PoAEngine); !ok {
+		return errors.New("当前区块链没有使用poa共识")
+	}
+	if !IsValidAddress(address) {
+		return fmt.Errorf("%w：%s", ErrInvalidAddress, address)
+	}
+	err := AppendPoAVote(poaConfigFile, PoAVote{address, add})
+	if err != nil {
+		return fmt.Errorf("写入投票失败：%w", err)
+	}
+	fmt.Printf("投票已保存，之后出块时生效\n")
+	return nil
+}
+
+//poa：打印当前的授权签名者
+func (cli *CLI) ListSigners() error {
+	engine, ok := cli.bc.engine.(*PoAEngine)
+	if !ok {
+		return errors.New("当前区块链没有使用poa共识")
+	}
+	signers, err := engine.Signers(cli.bc, cli.bc.Tip())
+	if err != nil {
+		return err
+	}
+	bestHeight, err := cli.bc.BestHeight()
+	if err != nil {
+		return err
+	}
+	for i, signer := range signers {
+		fmt.Printf("签名者[%d]：%s\n", i, signer)
+	}
+	fmt.Printf("下一个区块由%s出块\n", signers[(bestHeight+1)%uint64(len(signers))])
+	return nil
+}
+
+//打印当前高度实际发行的币的总量，以及区块链的奖励计划
+func (cli *CLI) Supply() error {
+	height, err := cli.bc.BestHeight()
+	if err != nil {
+		return err
+	}
+	issued, err := cli.bc.IssuedSupply()
+	if err != nil {
+		return err
+	}
+	schedule := cli.bc.subsidy
+	fmt.Printf("当前高度：%d\n", height)
+	fmt.Printf("已发行总量：%s\n", issued)
+	fmt.Printf("奖励计划到当前高度的发行量：%s\n", schedule.TotalSupply(height))
+	fmt.Printf("奖励计划的发行总量：%s\n", schedule.MaxSupply())
+	fmt.Printf("初始挖矿奖励：%s，每%d个区块减半\n", schedule.InitialSubsidy, schedule.HalvingInterval)
+	fmt.Printf("铸币交易经过%d个区块成熟\n", schedule.CoinbaseMaturity)
+	fmt.Printf("下一个区块的挖矿奖励：%s\n", schedule.Subsidy(height+1))
+	fmt.Printf("下一次减半的高度：%d\n", (height/schedule.HalvingInterval+1)*schedule.HalvingInterval)
+	return nil
+}
+
+//把旧数据库中gob格式的区块转换为二进制格式，不需要先打开区块链
+func MigrateEncoding() error {
+	db, err := bolt.Open(blockChainDb, 0600, nil)
+	if err != nil {
+		return fmt.Errorf("%w：打开%s失败：%v", ErrDatabase, blockChainDb, err)
+	}
+	defer db.Close()
+
+	count, err := migrateEncoding(db)
+	if err != nil {
+		return fmt.Errorf("迁移失败：%w", err)
+	}
+	if count == 0 {
+		fmt.Println("数据库已经是二进制格式，不需要迁移")
+		return nil
+	}
+	fmt.Printf("迁移完成，共改写%d个区块\n", count)
+	return nil
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"os"
+)
+
+//共识引擎，区块链在创建时指定，默认使用sha256的工作量证明
+//1.Seal：对准备好的区块进行封装（pow中就是挖矿，找到nonce并设置NowHash）
+//2.VerifySeal：校验区块的封装是否满足共识规则
+//3.CalcDifficulty：计算prev之后下一个区块应该使用的难度
+//4.BlockWork：区块的工作量，分叉时选择累计工作量最大的分支作为主链
+//chain用来查询区块的祖先，创世区块时为nil
+type Consensus interface {
+	//引擎名称，创建区块链时写入数据库，防止用不同的引擎打开同一个区块链
+	Name() string
+	//ctx被取消时返回ErrMiningCancelled
+	Seal(ctx context.Context, chain *BlockChain, block *Block) error
+	VerifySeal(chain HeaderReader, block *Block) error
+	CalcDifficulty(chain HeaderReader, prev *Block) (uint64, error)
+	BlockWork(block *Block) *big.Int
+}
+
+//查询祖先区块头，校验封装和计算难度只需要区块头
+//BlockChain可以查到已经保存的区块和区块头，同步时还没有保存的一批区块头也需要能查到
+type HeaderReader interface {
+	//找不到时返回ErrBlockNotFound
+	GetHeader(hash []byte) (*Block, error)
+}
+
+//根据工作目录中的配置选择共识引擎：存在poa.conf时使用poa，否则使用pow
+func LoadConsensus() (Consensus, error) {
+	_, err := os.Stat(poaConfigFile)
+	if os.IsNotExist(err) {
+		return NewPowEngine(), nil
+	}
+	config, err := LoadPoAConfig(poaConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewPoAEngine(config)
+}
+
+//sha256工作量证明共识引擎
+type PowEngine struct{}
+
+//创建pow共识引擎
+func NewPowEngine() *PowEngine {
+	return &PowEngine{}
+}
+
+func (engine *PowEngine) Name() string {
+	return "pow"
+}
+
+//挖矿：不停的修改nonce，直到区块哈希满足难度要求
+func (engine *PowEngine) Seal(ctx context.Context, chain *BlockChain, block *Block) error {
+	pow := newProofOfWork(block)
+	//查找随机数，不停的对完整的区块头进行hash运算
+	hash, nonce, err := pow.Mine(ctx)
+	if err != nil {
+		return err
+	}
+	block.NowHash = hash
+	block.Nonce = nonce
+	return nil
+}
+
+//区块哈希满足区块中记录的难度要求
+func (engine *PowEngine) VerifySeal(chain HeaderReader, block *Block) error {
+	pow := newProofOfWork(block)
+	if !pow.IsValid(block.NowHash) {
+		return fmt.Errorf("区块哈希不满足难度要求：%x", block.NowHash)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+)
+
+//难度调整
+//区块的Difficulty字段保存紧凑格式的目标值（与比特币的nBits相同）：
+//最高字节是目标值的字节长度，低3个字节是目标值最高的3个字节
+//每retargetInterval个区块，根据实际出块时间与期望出块时间的比例重新计算一次目标值
+
+//每隔多少个区块调整一次难度
+const retargetInterval = 10
+
+//期望的出块间隔（秒）
+const targetBlockTime = 10
+
+//单次调整的最大倍数，与比特币一样限制为4倍
+const retargetClamp = 4
+
+//创世区块的难度，目标值为 0x0000100000...（即2^236）
+const initialBits = 0x1e100000
+
+//目标值的上限（最低难度），为 0x000fffff00...
+const powLimitBits = 0x1f0fffff
+
+//把紧凑格式转换为目标值
+func CompactToBig(bits uint64) *big.Int {
+	mantissa := int64(bits & 0x007fffff)
+	exponent := uint(bits>>24) & 0xff
+
+	target := big.NewInt(mantissa)
+	if exponent <= 3 {
+		target.Rsh(target, 8*(3-exponent))
+	} else {
+		target.Lsh(target, 8*(exponent-3))
+	}
+	return target
+}
+
+//把目标值转换为紧凑格式
+func BigToCompact(target *big.Int) uint64 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	exponent := uint(len(target.Bytes()))
+	var mantissa uint64
+	if exponent <= 3 {
+		mantissa = target.Uint64() << (8 * (3 - exponent))
+	} else {
+		tmp := new(big.Int).Rsh(target, 8*(exponent-3))
+		mantissa = tmp.Uint64()
+	}
+
+	//最高位是符号位，为1时需要右移一个字节
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+	return uint64(exponent)<<24 | mantissa
+}
+
+//区块使用的难度，旧版本的区块没有保存难度（为0），它们都是按创世难度挖出来的
+func blockBits(block *Block) uint64 {
+	if block.Difficulty == 0 {
+		return initialBits
+	}
+	return block.Difficulty
+}
+
+//计算prev的下一个区块应该使用的难度，由区块链的共识引擎决定
+func (blockChain *BlockChain) CalcNextDifficulty(prev *Block) (uint64, error) {
+	return blockChain.engine.CalcDifficulty(blockChain, prev)
+}
+
+//pow的难度调整
+//1.不是调整周期的第一个区块，沿用上一个区块的难度
+//2.否则找到上一个周期的第一个区块，用实际花费的时间调整目标值
+//沿着PreHash向前查找而不是用高度索引，这样对不在主链上的区块以及只有区块头的区块也能计算
+func (engine *PowEngine) CalcDifficulty(chain HeaderReader, prev *Block) (uint64, error) {
+	if prev == nil {
+		return initialBits, nil
+	}
+	prevBits := blockBits(prev)
+
+	height := prev.Height + 1
+	if height%retargetInterval != 0 {
+		return prevBits, nil
+	}
+
+	first := prev
+	for i := 0; i < retargetInterval-1; i++ {
+		var err error
+		first, err = chain.GetHeader(first.PreHash)
+		if err != nil {
+			return 0, fmt.Errorf("计算难度时找不到祖先区块：%v", err)
+		}
+	}
+
+	return calcRetarget(prevBits, first.TimeStamp, prev.TimeStamp), nil
+}
+
+//pow区块的工作量：平均需要计算多少次哈希才能找到满足难度的区块，即 2^256 / (目标值+1)
+func (engine *PowEngine) BlockWork(block *Block) *big.Int {
+	target := CompactToBig(blockBits(block))
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+	return work.Div(work, target.Add(target, big.NewInt(1)))
+}
+
+//根据一个周期实际花费的时间调整目标值
+func calcRetarget(bits, firstTime, lastTime uint64) uint64 {
+	expected := int64(retargetInterval * targetBlockTime)
+	actual := int64(lastTime) - int64(firstTime)
+	if actual < expected/retargetClamp {
+		actual = expected / retargetClamp
+	}
+	if actual > expected*retargetClamp {
+		actual = expected * retargetClamp
+	}
+
+	//新目标值 = 旧目标值 * 实际时间 / 期望时间
+	target := CompactToBig(bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	powLimit := CompactToBig(powLimitBits)
+	if target.Cmp(powLimit) > 0 {
+		target = powLimit
+	}
+	return BigToCompact(target)
+}
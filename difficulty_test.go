@@ -0,0 +1,159 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestCompactToBig(t *testing.T) {
+	tests := []struct {
+		bits uint64
+		want string
+	}{
+		{0x01123456, "12"},
+		{0x02123456, "1234"},
+		{0x03123456, "123456"},
+		{0x04123456, "12345600"},
+		{0x1d00ffff, "ffff0000000000000000000000000000000000000000000000000000"},
+		{initialBits, "100000000000000000000000000000000000000000000000000000000000"},
+		{powLimitBits, "fffff00000000000000000000000000000000000000000000000000000000"},
+	}
+	for _, test := range tests {
+		want, _ := new(big.Int).SetString(test.want, 16)
+		if got := CompactToBig(test.bits); got.Cmp(want) != 0 {
+			t.Errorf("CompactToBig(%08x) = %x，应该为%x", test.bits, got, want)
+		}
+	}
+}
+
+func TestBigToCompact(t *testing.T) {
+	tests := []struct {
+		target string
+		want   uint64
+	}{
+		{"0", 0},
+		{"12", 0x01120000},
+		{"1234", 0x02123400},
+		{"123456", 0x03123456},
+		//最高位为1时指数加1，避免被当作负数
+		{"80", 0x02008000},
+		{"800000", 0x04008000},
+		{"12345678", 0x04123456},
+		{"100000000000000000000000000000000000000000000000000000000000", initialBits},
+	}
+	for _, test := range tests {
+		target, _ := new(big.Int).SetString(test.target, 16)
+		if got := BigToCompact(target); got != test.want {
+			t.Errorf("BigToCompact(%s) = %08x，应该为%08x", test.target, got, test.want)
+		}
+	}
+	if got := BigToCompact(big.NewInt(-1)); got != 0 {
+		t.Errorf("负数的紧凑格式为%08x，应该为0", got)
+	}
+}
+
+//规范的紧凑格式转换为目标值再转换回来保持不变
+func TestCompactRoundTrip(t *testing.T) {
+	for _, bits := range []uint64{0x03123456, 0x04123456, 0x1d00ffff, 0x1b0404cb, initialBits, powLimitBits} {
+		if got := BigToCompact(CompactToBig(bits)); got != bits {
+			t.Errorf("%08x转换之后为%08x", bits, got)
+		}
+	}
+}
+
+func TestCalcRetarget(t *testing.T) {
+	const expected = retargetInterval * targetBlockTime
+	target := CompactToBig(initialBits)
+	scaled := func(num, den int64) uint64 {
+		t := new(big.Int).Mul(target, big.NewInt(num))
+		return BigToCompact(t.Div(t, big.NewInt(den)))
+	}
+	tests := []struct {
+		name   string
+		actual uint64
+		want   uint64
+	}{
+		{"与期望时间相同", expected, initialBits},
+		{"快一倍", expected / 2, scaled(1, 2)},
+		{"慢一倍", expected * 2, scaled(2, 1)},
+		{"刚好快4倍", expected / retargetClamp, scaled(1, retargetClamp)},
+		{"快100倍时限制为4倍", expected / 100, scaled(1, retargetClamp)},
+		{"时间为0时限制为4倍", 0, scaled(1, retargetClamp)},
+		{"刚好慢4倍", expected * retargetClamp, scaled(retargetClamp, 1)},
+		{"慢100倍时限制为4倍", expected * 100, scaled(retargetClamp, 1)},
+	}
+	const firstTime = 1000000
+	for _, test := range tests {
+		if got := calcRetarget(initialBits, firstTime, firstTime+test.actual); got != test.want {
+			t.Errorf("%s：难度为%08x，应该为%08x", test.name, got, test.want)
+		}
+	}
+	//时间戳倒退时按最快处理
+	if got := calcRetarget(initialBits, firstTime, firstTime-expected); got != scaled(1, retargetClamp) {
+		t.Errorf("时间戳倒退：难度为%08x", got)
+	}
+	//目标值不能超过上限
+	if got := calcRetarget(powLimitBits, firstTime, firstTime+expected*retargetClamp); got != powLimitBits {
+		t.Errorf("超过目标值上限：难度为%08x，应该为%08x", got, powLimitBits)
+	}
+}
+
+//按哈希查找区块头
+type testHeaders map[string]*Block
+
+func (headers testHeaders) GetHeader(hash []byte) (*Block, error) {
+	if header, ok := headers[string(hash)]; ok {
+		return header, nil
+	}
+	return nil, ErrBlockNotFound
+}
+
+//只在调整周期的边界上调整难度，调整时用上一个周期第一个区块到最后一个区块的时间
+func TestPowCalcDifficultyInterval(t *testing.T) {
+	headers := make(testHeaders)
+	var prev *Block
+	var chain []*Block
+	//每个区块间隔1秒，远快于期望的出块时间
+	for height := uint64(0); height < 2*retargetInterval; height++ {
+		block := &Block{Height: height, Difficulty: initialBits, TimeStamp: 1000000 + height, NowHash: []byte{byte(height + 1)}}
+		if prev != nil {
+			block.PreHash = prev.NowHash
+		}
+		headers[string(block.NowHash)] = block
+		chain = append(chain, block)
+		prev = block
+	}
+
+	engine := NewPowEngine()
+	bits, err := engine.CalcDifficulty(headers, nil)
+	if err != nil || bits != initialBits {
+		t.Fatalf("创世区块的难度为%08x：%v", bits, err)
+	}
+	for height := 1; height < retargetInterval; height++ {
+		bits, err = engine.CalcDifficulty(headers, chain[height-1])
+		if err != nil || bits != initialBits {
+			t.Fatalf("高度%d不是调整周期的边界，难度为%08x：%v", height, bits, err)
+		}
+	}
+
+	bits, err = engine.CalcDifficulty(headers, chain[retargetInterval-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := calcRetarget(initialBits, chain[0].TimeStamp, chain[retargetInterval-1].TimeStamp)
+	if bits != want {
+		t.Fatalf("高度%d的难度为%08x，应该为%08x", retargetInterval, bits, want)
+	}
+	//出块太快，目标值最多缩小为1/4
+	clamped := new(big.Int).Div(CompactToBig(initialBits), big.NewInt(retargetClamp))
+	if bits != BigToCompact(clamped) {
+		t.Fatalf("高度%d的难度为%08x，没有限制在4倍以内", retargetInterval, bits)
+	}
+
+	//缺少祖先区块时返回错误
+	delete(headers, string(chain[0].NowHash))
+	_, err = engine.CalcDifficulty(headers, chain[retargetInterval-1])
+	if err == nil {
+		t.Fatal("缺少祖先区块时应该返回错误")
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"io"
+)
+
+//区块和交易的二进制编码格式
+//gob的编码结果与Go的实现以及进程中类型注册的顺序有关，不能保证同样的数据编码出同样的字节
+//交易ID和区块都需要一个确定的、与语言无关的格式，所以使用下面这种定长整数加长度前缀的格式
+//
+//基本类型：
+//	uint32、uint64、int64：大端序定长整数，分别为4、8、8字节
+//	bool：1字节，0或1
+//	字节数组：4字节长度 + 内容，空数组的长度为0
+//
+//TXInput：    TXid(字节数组) | Index(int64) | Signature(字节数组) | PubKey(字节数组)
+//TXOutput：   Value(int64) | PubKeyHash(字节数组)
+//Transaction：格式版本(uint32) | TXID(字节数组) | input个数(uint32) | 每个TXInput | output个数(uint32) | 每个TXOutput
+//Block：      格式版本(uint32) | Version(uint64) | PreHash | MerKerTreeRoot | Nonce(uint64) | Difficulty(uint64) |
+//             TimeStamp(uint64) | Height(uint64) | Signer | Vote | VoteAdd(bool) | Signature | NowHash |
+//             交易个数(uint32) | 每个交易（字节数组，内容为交易的编码）
+//
+//交易ID是TXID为空时整个交易编码的sha256
+//格式版本不同时解码失败，以后修改格式需要增加版本号并兼容旧版本
+
+//交易编码的格式版本
+const txEncodingVersion uint32 = 1
+
+//区块编码的格式版本
+const blockEncodingVersion uint32 = 1
+
+//单个字节数组的最大长度，防止损坏的数据导致分配过大的内存
+const maxEncodedFieldLen = 1 << 24
+
+//数据库中区块格式的key，旧数据库中没有这个key，区块是gob格式，需要执行migrateEncoding
+const blockFormatKey = "BlockFormat"
+const blockFormatBinary = "binary1"
+
+//migrateEncoding迁移的旧区块：旧交易的ID是用gob计算的，旧的铸币交易中也没有记录区块高度
+//迁移后无法重新计算交易ID、校验签名和铸币交易中的高度，校验这些区块时跳过这三项
+//legacyHeightKey记录迁移时最后一个区块的高度，legacyBlockBucket记录所有迁移的区块哈希
+//只按高度判断的话，侧链上同样高度的新区块也会跳过校验，所以还要查询区块哈希
+const legacyHeightKey = "LegacyHeight"
+const legacyBlockBucket = "legacyBlockBucket"
+
+//block是否是迁移的旧区块，高度超过legacyHeightKey时不需要查询legacyBlockBucket
+func isLegacyBlock(tx *bolt.Tx, block *Block) bool {
+	meta := tx.Bucket([]byte(metaBucket))
+	if meta == nil {
+		return false
+	}
+	height := meta.Get([]byte(legacyHeightKey))
+	if len(height) != 8 || block.Height > binary.BigEndian.Uint64(height) {
+		return false
+	}
+	legacy := tx.Bucket([]byte(legacyBlockBucket))
+	return legacy != nil && legacy.Get(block.NowHash) != nil
+}
+
+func (blockChain *BlockChain) isLegacyBlock(block *Block) (bool, error) {
+	var legacy bool
+	err := blockChain.db.View(func(tx *bolt.Tx) error {
+		legacy = isLegacyBlock(tx, block)
+		return nil
+	})
+	return legacy, err
+}
+
+//编码时使用，出错之后的写入都会被忽略，最后检查一次err即可
+type encoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *encoder) write(data []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(data)
+}
+
+func (e *encoder) uint32(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	e.write(buf[:])
+}
+
+func (e *encoder) uint64(v uint64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	e.write(buf[:])
+}
+
+func (e *encoder) int64(v int64) {
+	e.uint64(uint64(v))
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.write([]byte{1})
+	} else {
+		e.write([]byte{0})
+	}
+}
+
+func (e *encoder) bytes(data []byte) {
+	if e.err == nil && len(data) > maxEncodedFieldLen {
+		e.err = fmt.Errorf("字节数组过长：%d", len(data))
+		return
+	}
+	e.uint32(uint32(len(data)))
+	e.write(data)
+}
+
+//解码时使用，出错之后的读取都返回零值，最后检查一次err即可
+type decoder struct {
+	r   io.Reader
+	err error
+}
+
+func (d *decoder) read(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	buf := make([]byte, n)
+	_, d.err = io.ReadFull(d.r, buf)
+	return buf
+}
+
+func (d *decoder) uint32() uint32 {
+	buf := d.read(4)
+	if d.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(buf)
+}
+
+func (d *decoder) uint64() uint64 {
+	buf := d.read(8)
+	if d.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(buf)
+}
+
+func (d *decoder) int64() int64 {
+	return int64(d.uint64())
+}
+
+func (d *decoder) bool() bool {
+	buf := d.read(1)
+	if d.err != nil {
+		return false
+	}
+	if buf[0] > 1 {
+		d.err = fmt.Errorf("无效的bool值：%d", buf[0])
+		return false
+	}
+	return buf[0] == 1
+}
+
+//空数组解码为nil
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	if n > maxEncodedFieldLen {
+		d.err = fmt.Errorf("字节数组过长：%d", n)
+		return nil
+	}
+	return d.read(int(n))
+}
+
+//编码交易输入
+func (input *TXInput) Encode(w io.Writer) error {
+	e := encoder{w: w}
+	e.bytes(input.TXid)
+	e.int64(input.Index)
+	e.bytes(input.Signature)
+	e.bytes(input.PubKey)
+	return e.err
+}
+
+//解码交易输入
+func (input *TXInput) Decode(r io.Reader) error {
+	d := decoder{r: r}
+	input.TXid = d.bytes()
+	input.Index = d.int64()
+	input.Signature = d.bytes()
+	input.PubKey = d.bytes()
+	return d.err
+}
+
+//编码交易输出
+func (output *TXOutput) Encode(w io.Writer) error {
+	e := encoder{w: w}
+	e.int64(int64(output.Value))
+	e.bytes(output.PubKeyHash)
+	return e.err
+}
+
+//解码交易输出
+func (output *TXOutput) Decode(r io.Reader) error {
+	d := decoder{r: r}
+	output.Value = Amount(d.int64())
+	output.PubKeyHash = d.bytes()
+	return d.err
+}
+
+//编码交易
+func (tx *Transaction) Encode(w io.Writer) error {
+	e := encoder{w: w}
+	e.uint32(txEncodingVersion)
+	e.bytes(tx.TXID)
+	e.uint32(uint32(len(tx.TXInputs)))
+	for i := range tx.TXInputs {
+		if e.err == nil {
+			e.err = tx.TXInputs[i].Encode(w)
+		}
+	}
+	e.uint32(uint32(len(tx.TXOutputs)))
+	for i := range tx.TXOutputs {
+		if e.err == nil {
+			e.err = tx.TXOutputs[i].Encode(w)
+		}
+	}
+	return e.err
+}
+
+//解码交易
+func (tx *Transaction) Decode(r io.Reader) error {
+	d := decoder{r: r}
+	version := d.uint32()
+	if d.err == nil && version != txEncodingVersion {
+		return fmt.Errorf("不支持的交易格式版本：%d", version)
+	}
+	tx.TXID = d.bytes()
+
+	tx.TXInputs = nil
+	count := d.uint32()
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		var input TXInput
+		d.err = input.Decode(r)
+		tx.TXInputs = append(tx.TXInputs, input)
+	}
+
+	tx.TXOutputs = nil
+	count = d.uint32()
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		var output TXOutput
+		d.err = output.Decode(r)
+		tx.TXOutputs = append(tx.TXOutputs, output)
+	}
+	return d.err
+}
+
+//编码区块，每个交易的编码前面加上长度
+func (block *Block) Encode(w io.Writer) error {
+	e := encoder{w: w}
+	e.uint32(blockEncodingVersion)
+	e.uint64(block.Version)
+	e.bytes(block.PreHash)
+	e.bytes(block.MerKerTreeRoot)
+	e.uint64(block.Nonce)
+	e.uint64(block.Difficulty)
+	e.uint64(block.TimeStamp)
+	e.uint64(block.Height)
+	e.bytes(block.Signer)
+	e.bytes(block.Vote)
+	e.bool(block.VoteAdd)
+	e.bytes(block.Signature)
+	e.bytes(block.NowHash)
+
+	e.uint32(uint32(len(block.Transactions)))
+	for _, tx := range block.Transactions {
+		if e.err != nil {
+			break
+		}
+		var buffer bytes.Buffer
+		e.err = tx.Encode(&buffer)
+		e.bytes(buffer.Bytes())
+	}
+	return e.err
+}
+
+//解码区块
+func (block *Block) Decode(r io.Reader) error {
+	d := decoder{r: r}
+	version := d.uint32()
+	if d.err == nil && version != blockEncodingVersion {
+		return fmt.Errorf("不支持的区块格式版本：%d", version)
+	}
+	block.Version = d.uint64()
+	block.PreHash = d.bytes()
+	block.MerKerTreeRoot = d.bytes()
+	block.Nonce = d.uint64()
+	block.Difficulty = d.uint64()
+	block.TimeStamp = d.uint64()
+	block.Height = d.uint64()
+	block.Signer = d.bytes()
+	block.Vote = d.bytes()
+	block.VoteAdd = d.bool()
+	block.Signature = d.bytes()
+	block.NowHash = d.bytes()
+
+	block.Transactions = nil
+	count := d.uint32()
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		data := d.bytes()
+		if d.err != nil {
+			break
+		}
+		var tx Transaction
+		reader := bytes.NewReader(data)
+		d.err = tx.Decode(reader)
+		if d.err == nil && reader.Len() != 0 {
+			d.err = fmt.Errorf("第%d个交易的编码后面有多余的数据", i)
+		}
+		block.Transactions = append(block.Transactions, &tx)
+	}
+	return d.err
+}
+
+//把旧数据库中gob格式的区块和交易池改写为二进制格式
+//更旧的数据库中金额为float64，同时迁移为整数金额，并删除旧的UTXO集合（打开区块链时会重建）
+//交易ID和区块哈希保持不变，旧交易的ID是用gob计算的，迁移后无法再用Hash和Verify重新校验
+//迁移的区块记录在legacyHeightKey和legacyBlockBucket中，校验时跳过这些检查
+//返回改写的区块个数，已经是二进制格式时返回0
+func migrateEncoding(db *bolt.DB) (int, error) {
+	migratedCount := 0
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(blockBucket))
+		if bucket == nil {
+			return errors.New("数据库中没有区块")
+		}
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		if string(meta.Get([]byte(blockFormatKey))) == blockFormatBinary {
+			return nil
+		}
+		floatAmounts := string(meta.Get([]byte(amountFormatKey))) != amountFormatInt64
+
+		//先收集再改写，遍历bucket的同时不能修改它
+		migrated := make(map[string][]byte)
+		parents := make(map[string][]byte)
+		err = bucket.ForEach(func(k, v []byte) error {
+			if string(k) == "LastHashKey" {
+				return nil
+			}
+			var block *Block
+			decoder := gob.NewDecoder(bytes.NewReader(v))
+			if floatAmounts {
+				var legacy legacyBlock
+				if err := decoder.Decode(&legacy); err != nil {
+					return fmt.Errorf("解码区块%x失败：%v", k, err)
+				}
+				block = legacy.convert()
+			} else {
+				block = &Block{}
+				if err := decoder.Decode(block); err != nil {
+					return fmt.Errorf("解码区块%x失败：%v", k, err)
+				}
+			}
+			migrated[string(k)] = block.Serialize()
+			parents[string(k)] = block.PreHash
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for hash, data := range migrated {
+			err = bucket.Put([]byte(hash), data)
+			if err != nil {
+				return err
+			}
+		}
+		migratedCount = len(migrated)
+
+		//旧数据库中只有主链，所有区块都是旧区块
+		//更旧的区块中没有记录高度（打开区块链时才重建高度索引），所以从最后一个区块数到创世区块
+		var tipHeight uint64
+		hash := bucket.Get([]byte("LastHashKey"))
+		for {
+			prev, ok := parents[string(hash)]
+			if !ok {
+				return fmt.Errorf("找不到区块%x", hash)
+			}
+			if len(prev) == 0 {
+				break
+			}
+			if tipHeight >= uint64(len(parents)) {
+				return errors.New("区块的前区块哈希形成了环")
+			}
+			tipHeight++
+			hash = prev
+		}
+		legacy, err := tx.CreateBucketIfNotExists([]byte(legacyBlockBucket))
+		if err != nil {
+			return err
+		}
+		for hash := range migrated {
+			err = legacy.Put([]byte(hash), []byte{1})
+			if err != nil {
+				return err
+			}
+		}
+		err = meta.Put([]byte(legacyHeightKey), uint64ToByte(tipHeight))
+		if err != nil {
+			return err
+		}
+
+		//交易池中的交易同样改写
+		if pool := tx.Bucket([]byte(mempoolBucket)); pool != nil {
+			pending := make(map[string][]byte)
+			err = pool.ForEach(func(k, v []byte) error {
+				var pendingTx Transaction
+				if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&pendingTx); err != nil {
+					return fmt.Errorf("解码交易池中的交易%x失败：%v", k, err)
+				}
+				pending[string(k)] = pendingTx.Serialize()
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for id, data := range pending {
+				err = pool.Put([]byte(id), data)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if floatAmounts {
+			if tx.Bucket([]byte(utxoBucket)) != nil {
+				err = tx.DeleteBucket([]byte(utxoBucket))
+				if err != nil {
+					return err
+				}
+			}
+			err = meta.Put([]byte(amountFormatKey), []byte(amountFormatInt64))
+			if err != nil {
+				return err
+			}
+		}
+		return meta.Put([]byte(blockFormatKey), []byte(blockFormatBinary))
+	})
+	return migratedCount, err
+}
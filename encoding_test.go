@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+//测试用的交易，所有字段都不为空（空数组解码为nil，无法与空切片比较）
+func encodingTestTxs() []*Transaction {
+	coinbase := &Transaction{
+		TXID:      bytes.Repeat([]byte{1}, 32),
+		TXInputs:  []TXInput{{nil, -1, nil, []byte("coinbase data")}},
+		TXOutputs: []TXOutput{{50 * CoinUnit, bytes.Repeat([]byte{2}, 20)}},
+	}
+	transfer := &Transaction{
+		TXID: bytes.Repeat([]byte{3}, 32),
+		TXInputs: []TXInput{
+			{coinbase.TXID, 0, bytes.Repeat([]byte{4}, 64), bytes.Repeat([]byte{5}, 64)},
+			{bytes.Repeat([]byte{6}, 32), 7, bytes.Repeat([]byte{8}, 64), bytes.Repeat([]byte{9}, 64)},
+		},
+		TXOutputs: []TXOutput{
+			{CoinUnit + 1, bytes.Repeat([]byte{10}, 20)},
+			{0, bytes.Repeat([]byte{11}, 20)},
+		},
+	}
+	return []*Transaction{coinbase, transfer}
+}
+
+func encodingTestBlock() *Block {
+	return &Block{
+		Version:        1,
+		PreHash:        bytes.Repeat([]byte{12}, 32),
+		MerKerTreeRoot: bytes.Repeat([]byte{13}, 32),
+		Nonce:          1<<64 - 1,
+		Difficulty:     initialBits,
+		TimeStamp:      1665064000,
+		Height:         42,
+		Signer:         bytes.Repeat([]byte{14}, 64),
+		Vote:           bytes.Repeat([]byte{15}, 20),
+		VoteAdd:        true,
+		Signature:      bytes.Repeat([]byte{16}, 64),
+		NowHash:        bytes.Repeat([]byte{17}, 32),
+		Transactions:   encodingTestTxs(),
+	}
+}
+
+func TestTransactionEncodingRoundTrip(t *testing.T) {
+	for i, tx := range encodingTestTxs() {
+		decoded, err := DeserializeTransaction(tx.Serialize())
+		if err != nil {
+			t.Fatalf("第%d个交易：%v", i, err)
+		}
+		if !reflect.DeepEqual(&decoded, tx) {
+			t.Errorf("第%d个交易解码之后与原交易不同：%+v", i, decoded)
+		}
+	}
+}
+
+func TestBlockEncodingRoundTrip(t *testing.T) {
+	blocks := []*Block{encodingTestBlock(), {Version: 1, Height: 0, NowHash: []byte{1}}}
+	for i, block := range blocks {
+		decoded, err := Deserialize(block.Serialize())
+		if err != nil {
+			t.Fatalf("第%d个区块：%v", i, err)
+		}
+		if !reflect.DeepEqual(&decoded, block) {
+			t.Errorf("第%d个区块解码之后与原区块不同：%+v", i, decoded)
+		}
+	}
+}
+
+//截断在任何位置都返回错误，而不是panic或者解码出不完整的数据
+func TestDecodeTruncated(t *testing.T) {
+	data := encodingTestBlock().Serialize()
+	for n := 0; n < len(data); n++ {
+		_, err := Deserialize(data[:n])
+		if !errors.Is(err, ErrCorruptBlock) {
+			t.Fatalf("截断到%d字节的区块：%v", n, err)
+		}
+	}
+	data = encodingTestTxs()[1].Serialize()
+	for n := 0; n < len(data); n++ {
+		_, err := DeserializeTransaction(data[:n])
+		if !errors.Is(err, ErrCorruptTx) {
+			t.Fatalf("截断到%d字节的交易：%v", n, err)
+		}
+	}
+}
+
+//长度超过上限、多余的数据、不支持的版本以及无效的bool都返回错误
+func TestDecodeMalformed(t *testing.T) {
+	block := encodingTestBlock().Serialize()
+	empty := (&Block{Version: 1}).Serialize()
+	tx := encodingTestTxs()[1].Serialize()
+	modify := func(data []byte, f func(data []byte)) []byte {
+		data = append([]byte{}, data...)
+		f(data)
+		return data
+	}
+	//区块编码中PreHash的长度在格式版本和Version之后
+	const preHashOffset = 4 + 8
+	//交易编码中TXID的长度在格式版本之后
+	const txidOffset = 4
+
+	blockTests := []struct {
+		name string
+		data []byte
+	}{
+		{"空数据", nil},
+		{"不支持的格式版本", modify(block, func(data []byte) { data[3]++ })},
+		{"字节数组超过上限", modify(block, func(data []byte) {
+			binary.BigEndian.PutUint32(data[preHashOffset:], maxEncodedFieldLen+1)
+		})},
+		{"字节数组长度超过剩余数据", modify(block, func(data []byte) {
+			binary.BigEndian.PutUint32(data[preHashOffset:], maxEncodedFieldLen)
+		})},
+		{"交易个数超过剩余数据", modify(empty, func(data []byte) {
+			binary.BigEndian.PutUint32(data[len(data)-4:], 1<<32-1)
+		})},
+		{"多余的数据", append(append([]byte{}, block...), 0)},
+	}
+	for _, test := range blockTests {
+		_, err := Deserialize(test.data)
+		if !errors.Is(err, ErrCorruptBlock) {
+			t.Errorf("区块%s：%v", test.name, err)
+		}
+	}
+
+	txTests := []struct {
+		name string
+		data []byte
+	}{
+		{"不支持的格式版本", modify(tx, func(data []byte) { data[3]++ })},
+		{"字节数组超过上限", modify(tx, func(data []byte) {
+			binary.BigEndian.PutUint32(data[txidOffset:], 1<<32-1)
+		})},
+		{"input个数超过剩余数据", modify(tx, func(data []byte) {
+			binary.BigEndian.PutUint32(data[txidOffset+4+32:], 1<<32-1)
+		})},
+		{"多余的数据", append(append([]byte{}, tx...), 0)},
+	}
+	for _, test := range txTests {
+		_, err := DeserializeTransaction(test.data)
+		if !errors.Is(err, ErrCorruptTx) {
+			t.Errorf("交易%s：%v", test.name, err)
+		}
+	}
+
+	//VoteAdd只能是0或1
+	b := encodingTestBlock()
+	voteAddOffset := preHashOffset + 4 + len(b.PreHash) + 4 + len(b.MerKerTreeRoot) + 8*4 + 4 + len(b.Signer) + 4 + len(b.Vote)
+	if block[voteAddOffset] != 1 {
+		t.Fatalf("VoteAdd的位置不正确：%d", voteAddOffset)
+	}
+	invalidBool := modify(block, func(data []byte) { data[voteAddOffset] = 2 })
+	if _, err := Deserialize(invalidBool); !errors.Is(err, ErrCorruptBlock) {
+		t.Errorf("无效的bool值：%v", err)
+	}
+}
+
+//仓库中的blockChain.db是旧版本的gob格式，迁移之后必须能通过校验，并且可以继续挖矿
+func TestMigrateLegacyChain(t *testing.T) {
+	legacy, err := ioutil.ReadFile(blockChainDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	err = ioutil.WriteFile(blockChainDb, legacy, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := bolt.Open(blockChainDb, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := migrateEncoding(db)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 {
+		t.Fatal("没有迁移任何区块")
+	}
+
+	bc, err := NewBlockChain(NewPowEngine())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	err = bc.Validate()
+	if err != nil {
+		t.Fatalf("迁移后的区块链校验失败：%v", err)
+	}
+
+	//迁移之后的新区块按新的规则校验
+	ws, err := NewWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	miner, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := bc.LoadMempool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := bc.MineBlock(context.Background(), pool, miner, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyBlock, err := bc.isLegacyBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacyBlock {
+		t.Fatal("迁移之后挖出的区块被当作旧区块")
+	}
+	err = bc.Validate()
+	if err != nil {
+		t.Fatalf("迁移后挖出新区块，区块链校验失败：%v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "errors"
+
+//常见的错误种类，具体的错误用fmt.Errorf("%w...")包装这些错误，调用方用errors.Is判断种类
+//命令行根据错误种类给出提示，并返回非0的退出码
+var (
+	//地址不是合法的base58编码，或者校验码不对
+	ErrInvalidAddress = errors.New("地址无效")
+	//可用余额不足以支付转账金额和手续费
+	ErrInsufficientFunds = errors.New("余额不足")
+	//区块链中找不到交易
+	ErrTxNotFound = errors.New("交易不存在")
+	//区块链中找不到区块
+	ErrBlockNotFound = errors.New("区块不存在")
+	//数据库中的区块无法解码
+	ErrCorruptBlock = errors.New("区块数据损坏")
+	//数据库中的交易无法解码
+	ErrCorruptTx = errors.New("交易数据损坏")
+	//本地钱包中没有这个地址的私钥
+	ErrWalletNotFound = errors.New("钱包中没有该地址")
+	//钱包文件无法读取或写入
+	ErrWalletFile = errors.New("钱包文件读写失败")
+	//封禁列表或者节点列表文件无法读取或写入
+	ErrPeerFile = errors.New("节点文件读写失败")
+	//数据库无法打开，或者缺少必要的bucket
+	ErrDatabase = errors.New("数据库出错")
+	//数据库是旧格式，需要先迁移
+	ErrOutdatedDatabase = errors.New("区块链数据库是旧的gob格式，请先执行migrateEncoding")
+	//数据库中记录的共识引擎与当前配置的不同
+	ErrConsensusMismatch = errors.New("区块链与当前配置的共识引擎不一致")
+	//命令行参数不正确
+	ErrUsage = errors.New("命令参数使用不当")
+)
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+//交易手续费
+//交易的inputs总额减去outputs总额就是手续费，由打包这个交易的矿工在铸币交易中领取
+//手续费可以直接指定，也可以按费率（每字节多少个最小单位）根据交易大小计算
+
+//交易编码后的字节数，用于按费率计算手续费
+func (tx *Transaction) Size() int {
+	return len(tx.Serialize())
+}
+
+//计算交易的手续费：找到每个input引用的output，求和后减去outputs总额
+//铸币交易没有手续费
+func (bc *BlockChain) TransactionFee(tx *Transaction) (Amount, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	var inputSum Amount
+	for _, input := range tx.TXInputs {
+		prevTX, err := bc.FindTransactionByTXid(input.TXid)
+		if err != nil {
+			return 0, err
+		}
+		if input.Index < 0 || input.Index >= int64(len(prevTX.TXOutputs)) {
+			return 0, fmt.Errorf("input引用的output不存在：%x[%d]", input.TXid, input.Index)
+		}
+		inputSum, err = AddAmount(inputSum, prevTX.TXOutputs[input.Index].Value)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	outputSum, err := tx.OutputSum()
+	if err != nil {
+		return 0, err
+	}
+	if inputSum < outputSum {
+		return 0, fmt.Errorf("output总额%s大于input总额%s", outputSum, inputSum)
+	}
+	return inputSum - outputSum, nil
+}
+
+//按费率创建转账交易，feeRate为每字节的手续费（最小单位）
+//交易大小取决于用了多少个input，而input又取决于手续费，所以反复创建直到手续费足够为止
+func NewTransactionWithFeeRate(from, to string, amount, feeRate Amount, bc *BlockChain, pool *Mempool) (*Transaction, Amount, error) {
+	var fee Amount
+	for {
+		tx, err := NewTransaction(from, to, amount, fee, bc, pool)
+		if err != nil {
+			return nil, 0, err
+		}
+		size := Amount(tx.Size())
+		if feeRate > math.MaxInt64/size {
+			return nil, 0, fmt.Errorf("手续费费率过高：%d", feeRate)
+		}
+		need := feeRate * size
+		if need <= fee {
+			return tx, fee, nil
+		}
+		fee = need
+	}
+}
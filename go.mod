@@ -3,8 +3,9 @@ module blockChain01
 go 1.18
 
 require (
-	github.com/boltdb/bolt v1.3.1 // indirect
-	github.com/mr-tron/base58 v1.2.0 // indirect
-	golang.org/x/crypto v0.0.0-20221005025214-4161e89ecf1b // indirect
-	golang.org/x/sys v0.0.0-20220919091848-fb04ddd9f9c8 // indirect
+	github.com/boltdb/bolt v1.3.1
+	github.com/mr-tron/base58 v1.2.0
+	golang.org/x/crypto v0.0.0-20221005025214-4161e89ecf1b
 )
+
+require golang.org/x/sys v0.0.0-20220919091848-fb04ddd9f9c8 // indirect
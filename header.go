@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"math/big"
+)
+
+//区块头
+//区块哈希覆盖了默克尔树根，默克尔树根覆盖了所有交易，所以只用区块头（去掉交易的区块）就能校验
+//工作量证明（或poa签名）、前区块哈希、高度、时间戳和难度，之后下载的区块体只需要与区块头比较哈希和默克尔树根
+//headers-first同步时先下载并校验区块头，保存在headerBucket中，累计工作量与区块一样保存在chainWorkBucket中
+//区块体保存之后删除单独的区块头
+const headerBucket = "headerBucket"
+
+//区块头：去掉交易的区块
+func (block *Block) Header() *Block {
+	header := *block
+	header.Transactions = nil
+	return &header
+}
+
+//在bolt事务中读取区块头：先查找区块，再查找只有区块头的区块，都没有时返回ErrBlockNotFound
+func getHeader(tx *bolt.Tx, hash []byte) (*Block, error) {
+	block, err := getBlock(tx, hash)
+	if err == nil {
+		return block.Header(), nil
+	}
+	if !errors.Is(err, ErrBlockNotFound) {
+		return nil, err
+	}
+	if bucket := tx.Bucket([]byte(headerBucket)); bucket != nil {
+		if data := bucket.Get(hash); data != nil {
+			header, err := Deserialize(data)
+			if err != nil {
+				return nil, err
+			}
+			return &header, nil
+		}
+	}
+	return nil, err
+}
+
+//根据哈希获取区块头，找不到时返回ErrBlockNotFound
+func (blockChain *BlockChain) GetHeader(hash []byte) (*Block, error) {
+	var header *Block
+	err := blockChain.db.View(func(tx *bolt.Tx) error {
+		var err error
+		header, err = getHeader(tx, hash)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+//读取区块或区块头所在分支的累计工作量
+func (blockChain *BlockChain) ChainWork(hash []byte) (*big.Int, error) {
+	var work *big.Int
+	err := blockChain.db.View(func(tx *bolt.Tx) error {
+		var err error
+		work, err = getChainWork(tx, hash)
+		return err
+	})
+	return work, err
+}
+
+//一批还没有保存的区块头，校验时与已经保存的区块头一起查询
+type headerBatch struct {
+	chain   *BlockChain
+	headers map[string]*Block
+}
+
+func (batch *headerBatch) GetHeader(hash []byte) (*Block, error) {
+	if header, ok := batch.headers[string(hash)]; ok {
+		return header, nil
+	}
+	return batch.chain.GetHeader(hash)
+}
+
+//校验区块头与前一个区块头的关系以及工作量证明（或poa签名），chain用来查询祖先区块头
+func (blockChain *BlockChain) validateHeader(chain HeaderReader, header, prev *Block) error {
+	err := blockChain.checkBlockContext(chain, header, prev)
+	if err != nil {
+		return err
+	}
+	return blockChain.engine.VerifySeal(chain, header)
+}
+
+//校验并保存一组连续的区块头，第一个区块头的前一个区块头必须已经保存，否则返回ErrOrphanBlock
+//已经有的区块头直接跳过，任何一个区块头无效时返回ErrInvalidBlock，整组都不保存
+//返回最后一个区块头所在分支的累计工作量
+func (blockChain *BlockChain) AcceptHeaders(headers []*Block) (*big.Int, error) {
+	if len(headers) == 0 {
+		return nil, errors.New("没有区块头")
+	}
+	prev, err := blockChain.GetHeader(headers[0].PreHash)
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil, fmt.Errorf("%w：%x", ErrOrphanBlock, headers[0].PreHash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &headerBatch{blockChain, make(map[string]*Block)}
+	for i, header := range headers {
+		if len(header.Transactions) != 0 {
+			return nil, fmt.Errorf("%w：区块头中不应该有交易", ErrInvalidBlock)
+		}
+		if i > 0 && !bytes.Equal(header.PreHash, headers[i-1].NowHash) {
+			return nil, fmt.Errorf("%w：第%d个区块头与前一个不连续", ErrInvalidBlock, i)
+		}
+		//哈希与内容相符时，已经有的区块头才与收到的相同，可以跳过
+		if !bytes.Equal(header.CalcHash(), header.NowHash) {
+			return nil, fmt.Errorf("%w：区块哈希不正确：%x", ErrInvalidBlock, header.NowHash)
+		}
+		_, invalid, err := blockChain.blockStatus(header.NowHash)
+		if err != nil {
+			return nil, err
+		}
+		if invalid {
+			return nil, fmt.Errorf("%w：%x之前已经校验失败", ErrInvalidBlock, header.NowHash)
+		}
+		_, err = blockChain.GetHeader(header.NowHash)
+		if err == nil {
+			prev = header
+			continue
+		}
+		if !errors.Is(err, ErrBlockNotFound) {
+			return nil, err
+		}
+		err = blockChain.validateHeader(batch, header, prev)
+		if err != nil {
+			return nil, rejectBlockError(header.NowHash, err)
+		}
+		batch.headers[string(header.NowHash)] = header
+		prev = header
+	}
+
+	var total *big.Int
+	err = blockChain.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(headerBucket))
+		works := tx.Bucket([]byte(chainWorkBucket))
+		for _, header := range headers {
+			if _, ok := batch.headers[string(header.NowHash)]; !ok {
+				var err error
+				total, err = getChainWork(tx, header.NowHash)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			parentWork, err := getChainWork(tx, header.PreHash)
+			if err != nil {
+				return err
+			}
+			total = new(big.Int).Add(parentWork, blockChain.engine.BlockWork(header))
+			err = bucket.Put(header.NowHash, header.Serialize())
+			if err != nil {
+				return err
+			}
+			err = works.Put(header.NowHash, total.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return total, nil
+}
+
+//主链上定位器之后的区块头，最多max个，参数与BlocksAfter相同
+func (blockChain *BlockChain) HeadersAfter(locator [][]byte, stop []byte, max int) ([]*Block, error) {
+	hashes, err := blockChain.BlocksAfter(locator, stop, max)
+	if err != nil {
+		return nil, err
+	}
+	var headers []*Block
+	for _, hash := range hashes {
+		header, err := blockChain.GetHeader(hash)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+	}
+	return headers, nil
+}
+
+//从tip向前直到主链上的区块，返回这个分支上还没有区块体的区块头，从低到高排序
+//侧链上已经保存的区块不需要重新下载，接入新分支时AcceptBlock会一起处理
+func (blockChain *BlockChain) MissingBodies(tip []byte) ([]*Block, error) {
+	var missing []*Block
+	err := blockChain.db.View(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket([]byte(blockBucket))
+		heights := tx.Bucket([]byte(heightBucket))
+		hash := tip
+		for {
+			header, err := getHeader(tx, hash)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(heights.Get(uint64ToByte(header.Height)), hash) {
+				return nil
+			}
+			if blocks.Get(hash) == nil {
+				missing = append(missing, header)
+			}
+			hash = header.PreHash
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(missing)-1; i < j; i, j = i+1, j-1 {
+		missing[i], missing[j] = missing[j], missing[i]
+	}
+	return missing, nil
+}
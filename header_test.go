@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+//在parent之后创建n个连续的区块，返回完整的区块，区块头用Header()获取
+func newTestBranch(t *testing.T, parent *Block, miner, data string, n int) []*Block {
+	t.Helper()
+	var blocks []*Block
+	for i := 0; i < n; i++ {
+		parent = newTestBlock(t, parent, miner, fmt.Sprintf("%s%d", data, i))
+		blocks = append(blocks, parent)
+	}
+	return blocks
+}
+
+//一组区块的区块头
+func headersOf(blocks []*Block) []*Block {
+	var headers []*Block
+	for _, block := range blocks {
+		headers = append(headers, block.Header())
+	}
+	return headers
+}
+
+//区块头是否已经保存
+func hasHeader(t *testing.T, bc *BlockChain, hash []byte) bool {
+	t.Helper()
+	_, err := bc.GetHeader(hash)
+	if err != nil && !errors.Is(err, ErrBlockNotFound) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+//区块头不连续、父区块未知或者带有交易时整组拒绝，一个都不保存
+//正常的区块头保存后返回累计工作量，MissingBodies返回还没有区块体的区块头
+func TestAcceptHeaders(t *testing.T) {
+	bc, miner := newTestChain(t)
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	branch := newTestBranch(t, genesis, miner, "branch", 3)
+
+	broken := headersOf(branch)
+	//第三个区块头接在第一个之后，与第二个不连续
+	broken[2] = newTestBlock(t, branch[0], miner, "broken").Header()
+	//第二个区块头的高度被修改，区块哈希仍然与内容相符
+	badHeight := headersOf(branch)
+	badHeight[1].Height++
+	badHeight[1].NowHash = badHeight[1].CalcHash()
+	badHeight[2].PreHash = badHeight[1].NowHash
+	badHeight[2].NowHash = badHeight[2].CalcHash()
+	//区块哈希与内容不符
+	badHash := headersOf(branch)
+	badHash[1].TimeStamp++
+
+	for _, c := range []struct {
+		name    string
+		headers []*Block
+		want    error
+	}{
+		{"区块头不连续", broken, ErrInvalidBlock},
+		{"高度与前一个区块头不符", badHeight, ErrInvalidBlock},
+		{"区块哈希不正确", badHash, ErrInvalidBlock},
+		{"区块头中有交易", branch, ErrInvalidBlock},
+		{"父区块未知", headersOf(branch[1:]), ErrOrphanBlock},
+	} {
+		_, err = bc.AcceptHeaders(c.headers)
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s：返回%v，应为%v", c.name, err, c.want)
+		}
+		if hasHeader(t, bc, branch[0].NowHash) {
+			t.Fatalf("%s：被拒绝的一组区块头保存了第一个区块头", c.name)
+		}
+	}
+
+	work, err := bc.AcceptHeaders(headersOf(branch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//创世区块加3个区块头
+	if work.Int64() != 4 {
+		t.Fatalf("累计工作量为%s，应为4", work)
+	}
+	//再次收到相同的区块头时跳过
+	work, err = bc.AcceptHeaders(headersOf(branch))
+	if err != nil || work.Int64() != 4 {
+		t.Fatalf("重复的区块头返回%v，累计工作量%v", err, work)
+	}
+	missing, err := bc.MissingBodies(branch[2].NowHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 3 {
+		t.Fatalf("需要下载%d个区块体，应为3个", len(missing))
+	}
+	for i, header := range missing {
+		if string(header.NowHash) != string(branch[i].NowHash) {
+			t.Fatalf("第%d个需要下载的区块体是高度%d的区块", i, header.Height)
+		}
+	}
+}
+
+//poa签名无效的区块头被拒绝，整组都不保存
+func TestAcceptHeadersBadSeal(t *testing.T) {
+	chdirTemp(t)
+	wallets := newPoAWallets(t, 3)
+	signers, outsider := wallets[:2], wallets[2]
+	engine := newTestPoAEngine(t, signers)
+	bc, err := NewBlockChain(engine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.db.NoSync = true
+	defer bc.Close()
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//按顺序签名的两个区块头，签名时需要查询还没有保存的前一个区块头
+	batch := &headerBatch{bc, make(map[string]*Block)}
+	var headers []*Block
+	parent := genesis
+	for i := 0; i < 2; i++ {
+		header := newPoABlock(parent)
+		err = engine.seal(context.Background(), batch, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		batch.headers[string(header.NowHash)] = header
+		headers = append(headers, header)
+		parent = header
+	}
+
+	//第二个区块头由不是授权签名者的钱包签名
+	bad := newPoABlock(headers[0])
+	err = signPoABlock(bad, outsider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bc.AcceptHeaders([]*Block{headers[0], bad})
+	if !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("签名无效的区块头返回%v", err)
+	}
+	if hasHeader(t, bc, headers[0].NowHash) || hasHeader(t, bc, bad.NowHash) {
+		t.Fatal("被拒绝的一组区块头被保存了")
+	}
+	_, err = bc.AcceptHeaders(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasHeader(t, bc, headers[1].NowHash) {
+		t.Fatal("正常的区块头没有保存")
+	}
+}
@@ -1,7 +1,51 @@
 package main
 
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+)
+
 func main() {
-	blockChain := NewBlockChain()
-	cli := CLI{blockChain}
-	cli.Run()
+	//os.Exit不会执行defer，所以所有的工作都在run中完成
+	os.Exit(run())
+}
+
+//执行命令，返回进程的退出码
+func run() int {
+	//按下Ctrl-C时取消正在进行的挖矿，然后正常关闭数据库
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	//没有命令时不需要打开区块链
+	if len(os.Args) < 2 {
+		fmt.Print(Usage)
+		return exitUsage
+	}
+
+	//迁移旧数据库时不能按新格式打开区块链
+	if len(os.Args) == 2 && os.Args[1] == "migrateEncoding" {
+		return reportError(MigrateEncoding())
+	}
+
+	//管理节点的命令只读写封禁列表和节点列表，节点运行时（数据库被节点占用）也可以执行
+	switch os.Args[1] {
+	case "listPeers", "banPeer", "unbanPeer":
+		cli := CLI{nil, ctx}
+		return reportError(cli.Run())
+	}
+
+	//默认使用sha256工作量证明，配置了poa.conf时使用poa
+	engine, err := LoadConsensus()
+	if err != nil {
+		return reportError(err)
+	}
+	blockChain, err := NewBlockChain(engine)
+	if err != nil {
+		return reportError(err)
+	}
+	defer blockChain.Close()
+	cli := CLI{blockChain, ctx}
+	return reportError(cli.Run())
 }
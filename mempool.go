@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"sort"
+	"sync"
+)
+
+//交易池（mempool）
+//已经签名、尚未打包进区块的交易先放在交易池中，矿工从中按手续费费率选出交易打包，这样一个区块可以包含多笔转账
+//交易池中的交易既可以花费UTXO集合中的output，也可以花费交易池中其他交易的output（例如未确认的找零）
+//两个交易花费同一个output时，后加入的交易被拒绝
+//命令行每次运行都是一个新进程，所以交易池保存在数据库中，启动时重新加载并校验
+
+//交易池的bucket，key是交易id，value是交易的字节流
+const mempoolBucket = "mempoolBucket"
+
+//交易已经在交易池中
+var ErrTxInMempool = errors.New("交易已经在交易池中！")
+
+//交易本身无效：格式不对、签名无效或者金额不符，与本地的交易池和UTXO集合无关
+//中继这种交易的节点计入违规分数
+var ErrInvalidTx = errors.New("交易无效")
+
+//交易与交易池中的其他交易花费了同一个output（双花）
+var ErrMempoolConflict = errors.New("交易与交易池中的其他交易花费了同一个output！")
+
+type Mempool struct {
+	lock sync.Mutex
+	//key为交易id
+	txs map[string]*mempoolEntry
+	//被交易池中的交易花费的output，key为outpointKey，value为花费它的交易id
+	spent map[string]string
+	//不为空时，加入和删除的交易同时写入数据库
+	db *bolt.DB
+}
+
+//交易池中的一个交易，以及加入时计算好的手续费和大小
+type mempoolEntry struct {
+	tx   *Transaction
+	fee  Amount
+	size int
+}
+
+//每字节的手续费，用于排序
+func (entry *mempoolEntry) feeRate() float64 {
+	return float64(entry.fee) / float64(entry.size)
+}
+
+//一个output的唯一标识：交易id + 索引
+func outpointKey(txid []byte, index int64) string {
+	return fmt.Sprintf("%x:%d", txid, index)
+}
+
+//创建一个空的交易池，只保存在内存中
+func NewMempool() *Mempool {
+	return &Mempool{
+		txs:   make(map[string]*mempoolEntry),
+		spent: make(map[string]string),
+	}
+}
+
+//从数据库中加载交易池，之后交易池的修改都会写回数据库
+//每个交易都重新校验，已经上链或者与区块链冲突的交易直接从数据库中删除
+func (blockChain *BlockChain) LoadMempool() (*Mempool, error) {
+	var stored []*Transaction
+	var corrupt [][]byte
+	err := blockChain.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(mempoolBucket))
+		if bucket == nil {
+			return fmt.Errorf("%w：交易池bucket不存在", ErrDatabase)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			tx, err := DeserializeTransaction(v)
+			if err != nil {
+				//损坏的交易与失效的交易一样直接删除
+				corrupt = append(corrupt, append([]byte{}, k...))
+				return nil
+			}
+			stored = append(stored, &tx)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pool := NewMempool()
+	stored = pool.addAll(blockChain, stored)
+
+	pool.db = blockChain.db
+	for _, tx := range stored {
+		corrupt = append(corrupt, tx.TXID)
+	}
+	if len(corrupt) > 0 {
+		fmt.Printf("交易池中有%d个交易已经失效，已删除\n", len(corrupt))
+		for _, id := range corrupt {
+			err = pool.deleteStored(id)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return pool, nil
+}
+
+//把一组交易加入交易池，返回校验失败的交易
+//交易可能花费交易池中其他交易的output，被依赖的交易加入之前会校验失败，所以反复加入直到没有新的交易能加入
+func (pool *Mempool) addAll(bc *BlockChain, txs []*Transaction) []*Transaction {
+	for progress := true; progress; {
+		progress = false
+		var remain []*Transaction
+		for _, tx := range txs {
+			if pool.Add(bc, tx) == nil {
+				progress = true
+			} else {
+				remain = append(remain, tx)
+			}
+		}
+		txs = remain
+	}
+	return txs
+}
+
+//从数据库中删除交易
+func (pool *Mempool) deleteStored(id []byte) error {
+	if pool.db == nil {
+		return nil
+	}
+	err := pool.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(mempoolBucket)).Delete(id)
+	})
+	if err != nil {
+		return fmt.Errorf("删除交易池中的交易失败：%w", err)
+	}
+	return nil
+}
+
+//校验交易并加入交易池
+//1.不能是铸币交易，交易ID与内容相符，不能重复加入，也不能已经在区块链中
+//2.每个input引用的output在UTXO集合或交易池其他交易中，并且没有被交易池中的其他交易花费
+//  引用的铸币交易output在下一个区块中必须已经成熟
+//3.input的公钥与引用的output相符，input总额不小于output总额，签名有效
+func (pool *Mempool) Add(bc *BlockChain, tx *Transaction) error {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w：铸币交易不能加入交易池", ErrInvalidTx)
+	}
+	if len(tx.TXInputs) == 0 || len(tx.TXOutputs) == 0 {
+		return fmt.Errorf("%w：交易没有input或output", ErrInvalidTx)
+	}
+	if !bytes.Equal(tx.Hash(), tx.TXID) {
+		return fmt.Errorf("%w：交易ID与内容不符：%x", ErrInvalidTx, tx.TXID)
+	}
+	if _, ok := pool.txs[string(tx.TXID)]; ok {
+		return ErrTxInMempool
+	}
+	onChain, err := bc.isTxOnChain(tx.TXID)
+	if err != nil {
+		return err
+	}
+	if onChain {
+		return fmt.Errorf("交易已经在区块链中：%x", tx.TXID)
+	}
+
+	outputSum, err := tx.OutputSum()
+	if err != nil {
+		return fmt.Errorf("%w：%v", ErrInvalidTx, err)
+	}
+
+	bestHeight, err := bc.BestHeight()
+	if err != nil {
+		return err
+	}
+	nextHeight := bestHeight + 1
+	//交易池中的交易也可以作为引用的交易
+	pending := make(map[string]Transaction)
+	seen := make(map[string]bool)
+	var inputSum Amount
+	for _, input := range tx.TXInputs {
+		key := outpointKey(input.TXid, input.Index)
+		if seen[key] {
+			return fmt.Errorf("%w：交易重复引用了同一个output：%x[%d]", ErrInvalidTx, input.TXid, input.Index)
+		}
+		seen[key] = true
+		if spender, ok := pool.spent[key]; ok {
+			return fmt.Errorf("%w %x[%d]已被交易%x花费", ErrMempoolConflict, input.TXid, input.Index, spender)
+		}
+
+		var output TXOutput
+		if entry, ok := pool.txs[string(input.TXid)]; ok {
+			if input.Index < 0 || input.Index >= int64(len(entry.tx.TXOutputs)) {
+				return fmt.Errorf("%w：input引用的output不存在：%x[%d]", ErrInvalidTx, input.TXid, input.Index)
+			}
+			output = entry.tx.TXOutputs[input.Index]
+			pending[string(input.TXid)] = *entry.tx
+		} else {
+			utxo, found, err := bc.FindUTXOByOutpoint(input.TXid, input.Index)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("input引用的output不存在或已被花费：%x[%d]", input.TXid, input.Index)
+			}
+			if !utxo.IsMature(nextHeight, bc.subsidy.CoinbaseMaturity) {
+				return fmt.Errorf("input引用的铸币交易output尚未成熟：%x[%d]", input.TXid, input.Index)
+			}
+			output = utxo.Output
+		}
+
+		//input中的公钥必须是output的收款方
+		if !bytes.Equal(HashPubKey(input.PubKey), output.PubKeyHash) {
+			return fmt.Errorf("%w：input公钥与引用的output不符：%x[%d]", ErrInvalidTx, input.TXid, input.Index)
+		}
+		inputSum, err = AddAmount(inputSum, output.Value)
+		if err != nil {
+			return fmt.Errorf("%w：%v", ErrInvalidTx, err)
+		}
+	}
+	if inputSum < outputSum {
+		return fmt.Errorf("%w：output总额%s大于input总额%s", ErrInvalidTx, outputSum, inputSum)
+	}
+
+	prevTXs, err := bc.findPrevTransactions(tx, pending)
+	if err != nil {
+		return err
+	}
+	if !tx.Verify(prevTXs) {
+		return fmt.Errorf("%w：交易签名无效", ErrInvalidTx)
+	}
+
+	if pool.db != nil {
+		err = pool.db.Update(func(dbTx *bolt.Tx) error {
+			return dbTx.Bucket([]byte(mempoolBucket)).Put(tx.TXID, tx.Serialize())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	pool.txs[string(tx.TXID)] = &mempoolEntry{tx, inputSum - outputSum, tx.Size()}
+	for key := range seen {
+		pool.spent[key] = string(tx.TXID)
+	}
+	return nil
+}
+
+//根据id查找交易池中的交易
+func (pool *Mempool) Get(id []byte) (*Transaction, bool) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	entry, ok := pool.txs[string(id)]
+	if !ok {
+		return nil, false
+	}
+	return entry.tx, true
+}
+
+//output是否已经被交易池中的交易花费
+func (pool *Mempool) IsSpent(txid []byte, index int64) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	_, ok := pool.spent[outpointKey(txid, index)]
+	return ok
+}
+
+//交易池中所有交易的副本，key为交易id，创建花费未确认output的交易时用于查找和签名
+func (pool *Mempool) Transactions() map[string]Transaction {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	txs := make(map[string]Transaction)
+	for id, entry := range pool.txs {
+		txs[id] = *entry.tx
+	}
+	return txs
+}
+
+//交易池中的交易个数
+func (pool *Mempool) Count() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return len(pool.txs)
+}
+
+//从交易池中删除交易，花费它的output的交易也一起删除，返回删除的交易个数
+func (pool *Mempool) Remove(id []byte) (int, error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return pool.removeWithDescendants(string(id))
+}
+
+func (pool *Mempool) removeWithDescendants(id string) (int, error) {
+	entry, ok := pool.txs[id]
+	if !ok {
+		return 0, nil
+	}
+	err := pool.removeEntry(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 1
+	for i := range entry.tx.TXOutputs {
+		if spender, ok := pool.spent[outpointKey(entry.tx.TXID, int64(i))]; ok {
+			count, err := pool.removeWithDescendants(spender)
+			removed += count
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+//只删除交易本身，并释放它花费的output
+//数据库删除失败时内存中的交易池保持不变
+func (pool *Mempool) removeEntry(entry *mempoolEntry) error {
+	err := pool.deleteStored(entry.tx.TXID)
+	if err != nil {
+		return err
+	}
+	delete(pool.txs, string(entry.tx.TXID))
+	for _, input := range entry.tx.TXInputs {
+		delete(pool.spent, outpointKey(input.TXid, input.Index))
+	}
+	return nil
+}
+
+//区块加入区块链后调用
+//1.删除已经打包进区块的交易，它们的output已经进入UTXO集合，交易池中花费这些output的交易仍然有效
+//2.删除与区块中交易花费了同一个output的交易，以及花费它们output的交易
+func (pool *Mempool) RemoveBlock(block *Block) error {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		if entry, ok := pool.txs[string(tx.TXID)]; ok {
+			err := pool.removeEntry(entry)
+			if err != nil {
+				return err
+			}
+		}
+		for _, input := range tx.TXInputs {
+			if spender, ok := pool.spent[outpointKey(input.TXid, input.Index)]; ok {
+				_, err := pool.removeWithDescendants(spender)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//主链发生变化后更新交易池
+//没有断开的区块时，只需要删除接入主链的区块中的交易（RemoveBlock）
+//发生重组时，断开的区块中的交易（铸币交易除外）放回交易池，交易池中原有的交易可能依赖断开的交易的output，
+//或者与新分支中的交易冲突，所以全部重新校验，已经在新分支中或者校验失败的交易被删除
+func (pool *Mempool) Reorganize(bc *BlockChain, update *ChainUpdate) error {
+	if len(update.Disconnected) == 0 {
+		for _, block := range update.Connected {
+			err := pool.RemoveBlock(block)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	//断开的区块从旧到新排列，被依赖的交易先加入
+	var txs []*Transaction
+	for i := len(update.Disconnected) - 1; i >= 0; i-- {
+		for _, tx := range update.Disconnected[i].Transactions {
+			if !tx.IsCoinbase() {
+				txs = append(txs, tx)
+			}
+		}
+	}
+	pool.lock.Lock()
+	for _, entry := range pool.sorted() {
+		txs = append(txs, entry.tx)
+	}
+	pool.txs = make(map[string]*mempoolEntry)
+	pool.spent = make(map[string]string)
+	pool.lock.Unlock()
+
+	for _, tx := range pool.addAll(bc, txs) {
+		err := pool.deleteStored(tx.TXID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//按手续费费率从高到低选出最多limit个交易用于打包，返回交易以及手续费总额
+//交易花费了交易池中其他交易的output时，必须排在那个交易之后
+func (pool *Mempool) Select(limit int) ([]*Transaction, Amount) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	entries := pool.sorted()
+	var txs []*Transaction
+	var fees Amount
+	selected := make(map[string]bool)
+	//每一轮按费率顺序选出所有依赖已经满足的交易，直到没有新的交易可选
+	for progress := true; progress && len(txs) < limit; {
+		progress = false
+		for _, entry := range entries {
+			if len(txs) >= limit {
+				break
+			}
+			if selected[string(entry.tx.TXID)] || !pool.parentsSelected(entry.tx, selected) {
+				continue
+			}
+			total, err := AddAmount(fees, entry.fee)
+			if err != nil {
+				continue
+			}
+			selected[string(entry.tx.TXID)] = true
+			txs = append(txs, entry.tx)
+			fees = total
+			progress = true
+		}
+	}
+	return txs, fees
+}
+
+//交易引用的交易池中的交易是否都已经被选中
+func (pool *Mempool) parentsSelected(tx *Transaction, selected map[string]bool) bool {
+	for _, input := range tx.TXInputs {
+		if _, inPool := pool.txs[string(input.TXid)]; inPool && !selected[string(input.TXid)] {
+			return false
+		}
+	}
+	return true
+}
+
+//按手续费费率从高到低返回交易池中所有的交易
+func (pool *Mempool) List() []*mempoolEntry {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return pool.sorted()
+}
+
+//调用时必须持有锁
+func (pool *Mempool) sorted() []*mempoolEntry {
+	var entries []*mempoolEntry
+	for _, entry := range pool.txs {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].feeRate() != entries[j].feeRate() {
+			return entries[i].feeRate() > entries[j].feeRate()
+		}
+		return bytes.Compare(entries[i].tx.TXID, entries[j].tx.TXID) < 0
+	})
+	return entries
+}
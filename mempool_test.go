@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+//通过序列化复制一个交易，修改副本不影响原来的交易
+func copyTx(t *testing.T, tx *Transaction) *Transaction {
+	t.Helper()
+	cpy, err := DeserializeTransaction(tx.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &cpy
+}
+
+//连续创建两个交易而不挖矿：第二个交易不能选中第一个交易已经花费的output，可以花费它未确认的找零
+func TestNewTransactionSpendsPendingChange(t *testing.T) {
+	bc, miner := newTestChain(t)
+	pool, err := bc.LoadMempool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, pool, miner, int(bc.subsidy.CoinbaseMaturity))
+
+	ws, err := NewWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//sender只有一个10的output
+	funding, err := NewTransaction(miner, sender, 10*CoinUnit, 0, bc, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pool.Add(bc, funding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, pool, miner, 1)
+
+	first, err := NewTransaction(sender, miner, 3*CoinUnit, 0, bc, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pool.Add(bc, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//唯一的output已经被第一个交易花费，只能使用它7的找零
+	second, err := NewTransaction(sender, miner, 5*CoinUnit, 0, bc, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second.TXInputs) != 1 || string(second.TXInputs[0].TXid) != string(first.TXID) {
+		t.Fatalf("第二个交易没有花费第一个交易的找零")
+	}
+	err = pool.Add(bc, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//余额不足时报错，而不是选中已经被花费的output
+	_, err = NewTransaction(sender, miner, 3*CoinUnit, 0, bc, pool)
+	if err == nil {
+		t.Fatalf("余额只有2，转账3应该失败")
+	}
+
+	block := mineBlocks(t, bc, pool, miner, 1)
+	if len(block.Transactions) != 3 {
+		t.Fatalf("区块中有%d个交易，应该有3个", len(block.Transactions))
+	}
+	pubKeyHash, err := GetPubKeyFromAddress(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxos, err := bc.FindUTXO(pubKeyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(utxos) != 1 || utxos[0].Output.Value != 2*CoinUnit {
+		t.Fatalf("sender的UTXO不正确：%v", utxos)
+	}
+}
+
+//本身无效的交易返回ErrInvalidTx，与交易池冲突的交易返回ErrMempoolConflict，只有前者计入违规分数
+func TestMempoolRejectsInvalidTx(t *testing.T) {
+	bc, miner := newTestChain(t)
+	pool, err := bc.LoadMempool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, pool, miner, int(bc.subsidy.CoinbaseMaturity))
+	ws, err := NewWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//签名被篡改
+	tx, err := NewTransaction(miner, receiver, CoinUnit, 0, bc, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := copyTx(t, tx)
+	bad.TXInputs[0].Signature[5] ^= 1
+	bad.SetHash()
+	err = pool.Add(bc, bad)
+	if !errors.Is(err, ErrInvalidTx) {
+		t.Fatalf("签名无效的交易返回%v", err)
+	}
+
+	//签名之后修改了金额，交易ID也重新计算
+	bad = copyTx(t, tx)
+	bad.TXOutputs[0].Value++
+	bad.SetHash()
+	err = pool.Add(bc, bad)
+	if !errors.Is(err, ErrInvalidTx) {
+		t.Fatalf("签名后修改金额的交易返回%v", err)
+	}
+
+	//交易ID与内容不符
+	bad = copyTx(t, tx)
+	bad.TXID[0] ^= 1
+	err = pool.Add(bc, bad)
+	if !errors.Is(err, ErrInvalidTx) {
+		t.Fatalf("交易ID不符的交易返回%v", err)
+	}
+
+	err = pool.Add(bc, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//不考虑交易池创建的交易花费了同一个output，交易本身有效
+	conflict, err := NewTransaction(miner, receiver, 2*CoinUnit, 0, bc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pool.Add(bc, conflict)
+	if !errors.Is(err, ErrMempoolConflict) || errors.Is(err, ErrInvalidTx) {
+		t.Fatalf("双花的交易返回%v", err)
+	}
+	if misbehaviorScore(err) != 0 {
+		t.Fatal("与交易池冲突的交易计入了违规分数")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+//二叉默克尔树
+//叶子节点是区块中每个交易的TXID，父节点 = sha256(左子节点 + 右子节点)
+//某一层节点个数为奇数时，复制最后一个节点与自己配对（与比特币相同）
+
+//计算两个子节点的父节点
+func hashMerkleNodes(left, right []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, left...), right...))
+	return hash[:]
+}
+
+//由叶子节点逐层向上构建默克尔树，返回每一层的节点，第0层是叶子，最后一层只有根
+func buildMerkleLevels(leaves [][]byte) [][][]byte {
+	levels := [][][]byte{leaves}
+	level := leaves
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			left := level[i]
+			right := left
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			next = append(next, hashMerkleNodes(left, right))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+//取出交易数组的叶子节点
+func merkleLeaves(txs []*Transaction) [][]byte {
+	var leaves [][]byte
+	for _, tx := range txs {
+		leaves = append(leaves, tx.TXID)
+	}
+	return leaves
+}
+
+//计算默克尔树根，没有交易时返回空数据的哈希
+func NewMerkleRoot(txs []*Transaction) []byte {
+	if len(txs) == 0 {
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	}
+	levels := buildMerkleLevels(merkleLeaves(txs))
+	return levels[len(levels)-1][0]
+}
+
+//默克尔证明，证明某个交易包含在某个区块中，只需要区块头中的默克尔树根即可验证
+type MerkleProof struct {
+	TXID []byte //要证明的交易ID
+	//交易在区块中的位置，每一层的奇偶决定兄弟节点在左边还是右边
+	Index uint64
+	//从叶子到根，每一层兄弟节点的哈希
+	Hashes [][]byte
+}
+
+//为txs中的某个交易生成默克尔证明
+func GenerateMerkleProof(txs []*Transaction, txid []byte) (*MerkleProof, error) {
+	leaves := merkleLeaves(txs)
+	index := -1
+	for i, leaf := range leaves {
+		if bytes.Equal(leaf, txid) {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return nil, errors.New("交易不在区块中，无法生成默克尔证明！")
+	}
+
+	proof := MerkleProof{TXID: txid, Index: uint64(index)}
+	levels := buildMerkleLevels(leaves)
+	//最后一层是根，不需要兄弟节点
+	for _, level := range levels[:len(levels)-1] {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			//奇数个节点时最后一个节点和自己配对
+			sibling = index
+		}
+		proof.Hashes = append(proof.Hashes, level[sibling])
+		index /= 2
+	}
+	return &proof, nil
+}
+
+//用默克尔证明和区块头中的默克尔树根验证交易是否包含在区块中
+func VerifyMerkleProof(root []byte, proof *MerkleProof) bool {
+	if proof == nil || len(proof.TXID) == 0 {
+		return false
+	}
+	hash := proof.TXID
+	index := proof.Index
+	for _, sibling := range proof.Hashes {
+		if index%2 == 0 {
+			hash = hashMerkleNodes(hash, sibling)
+		} else {
+			hash = hashMerkleNodes(sibling, hash)
+		}
+		index /= 2
+	}
+	//所有层处理完之后index必须为0，否则Index与证明的层数不符
+	return index == 0 && bytes.Equal(hash, root)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+//生成n个只有TXID的交易，默克尔树只用到TXID
+func merkleTestTxs(n int) []*Transaction {
+	var txs []*Transaction
+	for i := 0; i < n; i++ {
+		id := sha256.Sum256([]byte(fmt.Sprintf("tx%d", i)))
+		txs = append(txs, &Transaction{TXID: id[:]})
+	}
+	return txs
+}
+
+func TestNewMerkleRoot(t *testing.T) {
+	txs := merkleTestTxs(3)
+	a, b, c := txs[0].TXID, txs[1].TXID, txs[2].TXID
+	tests := []struct {
+		name string
+		txs  []*Transaction
+		want []byte
+	}{
+		{"一个交易", txs[:1], a},
+		{"两个交易", txs[:2], hashMerkleNodes(a, b)},
+		//奇数个节点时最后一个与自己配对
+		{"三个交易", txs, hashMerkleNodes(hashMerkleNodes(a, b), hashMerkleNodes(c, c))},
+	}
+	for _, test := range tests {
+		if got := NewMerkleRoot(test.txs); !bytes.Equal(got, test.want) {
+			t.Errorf("%s：默克尔树根为%x，应该为%x", test.name, got, test.want)
+		}
+	}
+}
+
+//每个交易的证明都能通过验证，包括奇数个叶子时与自己配对的最后一个交易
+func TestMerkleProofRoundTrip(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 5, 7, 8, 9, 16, 17} {
+		txs := merkleTestTxs(n)
+		root := NewMerkleRoot(txs)
+		for i, tx := range txs {
+			proof, err := GenerateMerkleProof(txs, tx.TXID)
+			if err != nil {
+				t.Fatalf("%d个交易，第%d个：%v", n, i, err)
+			}
+			if proof.Index != uint64(i) {
+				t.Errorf("%d个交易，第%d个：证明中的位置为%d", n, i, proof.Index)
+			}
+			if !VerifyMerkleProof(root, proof) {
+				t.Errorf("%d个交易，第%d个：证明验证失败", n, i)
+			}
+		}
+	}
+}
+
+func TestMerkleProofNotInBlock(t *testing.T) {
+	txs := merkleTestTxs(4)
+	_, err := GenerateMerkleProof(txs, []byte("不存在的交易"))
+	if err == nil {
+		t.Fatal("不在区块中的交易不应该生成证明")
+	}
+}
+
+//篡改证明的任何一部分都无法通过验证
+func TestMerkleProofTampered(t *testing.T) {
+	txs := merkleTestTxs(7)
+	root := NewMerkleRoot(txs)
+	other := merkleTestTxs(8)[7].TXID
+
+	tests := []struct {
+		name   string
+		tamper func(proof *MerkleProof)
+	}{
+		{"修改兄弟节点", func(proof *MerkleProof) { proof.Hashes[1][0] ^= 1 }},
+		{"替换交易ID", func(proof *MerkleProof) { proof.TXID = other }},
+		{"修改位置", func(proof *MerkleProof) { proof.Index ^= 1 }},
+		{"位置超出层数", func(proof *MerkleProof) { proof.Index += 8 }},
+		{"去掉最后一层", func(proof *MerkleProof) { proof.Hashes = proof.Hashes[:len(proof.Hashes)-1] }},
+		{"多加一层", func(proof *MerkleProof) { proof.Hashes = append(proof.Hashes, root) }},
+		{"交易ID为空", func(proof *MerkleProof) { proof.TXID = nil }},
+	}
+	for _, test := range tests {
+		proof, err := GenerateMerkleProof(txs, txs[2].TXID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.tamper(proof)
+		if VerifyMerkleProof(root, proof) {
+			t.Errorf("%s：篡改后的证明通过了验证", test.name)
+		}
+	}
+
+	proof, err := GenerateMerkleProof(txs, txs[2].TXID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifyMerkleProof(NewMerkleRoot(txs[:6]), proof) {
+		t.Error("证明在另一个区块的默克尔树根下通过了验证")
+	}
+	if VerifyMerkleProof(root, nil) {
+		t.Error("空的证明通过了验证")
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//节点之间的消息格式
+//每个消息由消息头和内容组成：
+//	魔数(uint32) | 命令(12字节，不足的部分补0) | 内容长度(uint32) | 校验和(内容sha256的前4字节) | 内容
+//内容使用与区块、交易相同的二进制编码（见encoding.go）：
+//	version：   协议版本(uint32) | 随机数(uint64) | 创世区块哈希 | 共识引擎名称 | 主链高度(uint64) | 监听端口(uint32)
+//	verack：    空
+//	getheaders：哈希个数(uint32) | 每个区块定位器哈希 | 停止哈希
+//	headers：   区块头个数(uint32) | 每个区块头（字节数组，内容为没有交易的区块的编码）
+//	inv：       类型(uint32) | 哈希个数(uint32) | 每个哈希
+//	getdata：   与inv相同
+//	block：     区块的编码
+//	tx：        交易的编码
+
+//对方发送的消息无法解析：魔数、校验和或长度不正确，或者内容无法解码
+var ErrMalformedMessage = errors.New("消息格式错误")
+
+//消息开头的魔数，用来识别不是本协议的连接
+const networkMagic uint32 = 0xB10C0C01
+
+//协议版本，握手时双方必须相同
+//版本2：用getheaders/headers代替getblocks，先同步区块头
+//版本3：新区块的区块头带长度前缀（blockVersionPrefixed），区块哈希的计算方式不同
+const protocolVersion uint32 = 3
+
+//消息头中命令的长度
+const commandLength = 12
+
+//单个消息内容的最大长度
+const maxMessageSize = 32 << 20
+
+//一个inv或getdata消息中最多的哈希个数
+const maxInvHashes = 500
+
+//一个headers消息中最多的区块头个数，满了说明对方还有更多区块头
+const maxHeadersPerMsg = 2000
+
+//区块定位器中最多的哈希个数，间隔加倍时2^64个区块也只需要不到100个
+const maxLocatorHashes = 100
+
+//消息命令
+const (
+	cmdVersion    = "version"
+	cmdVerack     = "verack"
+	cmdGetHeaders = "getheaders"
+	cmdHeaders    = "headers"
+	cmdInv        = "inv"
+	cmdGetData    = "getdata"
+	cmdBlock      = "block"
+	cmdTx         = "tx"
+)
+
+//inv和getdata中哈希的类型
+const (
+	invTypeTx    uint32 = 1
+	invTypeBlock uint32 = 2
+)
+
+//可以编码为消息内容的类型
+type payload interface {
+	Encode(w io.Writer) error
+	Decode(r io.Reader) error
+}
+
+//握手时发送的节点信息
+type versionMsg struct {
+	Version    uint32 //协议版本
+	Nonce      uint64 //每次启动时随机生成，用来识别连接到自己以及重复的连接
+	Genesis    []byte //创世区块哈希，不同的区块链不能互相同步
+	Consensus  string //共识引擎名称
+	BestHeight uint64 //主链高度
+	ListenPort uint32 //监听的端口，与连接的ip一起就是对方可以被连接的地址
+}
+
+func (msg *versionMsg) Encode(w io.Writer) error {
+	e := encoder{w: w}
+	e.uint32(msg.Version)
+	e.uint64(msg.Nonce)
+	e.bytes(msg.Genesis)
+	e.bytes([]byte(msg.Consensus))
+	e.uint64(msg.BestHeight)
+	e.uint32(msg.ListenPort)
+	return e.err
+}
+
+func (msg *versionMsg) Decode(r io.Reader) error {
+	d := decoder{r: r}
+	msg.Version = d.uint32()
+	msg.Nonce = d.uint64()
+	msg.Genesis = d.bytes()
+	msg.Consensus = string(d.bytes())
+	msg.BestHeight = d.uint64()
+	msg.ListenPort = d.uint32()
+	return d.err
+}
+
+//请求对方主链上定位器之后的区块头，对方用headers回复
+type getHeadersMsg struct {
+	Locator [][]byte
+	Stop    []byte //为空时一直到对方的主链尾部（最多maxHeadersPerMsg个）
+}
+
+func (msg *getHeadersMsg) Encode(w io.Writer) error {
+	e := encoder{w: w}
+	e.uint32(uint32(len(msg.Locator)))
+	for _, hash := range msg.Locator {
+		e.bytes(hash)
+	}
+	e.bytes(msg.Stop)
+	return e.err
+}
+
+func (msg *getHeadersMsg) Decode(r io.Reader) error {
+	d := decoder{r: r}
+	count := d.uint32()
+	if d.err == nil && count > maxLocatorHashes {
+		return fmt.Errorf("区块定位器中的哈希过多：%d", count)
+	}
+	msg.Locator = nil
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		msg.Locator = append(msg.Locator, d.bytes())
+	}
+	msg.Stop = d.bytes()
+	return d.err
+}
+
+//回复getheaders的区块头，从低到高排序，没有更多区块头时为空
+type headersMsg struct {
+	Headers []*Block
+}
+
+func (msg *headersMsg) Encode(w io.Writer) error {
+	e := encoder{w: w}
+	e.uint32(uint32(len(msg.Headers)))
+	for _, header := range msg.Headers {
+		if e.err != nil {
+			break
+		}
+		var buffer bytes.Buffer
+		e.err = header.Header().Encode(&buffer)
+		e.bytes(buffer.Bytes())
+	}
+	return e.err
+}
+
+func (msg *headersMsg) Decode(r io.Reader) error {
+	d := decoder{r: r}
+	count := d.uint32()
+	if d.err == nil && count > maxHeadersPerMsg {
+		return fmt.Errorf("区块头过多：%d", count)
+	}
+	msg.Headers = nil
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		data := d.bytes()
+		if d.err != nil {
+			break
+		}
+		header, err := Deserialize(data)
+		if err != nil {
+			return err
+		}
+		if len(header.Transactions) != 0 {
+			return errors.New("区块头中不应该有交易")
+		}
+		msg.Headers = append(msg.Headers, &header)
+	}
+	return d.err
+}
+
+//通告自己拥有的区块或交易（inv），或者请求对方发送（getdata）
+type invMsg struct {
+	Type   uint32
+	Hashes [][]byte
+}
+
+func (msg *invMsg) Encode(w io.Writer) error {
+	e := encoder{w: w}
+	e.uint32(msg.Type)
+	e.uint32(uint32(len(msg.Hashes)))
+	for _, hash := range msg.Hashes {
+		e.bytes(hash)
+	}
+	return e.err
+}
+
+func (msg *invMsg) Decode(r io.Reader) error {
+	d := decoder{r: r}
+	msg.Type = d.uint32()
+	if d.err == nil && msg.Type != invTypeTx && msg.Type != invTypeBlock {
+		return fmt.Errorf("未知的inv类型：%d", msg.Type)
+	}
+	count := d.uint32()
+	if d.err == nil && count > maxInvHashes {
+		return fmt.Errorf("inv中的哈希过多：%d", count)
+	}
+	msg.Hashes = nil
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		msg.Hashes = append(msg.Hashes, d.bytes())
+	}
+	return d.err
+}
+
+//把消息内容编码为字节，msg为nil时内容为空
+func encodePayload(msg payload) ([]byte, error) {
+	var buffer bytes.Buffer
+	if msg != nil {
+		err := msg.Encode(&buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buffer.Bytes(), nil
+}
+
+//解码消息内容，内容后面不能有多余的数据
+func decodePayload(data []byte, msg payload) error {
+	reader := bytes.NewReader(data)
+	err := msg.Decode(reader)
+	if err != nil {
+		return fmt.Errorf("%w：%v", ErrMalformedMessage, err)
+	}
+	if reader.Len() != 0 {
+		return fmt.Errorf("%w：消息内容后面有多余的数据", ErrMalformedMessage)
+	}
+	return nil
+}
+
+//内容的校验和
+func checksum(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:4]
+}
+
+//写一个消息
+func writeMessage(w io.Writer, command string, data []byte) error {
+	if len(command) > commandLength {
+		return fmt.Errorf("命令过长：%s", command)
+	}
+	if len(data) > maxMessageSize {
+		return fmt.Errorf("消息过长：%d", len(data))
+	}
+	header := make([]byte, 4+commandLength+4+4)
+	binary.BigEndian.PutUint32(header[0:4], networkMagic)
+	copy(header[4:4+commandLength], command)
+	binary.BigEndian.PutUint32(header[4+commandLength:], uint32(len(data)))
+	copy(header[8+commandLength:], checksum(data))
+	_, err := w.Write(append(header, data...))
+	return err
+}
+
+//读一个消息，返回命令和内容
+func readMessage(r io.Reader) (string, []byte, error) {
+	header := make([]byte, 4+commandLength+4+4)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return "", nil, err
+	}
+	if binary.BigEndian.Uint32(header[0:4]) != networkMagic {
+		return "", nil, fmt.Errorf("%w：魔数不正确", ErrMalformedMessage)
+	}
+	command := string(bytes.TrimRight(header[4:4+commandLength], "\x00"))
+	length := binary.BigEndian.Uint32(header[4+commandLength:])
+	if length > maxMessageSize {
+		return "", nil, fmt.Errorf("%w：消息过长：%d", ErrMalformedMessage, length)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(checksum(data), header[8+commandLength:]) {
+		return "", nil, fmt.Errorf("%w：%s消息的校验和不正确", ErrMalformedMessage, command)
+	}
+	return command, data, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+//写一个消息再读出来，命令和内容不变
+func roundTripMessage(t *testing.T, command string, msg, decoded payload) {
+	t.Helper()
+	data, err := encodePayload(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	err = writeMessage(&buffer, command, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotCommand, gotData, err := readMessage(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotCommand != command {
+		t.Fatalf("读出的命令为%s，应为%s", gotCommand, command)
+	}
+	if buffer.Len() != 0 {
+		t.Fatalf("%s消息后面还剩%d字节", command, buffer.Len())
+	}
+	err = decodePayload(gotData, decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	wallet, err := NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase, err := NewCoinbaseTX(wallet.NewAddress(), "test", 1, CoinUnit, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := NewBlock([]*Transaction{coinbase}, []byte{1, 2, 3}, 1, initialBits)
+	block.NowHash = block.CalcHash()
+
+	version := &versionMsg{protocolVersion, 42, []byte{9, 9}, "pow", 7, 3000}
+	var gotVersion versionMsg
+	roundTripMessage(t, cmdVersion, version, &gotVersion)
+	if !reflect.DeepEqual(version, &gotVersion) {
+		t.Fatalf("version消息为%+v，应为%+v", gotVersion, version)
+	}
+
+	getHeaders := &getHeadersMsg{[][]byte{{1}, {2, 3}}, []byte{4}}
+	var gotGetHeaders getHeadersMsg
+	roundTripMessage(t, cmdGetHeaders, getHeaders, &gotGetHeaders)
+	if !reflect.DeepEqual(getHeaders, &gotGetHeaders) {
+		t.Fatalf("getheaders消息为%+v，应为%+v", gotGetHeaders, getHeaders)
+	}
+
+	//区块头消息中只有区块头，不带交易
+	var gotHeaders headersMsg
+	roundTripMessage(t, cmdHeaders, &headersMsg{[]*Block{block}}, &gotHeaders)
+	if len(gotHeaders.Headers) != 1 || len(gotHeaders.Headers[0].Transactions) != 0 ||
+		!bytes.Equal(gotHeaders.Headers[0].CalcHash(), block.NowHash) {
+		t.Fatalf("headers消息中的区块头与原区块不符")
+	}
+
+	inv := &invMsg{invTypeBlock, [][]byte{block.NowHash, {5}}}
+	var gotInv invMsg
+	roundTripMessage(t, cmdInv, inv, &gotInv)
+	if !reflect.DeepEqual(inv, &gotInv) {
+		t.Fatalf("inv消息为%+v，应为%+v", gotInv, inv)
+	}
+
+	//内容为空的verack
+	var buffer bytes.Buffer
+	err = writeMessage(&buffer, cmdVerack, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	command, data, err := readMessage(&buffer)
+	if err != nil || command != cmdVerack || len(data) != 0 {
+		t.Fatalf("verack消息读出%s %x：%v", command, data, err)
+	}
+
+	//block和tx消息直接使用区块和交易的编码
+	buffer.Reset()
+	err = writeMessage(&buffer, cmdBlock, block.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data, err = readMessage(&buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotBlock, err := Deserialize(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotBlock.Serialize(), block.Serialize()) {
+		t.Fatal("block消息中的区块与原区块不符")
+	}
+}
+
+//魔数、校验和、长度不正确的消息，以及无法解码的内容都返回ErrMalformedMessage
+func TestReadMessageRejectsMalformed(t *testing.T) {
+	var buffer bytes.Buffer
+	err := writeMessage(&buffer, cmdTx, []byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := buffer.Bytes()
+	//消息头中各字段的位置
+	const lengthOffset = 4 + commandLength
+	const checksumOffset = lengthOffset + 4
+
+	for _, c := range []struct {
+		name   string
+		modify func(msg []byte) []byte
+	}{
+		{"魔数不正确", func(msg []byte) []byte {
+			msg[0] ^= 1
+			return msg
+		}},
+		{"校验和不正确", func(msg []byte) []byte {
+			msg[checksumOffset] ^= 1
+			return msg
+		}},
+		{"内容被修改", func(msg []byte) []byte {
+			msg[len(msg)-1] ^= 1
+			return msg
+		}},
+		{"长度超过上限", func(msg []byte) []byte {
+			binary.BigEndian.PutUint32(msg[lengthOffset:], maxMessageSize+1)
+			return msg
+		}},
+	} {
+		msg := c.modify(append([]byte{}, valid...))
+		_, _, err := readMessage(bytes.NewReader(msg))
+		if !errors.Is(err, ErrMalformedMessage) {
+			t.Errorf("%s：返回%v", c.name, err)
+		}
+	}
+
+	//长度超过上限时不写出
+	err = writeMessage(&bytes.Buffer{}, cmdBlock, make([]byte, maxMessageSize+1))
+	if err == nil {
+		t.Error("写出了超过长度上限的消息")
+	}
+
+	//内容无法解码，或者后面有多余的数据
+	data, err := encodePayload(&invMsg{invTypeTx, [][]byte{{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"内容被截断", data[:len(data)-1]},
+		{"内容后面有多余的数据", append(append([]byte{}, data...), 0)},
+		{"未知的inv类型", append([]byte{0, 0, 0, 9}, data[4:]...)},
+	} {
+		err = decodePayload(c.data, &invMsg{})
+		if !errors.Is(err, ErrMalformedMessage) {
+			t.Errorf("%s：返回%v", c.name, err)
+		}
+	}
+	tooMany := make([]byte, 8)
+	binary.BigEndian.PutUint32(tooMany, invTypeTx)
+	binary.BigEndian.PutUint32(tooMany[4:], maxInvHashes+1)
+	err = decodePayload(tooMany, &invMsg{})
+	if !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("inv中的哈希过多：返回%v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+//挖矿期间同一高度已经有其他区块加入区块链，当前挖矿的结果已经过时
+var ErrStaleBlock = errors.New("同一高度已经有新的区块，放弃当前挖矿！")
+
+//正在某个高度上挖矿的任务
+type miningJob struct {
+	cancel context.CancelFunc
+}
+
+//为高度height上的挖矿创建一个子ctx，同一高度有区块加入时（AbortMining）会被取消
+//返回的cancel必须调用，用来注销这个挖矿任务
+func (blockChain *BlockChain) watchHeight(ctx context.Context, height uint64) (context.Context, context.CancelFunc) {
+	mineCtx, cancel := context.WithCancel(ctx)
+	job := &miningJob{cancel}
+
+	blockChain.miningLock.Lock()
+	if blockChain.miningJobs == nil {
+		blockChain.miningJobs = make(map[uint64][]*miningJob)
+	}
+	blockChain.miningJobs[height] = append(blockChain.miningJobs[height], job)
+	blockChain.miningLock.Unlock()
+
+	return mineCtx, func() {
+		cancel()
+		blockChain.miningLock.Lock()
+		defer blockChain.miningLock.Unlock()
+		jobs := blockChain.miningJobs[height]
+		for i, j := range jobs {
+			if j == job {
+				blockChain.miningJobs[height] = append(jobs[:i], jobs[i+1:]...)
+				break
+			}
+		}
+		if len(blockChain.miningJobs[height]) == 0 {
+			delete(blockChain.miningJobs, height)
+		}
+	}
+}
+
+//高度height上有区块加入区块链时调用，取消这个高度以及更低高度上所有正在进行的挖矿
+func (blockChain *BlockChain) AbortMining(height uint64) {
+	blockChain.miningLock.Lock()
+	defer blockChain.miningLock.Unlock()
+	for h, jobs := range blockChain.miningJobs {
+		if h <= height {
+			for _, job := range jobs {
+				job.cancel()
+			}
+		}
+	}
+}
+
+//一个区块最多打包的交易个数（不含铸币交易）
+const maxBlockTransactions = 1000
+
+//从交易池中按手续费费率选出交易打包挖矿，矿工领取挖矿奖励和所有手续费
+//区块加入区块链后，从交易池中删除已经打包的交易，发生重组时断开的交易放回交易池
+func (blockChain *BlockChain) MineBlock(ctx context.Context, pool *Mempool, miner, data string) (*Block, error) {
+	txs, fees := pool.Select(maxBlockTransactions)
+	bestHeight, err := blockChain.BestHeight()
+	if err != nil {
+		return nil, err
+	}
+	coinbase, err := NewCoinbaseTX(miner, data, bestHeight+1, blockChain.subsidy.Subsidy(bestHeight+1), fees)
+	if err != nil {
+		return nil, err
+	}
+	block, update, err := blockChain.AddBlock(ctx, append([]*Transaction{coinbase}, txs...))
+	if err != nil {
+		return nil, err
+	}
+	//区块已经上链，交易池更新失败时只是留下一些已经失效的交易，下次加载时会被清理
+	err = pool.Reorganize(blockChain, update)
+	if err != nil {
+		fmt.Printf("更新交易池失败：%v\n", err)
+	}
+	return block, nil
+}
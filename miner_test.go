@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+//挖矿时一直等到ctx被取消的共识引擎，started在开始挖矿时关闭
+type blockingEngine struct {
+	testEngine
+	started chan struct{}
+}
+
+func (engine *blockingEngine) Seal(ctx context.Context, chain *BlockChain, block *Block) error {
+	close(engine.started)
+	<-ctx.Done()
+	return ErrMiningCancelled
+}
+
+//在后台用blockingEngine在创世区块之后挖一个区块，返回AddBlock的结果
+func startBlockingMine(t *testing.T, bc *BlockChain, ctx context.Context, miner string) <-chan error {
+	t.Helper()
+	engine := &blockingEngine{started: make(chan struct{})}
+	bc.engine = engine
+	coinbase, err := NewCoinbaseTX(miner, "", 1, bc.subsidy.Subsidy(1), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := bc.AddBlock(ctx, []*Transaction{coinbase})
+		done <- err
+	}()
+	<-engine.started
+	return done
+}
+
+//等待挖矿结束，超时时测试失败
+func waitMine(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("挖矿没有停止")
+		return nil
+	}
+}
+
+//ctx被取消时pow挖矿停止，返回ErrMiningCancelled
+func TestPowMineCancelled(t *testing.T) {
+	//目标值为1，不可能挖到
+	block := NewBlock(nil, []byte{}, 1, BigToCompact(big.NewInt(1)))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := newProofOfWork(block).Mine(ctx)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	err := waitMine(t, done)
+	if !errors.Is(err, ErrMiningCancelled) {
+		t.Fatalf("取消挖矿返回%v", err)
+	}
+
+	//已经取消的ctx直接返回
+	err = NewPowEngine().Seal(ctx, nil, block)
+	if !errors.Is(err, ErrMiningCancelled) {
+		t.Fatalf("用已经取消的ctx挖矿返回%v", err)
+	}
+}
+
+//用户取消挖矿时AddBlock返回ErrMiningCancelled，而不是ErrStaleBlock
+func TestAddBlockCancelled(t *testing.T) {
+	bc, miner := newTestChain(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := startBlockingMine(t, bc, ctx, miner)
+	cancel()
+	err := waitMine(t, done)
+	if !errors.Is(err, ErrMiningCancelled) {
+		t.Fatalf("取消挖矿返回%v", err)
+	}
+	if len(bc.miningJobs) != 0 {
+		t.Fatalf("挖矿结束后还有%d个高度的挖矿任务", len(bc.miningJobs))
+	}
+}
+
+//挖矿期间同一高度的其他区块加入区块链，挖矿被放弃并返回ErrStaleBlock
+func TestAddBlockStale(t *testing.T) {
+	bc, miner := newTestChain(t)
+	genesis, err := bc.GetBlockByHash(bc.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := startBlockingMine(t, bc, context.Background(), miner)
+
+	update, err := bc.AcceptBlock(newTestBlock(t, genesis, miner, "competitor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(update.Connected) != 1 {
+		t.Fatalf("竞争区块没有加入主链")
+	}
+	err = waitMine(t, done)
+	if !errors.Is(err, ErrStaleBlock) {
+		t.Fatalf("同一高度有区块加入后挖矿返回%v", err)
+	}
+}
+
+//AbortMining只取消指定高度及更低高度上的挖矿
+func TestAbortMiningHeight(t *testing.T) {
+	bc, _ := newTestChain(t)
+	low, cancelLow := bc.watchHeight(context.Background(), 5)
+	defer cancelLow()
+	high, cancelHigh := bc.watchHeight(context.Background(), 7)
+	defer cancelHigh()
+
+	bc.AbortMining(6)
+	if low.Err() == nil {
+		t.Fatal("高度5上的挖矿没有被取消")
+	}
+	if high.Err() != nil {
+		t.Fatal("高度7上的挖矿被取消了")
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//p2p节点
+//节点之间通过tcp连接交换消息（格式见message.go），同步区块链并转发交易：
+//1.握手：主动连接的一方先发送version，对方回复version和verack，再由主动方回复verack
+//  双方的创世区块和共识引擎必须相同，所以多个节点需要使用同一个区块链数据库的拷贝启动
+//2.同步：握手完成后先同步区块头，再从多个节点并行下载区块体（见sync.go）
+//3.转发：接入主链的新区块和加入交易池的新交易用inv通告给其他节点，对方用getdata请求
+//4.管理：连接数限制、违规计分和封禁由PeerManager负责（见peerManager.go）
+//收到的区块由AcceptBlock校验并加入区块链，侧链和重组的处理与本地挖出的区块完全相同
+//节点直接使用BlockChain和Mempool未导出的字段和方法，整个项目又只有一个main包，所以节点代码也放在main包中
+
+//主动连接断开或者失败后，重新连接的间隔
+const reconnectInterval = 10 * time.Second
+
+type Node struct {
+	bc   *BlockChain
+	pool *Mempool
+	port int
+	//本次启动的随机数，写在version消息中
+	nonce uint64
+	//创世区块哈希
+	genesis []byte
+	//不为空时，交易池中有交易就打包挖矿，挖矿奖励给这个地址
+	miner string
+
+	//已经建立的连接、违规分数和封禁列表
+	peers *PeerManager
+
+	//headers-first同步的状态
+	sync *blockSync
+
+	//通知挖矿协程交易池或主链发生了变化
+	mineSignal chan struct{}
+	wg         sync.WaitGroup
+}
+
+//创建节点，监听port端口，miner为空时不挖矿，被动连接和主动连接分别最多maxInbound和maxOutbound个
+func NewNode(bc *BlockChain, port int, miner string, maxInbound, maxOutbound int) (*Node, error) {
+	pool, err := bc.LoadMempool()
+	if err != nil {
+		return nil, err
+	}
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := NewPeerManager(port, maxInbound, maxOutbound)
+	if err != nil {
+		return nil, err
+	}
+	var buf [8]byte
+	_, err = rand.Read(buf[:])
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{
+		bc:         bc,
+		pool:       pool,
+		port:       port,
+		nonce:      binary.BigEndian.Uint64(buf[:]),
+		genesis:    genesis.NowHash,
+		miner:      miner,
+		peers:      peers,
+		mineSignal: make(chan struct{}, 1),
+	}
+	node.sync = newBlockSync(node)
+	return node, nil
+}
+
+//启动节点并连接peers中的节点，直到ctx被取消
+func (node *Node) Run(ctx context.Context, peers []string) error {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(node.port))
+	if err != nil {
+		return fmt.Errorf("监听端口%d失败：%w", node.port, err)
+	}
+	bestHeight, err := node.bc.BestHeight()
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	fmt.Printf("节点已启动，监听端口%d，当前高度%d，交易池中有%d个交易\n", node.port, bestHeight, node.pool.Count())
+
+	node.wg.Add(1)
+	go func() {
+		defer node.wg.Done()
+		node.acceptLoop(ctx, listener)
+	}()
+	for _, addr := range peers {
+		addr := addr
+		node.wg.Add(1)
+		go func() {
+			defer node.wg.Done()
+			node.connectLoop(ctx, addr)
+		}()
+	}
+	node.wg.Add(1)
+	go func() {
+		defer node.wg.Done()
+		node.maintainLoop(ctx)
+	}()
+	if node.miner != "" {
+		node.wg.Add(1)
+		go func() {
+			defer node.wg.Done()
+			node.mineLoop(ctx)
+		}()
+		node.signalMiner()
+	}
+
+	<-ctx.Done()
+	listener.Close()
+	node.wg.Wait()
+	node.peers.close()
+	fmt.Printf("节点已停止\n")
+	return nil
+}
+
+//接受其他节点的连接
+func (node *Node) acceptLoop(ctx context.Context, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Printf("接受连接失败：%v\n", err)
+			continue
+		}
+		peer := newPeer(conn, conn.RemoteAddr().String(), true)
+		node.wg.Add(1)
+		go func() {
+			defer node.wg.Done()
+			node.handlePeer(ctx, peer)
+		}()
+	}
+}
+
+//连接配置的节点，连接断开或失败后每隔reconnectInterval重试
+//对方主动连接过来的连接仍然存在时不重复连接
+func (node *Node) connectLoop(ctx context.Context, addr string) {
+	var lastNonce uint64
+	dialer := net.Dialer{Timeout: handshakeTimeout}
+	for {
+		if (lastNonce == 0 || !node.peers.connected(lastNonce)) && !node.peers.outboundFull() {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err == nil {
+				peer := newPeer(conn, addr, false)
+				node.handlePeer(ctx, peer)
+				lastNonce = peer.nonce()
+			} else if ctx.Err() == nil {
+				fmt.Printf("连接%s失败：%v\n", addr, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+//定期检查下载超时的区块和区块头，重新读取被修改的封禁列表，保存连接的节点
+func (node *Node) maintainLoop(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			node.sync.checkTimeouts()
+			node.peers.maintain()
+		}
+	}
+}
+
+//处理一个连接上的消息，直到连接断开、对方违反协议或者ctx被取消
+//对方违反协议时按错误种类记录违规分数
+func (node *Node) handlePeer(ctx context.Context, peer *Peer) {
+	err := node.peers.add(peer)
+	if err != nil {
+		fmt.Printf("拒绝与%s的连接：%v\n", peer, err)
+		peer.close()
+		return
+	}
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		node.peers.remove(peer)
+		peer.close()
+		//这个节点正在下载的区块和区块头交给其他节点
+		node.sync.removePeer(peer)
+	}()
+	//ctx被取消时关闭连接，正在阻塞的读取会立即返回
+	go func() {
+		select {
+		case <-ctx.Done():
+			peer.close()
+		case <-done:
+		}
+	}()
+
+	if !peer.inbound {
+		err := node.sendVersion(peer)
+		if err != nil {
+			fmt.Printf("向%s发送version失败：%v\n", peer, err)
+			return
+		}
+	}
+	//握手完成后取消读超时
+	err = peer.conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return
+	}
+	for {
+		command, data, err := readMessage(peer.conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if peer.handshakeDone() {
+				fmt.Printf("与%s的连接断开：%v\n", peer, err)
+			} else {
+				//对方认为握手失败时（例如创世区块不同）直接断开连接
+				fmt.Printf("与%s握手失败：%v\n", peer, err)
+			}
+			node.peers.misbehave(peer, err)
+			return
+		}
+		err = node.handleMessage(peer, command, data)
+		if err != nil {
+			fmt.Printf("断开与%s的连接：%v\n", peer, err)
+			node.peers.misbehave(peer, err)
+			return
+		}
+	}
+}
+
+//处理一个消息，返回错误表示对方违反了协议，需要断开连接
+//本地的错误（例如数据库出错）只打印出来，不断开连接
+func (node *Node) handleMessage(peer *Peer, command string, data []byte) error {
+	if command != cmdVersion && command != cmdVerack && !peer.handshakeDone() {
+		return fmt.Errorf("握手完成之前收到了%s消息", command)
+	}
+	switch command {
+	case cmdVersion:
+		return node.handleVersion(peer, data)
+	case cmdVerack:
+		return node.handleVerack(peer)
+	case cmdGetHeaders:
+		return node.handleGetHeaders(peer, data)
+	case cmdHeaders:
+		return node.handleHeaders(peer, data)
+	case cmdInv:
+		return node.handleInv(peer, data)
+	case cmdGetData:
+		return node.handleGetData(peer, data)
+	case cmdBlock:
+		return node.handleBlock(peer, data)
+	case cmdTx:
+		return node.handleTx(peer, data)
+	default:
+		fmt.Printf("忽略%s发送的未知消息：%s\n", peer, command)
+		return nil
+	}
+}
+
+//发送自己的version消息
+func (node *Node) sendVersion(peer *Peer) error {
+	bestHeight, err := node.bc.BestHeight()
+	if err != nil {
+		return err
+	}
+	return peer.send(cmdVersion, &versionMsg{
+		Version:    protocolVersion,
+		Nonce:      node.nonce,
+		Genesis:    node.genesis,
+		Consensus:  node.bc.engine.Name(),
+		BestHeight: bestHeight,
+		ListenPort: uint32(node.port),
+	})
+}
+
+func (node *Node) handleVersion(peer *Peer, data []byte) error {
+	var msg versionMsg
+	err := decodePayload(data, &msg)
+	if err != nil {
+		return fmt.Errorf("version消息无效：%w", err)
+	}
+	if msg.Version != protocolVersion {
+		return fmt.Errorf("协议版本不同：%d", msg.Version)
+	}
+	if msg.Nonce == node.nonce {
+		return errors.New("连接到了自己")
+	}
+	if !bytes.Equal(msg.Genesis, node.genesis) {
+		return fmt.Errorf("创世区块不同：%x", msg.Genesis)
+	}
+	if msg.Consensus != node.bc.engine.Name() {
+		return fmt.Errorf("共识引擎不同：%s", msg.Consensus)
+	}
+	if node.peers.connected(msg.Nonce) {
+		return errors.New("已经与该节点建立了连接")
+	}
+
+	peer.lock.Lock()
+	if peer.version != nil {
+		peer.lock.Unlock()
+		return errors.New("重复的version消息")
+	}
+	peer.version = &msg
+	peer.bestHeight = msg.BestHeight
+	verack := peer.verack
+	peer.lock.Unlock()
+
+	if peer.inbound {
+		err = node.sendVersion(peer)
+		if err != nil {
+			return err
+		}
+	}
+	err = peer.send(cmdVerack, nil)
+	if err != nil {
+		return err
+	}
+	if verack {
+		return node.onHandshake(peer)
+	}
+	return nil
+}
+
+func (node *Node) handleVerack(peer *Peer) error {
+	peer.lock.Lock()
+	if peer.verack {
+		peer.lock.Unlock()
+		return errors.New("重复的verack消息")
+	}
+	peer.verack = true
+	version := peer.version
+	peer.lock.Unlock()
+
+	if version != nil {
+		return node.onHandshake(peer)
+	}
+	return nil
+}
+
+//握手完成：开始同步区块，并通告交易池中的交易
+func (node *Node) onHandshake(peer *Peer) error {
+	err := peer.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+	peer.lock.Lock()
+	bestHeight := peer.bestHeight
+	peer.lock.Unlock()
+	fmt.Printf("与%s握手成功，对方高度%d\n", peer, bestHeight)
+
+	//不知道对方的主链是否与自己相同，没有正在同步区块头时总是请求一次
+	//已经在下载的区块也可以分配给这个节点
+	err = node.sync.start(peer)
+	if err != nil {
+		return err
+	}
+	node.sync.assign()
+
+	var hashes [][]byte
+	for _, entry := range node.pool.List() {
+		hashes = append(hashes, entry.tx.TXID)
+	}
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > maxInvHashes {
+			n = maxInvHashes
+		}
+		err = peer.send(cmdInv, &invMsg{invTypeTx, hashes[:n]})
+		if err != nil {
+			return err
+		}
+		hashes = hashes[n:]
+	}
+	return nil
+}
+
+//回复主链上定位器之后的区块头，没有更多区块头时也回复空的headers，对方据此结束同步
+func (node *Node) handleGetHeaders(peer *Peer, data []byte) error {
+	var msg getHeadersMsg
+	err := decodePayload(data, &msg)
+	if err != nil {
+		return fmt.Errorf("getheaders消息无效：%w", err)
+	}
+	headers, err := node.bc.HeadersAfter(msg.Locator, msg.Stop, maxHeadersPerMsg)
+	if err != nil {
+		fmt.Printf("查找%s请求的区块头失败：%v\n", peer, err)
+		return nil
+	}
+	return peer.send(cmdHeaders, &headersMsg{headers})
+}
+
+func (node *Node) handleHeaders(peer *Peer, data []byte) error {
+	var msg headersMsg
+	err := decodePayload(data, &msg)
+	if err != nil {
+		return fmt.Errorf("headers消息无效：%w", err)
+	}
+	return node.sync.handleHeaders(peer, msg.Headers)
+}
+
+func (node *Node) handleInv(peer *Peer, data []byte) error {
+	var msg invMsg
+	err := decodePayload(data, &msg)
+	if err != nil {
+		return fmt.Errorf("inv消息无效：%w", err)
+	}
+
+	var missing [][]byte
+	for _, hash := range msg.Hashes {
+		if msg.Type == invTypeTx {
+			if _, ok := node.pool.Get(hash); !ok {
+				missing = append(missing, hash)
+			}
+			continue
+		}
+		stored, invalid, err := node.bc.blockStatus(hash)
+		if err != nil {
+			fmt.Printf("查询区块失败：%v\n", err)
+			return nil
+		}
+		//正在同步的区块由blockSync统一下载
+		if !stored && !invalid && !node.sync.isPending(hash) {
+			missing = append(missing, hash)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return peer.send(cmdGetData, &invMsg{msg.Type, missing})
+}
+
+func (node *Node) handleGetData(peer *Peer, data []byte) error {
+	var msg invMsg
+	err := decodePayload(data, &msg)
+	if err != nil {
+		return fmt.Errorf("getdata消息无效：%w", err)
+	}
+	for _, hash := range msg.Hashes {
+		if msg.Type == invTypeTx {
+			tx, ok := node.pool.Get(hash)
+			if !ok {
+				continue
+			}
+			err = peer.sendRaw(cmdTx, tx.Serialize())
+		} else {
+			block, blockErr := node.bc.GetBlockByHash(hash)
+			if blockErr != nil {
+				if !errors.Is(blockErr, ErrBlockNotFound) {
+					fmt.Printf("读取区块失败：%v\n", blockErr)
+				}
+				continue
+			}
+			err = peer.sendRaw(cmdBlock, block.Serialize())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (node *Node) handleBlock(peer *Peer, data []byte) error {
+	block, err := Deserialize(data)
+	if err != nil {
+		return fmt.Errorf("%w：block消息无效：%v", ErrMalformedMessage, err)
+	}
+	peer.updateHeight(block.Height)
+
+	handled, err := node.sync.handleBlock(peer, &block)
+	if handled || err != nil {
+		return err
+	}
+	update, err := node.bc.AcceptBlock(&block)
+	switch {
+	case errors.Is(err, ErrKnownBlock):
+	case errors.Is(err, ErrOrphanBlock):
+		//缺少前面的区块，从分叉点开始同步区块头
+		return node.sync.start(peer)
+	case errors.Is(err, ErrInvalidBlock):
+		//断开连接并记录违规
+		return err
+	case err != nil:
+		fmt.Printf("拒绝%s发送的区块%x：%v\n", peer, block.NowHash, err)
+	case len(update.Connected) == 0:
+		fmt.Printf("收到%s发送的侧链区块%d：%x\n", peer, block.Height, block.NowHash)
+	default:
+		if len(update.Disconnected) > 0 {
+			fmt.Printf("主链发生重组，断开%d个区块，接入%d个区块\n", len(update.Disconnected), len(update.Connected))
+		}
+		fmt.Printf("收到%s发送的区块%d：%x\n", peer, block.Height, block.NowHash)
+		//区块已经上链，交易池更新失败时只是留下一些已经失效的交易，下次加载时会被清理
+		err = node.pool.Reorganize(node.bc, update)
+		if err != nil {
+			fmt.Printf("更新交易池失败：%v\n", err)
+		}
+		node.broadcastInv(peer, invTypeBlock, [][]byte{block.NowHash})
+		node.signalMiner()
+	}
+	return nil
+}
+
+func (node *Node) handleTx(peer *Peer, data []byte) error {
+	tx, err := DeserializeTransaction(data)
+	if err != nil {
+		return fmt.Errorf("%w：tx消息无效：%v", ErrMalformedMessage, err)
+	}
+	err = node.pool.Add(node.bc, &tx)
+	if errors.Is(err, ErrTxInMempool) {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("拒绝%s发送的交易%x：%v\n", peer, tx.TXID, err)
+		//本身无效的交易计入违规分数，但是不断开连接，分数达到上限时才断开
+		node.peers.misbehave(peer, err)
+		return nil
+	}
+	fmt.Printf("收到%s发送的交易%x\n", peer, tx.TXID)
+	node.broadcastInv(peer, invTypeTx, [][]byte{tx.TXID})
+	node.signalMiner()
+	return nil
+}
+
+//向除了except之外所有完成握手的节点通告区块或交易
+func (node *Node) broadcastInv(except *Peer, invType uint32, hashes [][]byte) {
+	for _, peer := range node.peers.ready() {
+		if peer == except {
+			continue
+		}
+		err := peer.send(cmdInv, &invMsg{invType, hashes})
+		if err != nil {
+			fmt.Printf("向%s发送inv失败：%v\n", peer, err)
+		}
+	}
+}
+
+//通知挖矿协程，已经有通知没有处理时不重复通知
+func (node *Node) signalMiner() {
+	if node.miner == "" {
+		return
+	}
+	select {
+	case node.mineSignal <- struct{}{}:
+	default:
+	}
+}
+
+//交易池中有交易时打包挖矿，挖出的区块通告给所有节点
+//挖矿期间收到同一高度的区块时放弃，重新选择交易
+func (node *Node) mineLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-node.mineSignal:
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if node.pool.Count() == 0 {
+			continue
+		}
+		block, err := node.bc.MineBlock(ctx, node.pool, node.miner, "")
+		if errors.Is(err, ErrStaleBlock) {
+			node.signalMiner()
+			continue
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Printf("挖矿失败：%v\n", err)
+			}
+			continue
+		}
+		fmt.Printf("挖出区块%d：%x，打包了%d个交易\n", block.Height, block.NowHash, len(block.Transactions)-1)
+		node.broadcastInv(nil, invTypeBlock, [][]byte{block.NowHash})
+		if node.pool.Count() > 0 {
+			node.signalMiner()
+		}
+	}
+}
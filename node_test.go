@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//在bc上创建一个不挖矿的节点
+func newTestNode(t *testing.T, bc *BlockChain, port int) *Node {
+	t.Helper()
+	node, err := NewNode(bc, port, "", defaultMaxInbound, defaultMaxOutbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+//在后台处理peer上的消息，测试结束时取消并等待处理结束
+func runTestPeer(t *testing.T, node *Node, peer *Peer) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.handlePeer(ctx, peer)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+}
+
+//等待cond成立，超时时测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待%s超时", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//两个使用同一个区块链的节点完成version/verack握手
+//双方收到version后都会立即回复，net.Pipe没有缓冲，两边同时写会互相等待，所以这里使用本机的tcp连接
+func TestNodeHandshake(t *testing.T) {
+	bc, _ := newTestChain(t)
+	server := newTestNode(t, bc, 3000)
+	client := newTestNode(t, bc, 3001)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inbound := newPeer(serverConn, serverConn.RemoteAddr().String(), true)
+	outbound := newPeer(clientConn, listener.Addr().String(), false)
+	runTestPeer(t, server, inbound)
+	runTestPeer(t, client, outbound)
+
+	waitFor(t, "握手完成", func() bool {
+		return inbound.handshakeDone() && outbound.handshakeDone()
+	})
+	if inbound.nonce() != client.nonce || outbound.nonce() != server.nonce {
+		t.Fatal("握手后记录的随机数不是对方节点的")
+	}
+	if len(server.peers.ready()) != 1 || len(client.peers.ready()) != 1 {
+		t.Fatal("握手完成的节点没有加入节点列表")
+	}
+}
+
+//按协议发送version后等待对方的回应，返回对方是否断开了连接
+func sendRawVersion(t *testing.T, remote io.ReadWriter, msg *versionMsg) bool {
+	t.Helper()
+	data, err := encodePayload(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeMessage(remote, cmdVersion, data)
+	if err != nil {
+		//对方在读完之前就断开了
+		return true
+	}
+	_, _, err = readMessage(remote)
+	return err != nil
+}
+
+//创世区块、协议版本或者共识引擎不同，以及握手之前发送其他消息时断开连接
+func TestNodeHandshakeRejected(t *testing.T) {
+	bc, _ := newTestChain(t)
+	node := newTestNode(t, bc, 3000)
+	valid := versionMsg{protocolVersion, 1, node.genesis, bc.engine.Name(), 0, 3001}
+
+	for _, c := range []struct {
+		name   string
+		modify func(msg *versionMsg)
+	}{
+		{"创世区块不同", func(msg *versionMsg) { msg.Genesis = []byte{1} }},
+		{"协议版本不同", func(msg *versionMsg) { msg.Version-- }},
+		{"共识引擎不同", func(msg *versionMsg) { msg.Consensus = "other" }},
+		{"连接到了自己", func(msg *versionMsg) { msg.Nonce = node.nonce }},
+	} {
+		peer, remote := newTestPeer(t, "127.0.0.1:40001", "127.0.0.1", true)
+		runTestPeer(t, node, peer)
+		msg := valid
+		c.modify(&msg)
+		if !sendRawVersion(t, remote, &msg) {
+			t.Errorf("%s：没有断开连接", c.name)
+		}
+	}
+
+	//握手之前发送其他消息
+	peer, remote := newTestPeer(t, "127.0.0.1:40002", "127.0.0.1", true)
+	runTestPeer(t, node, peer)
+	data, err := encodePayload(&invMsg{invTypeTx, [][]byte{{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeMessage(remote, cmdInv, data)
+	if err == nil {
+		_, _, err = readMessage(remote)
+	}
+	if err == nil {
+		t.Error("握手之前收到inv消息时没有断开连接")
+	}
+
+	//正常的version得到version和verack回复
+	peer, remote = newTestPeer(t, "127.0.0.1:40003", "127.0.0.1", true)
+	runTestPeer(t, node, peer)
+	msg := valid
+	data, err = encodePayload(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeMessage(remote, cmdVersion, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{cmdVersion, cmdVerack} {
+		command, _, err := readMessage(remote)
+		if err != nil || command != want {
+			t.Fatalf("收到%s消息（%v），应为%s", command, err, want)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+//握手必须在这个时间内完成，否则断开连接
+const handshakeTimeout = 30 * time.Second
+
+//发送一个消息的超时时间，对方长时间不读取时断开连接
+const writeTimeout = 30 * time.Second
+
+//与一个节点的连接
+type Peer struct {
+	conn net.Conn
+	//对方的地址，主动连接时是配置的地址，被动连接时是对方的ip和端口
+	addr string
+	//是否是对方主动连接过来的
+	inbound bool
+	//对方的ip，封禁和违规分数都按ip计算（本机节点的违规分数见scoreKey）
+	host string
+	//建立连接的时间
+	connTime time.Time
+
+	//发送消息时持有，多个协程可能同时向同一个节点发送消息
+	writeLock sync.Mutex
+
+	//以下字段由lock保护
+	lock sync.Mutex
+	//对方的version消息，收到之前为nil
+	version *versionMsg
+	//是否收到了对方的verack
+	verack bool
+	//对方的主链高度，握手时取自version消息，之后收到更高的区块时更新
+	bestHeight uint64
+}
+
+func newPeer(conn net.Conn, addr string, inbound bool) *Peer {
+	host := conn.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return &Peer{conn: conn, addr: addr, inbound: inbound, host: host, connTime: time.Now()}
+}
+
+func (peer *Peer) String() string {
+	return peer.addr
+}
+
+//发送一个消息，msg为nil时内容为空
+func (peer *Peer) send(command string, msg payload) error {
+	data, err := encodePayload(msg)
+	if err != nil {
+		return err
+	}
+	return peer.sendRaw(command, data)
+}
+
+//发送已经编码的消息内容，区块和交易直接使用Serialize的结果
+func (peer *Peer) sendRaw(command string, data []byte) error {
+	peer.writeLock.Lock()
+	defer peer.writeLock.Unlock()
+	err := peer.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err != nil {
+		return err
+	}
+	return writeMessage(peer.conn, command, data)
+}
+
+//是否已经完成握手：收到了对方的version和verack
+func (peer *Peer) handshakeDone() bool {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	return peer.version != nil && peer.verack
+}
+
+//对方的随机数，握手之前为0
+func (peer *Peer) nonce() uint64 {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	if peer.version == nil {
+		return 0
+	}
+	return peer.version.Nonce
+}
+
+//对方的主链高度
+func (peer *Peer) height() uint64 {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	return peer.bestHeight
+}
+
+//收到对方更高的区块或区块头时更新对方的高度
+func (peer *Peer) updateHeight(height uint64) {
+	peer.lock.Lock()
+	defer peer.lock.Unlock()
+	if height > peer.bestHeight {
+		peer.bestHeight = height
+	}
+}
+
+func (peer *Peer) close() {
+	peer.conn.Close()
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//节点管理
+//1.连接数：被动连接最多maxInbound个，主动连接最多maxOutbound个，超过时拒绝新的连接
+//2.违规分数：对方发送无法解析的消息、工作量证明或签名无效的区块和区块头时，按错误种类累计分数
+//  分数按ip累计，断开重连不会清零，达到banThreshold时封禁这个ip defaultBanDuration，并断开它的所有连接
+//  本机（回环地址）的节点共用同一个ip，按ip封禁会把本机的所有节点一起封禁，所以按地址累计，达到上限时只断开这个连接
+//3.封禁列表保存在banListFile中（见banList.go），banPeer/unbanPeer修改之后，运行中的节点在一秒内重新读取
+//4.运行中的节点定期把连接的节点写入peersFile，listPeers读取这个文件，节点停止时删除
+//  节点运行时数据库被节点占用，这几个命令不打开区块链，只读写这两个文件
+
+//默认的最大被动连接数和主动连接数
+const defaultMaxInbound = 32
+const defaultMaxOutbound = 8
+
+//违规分数累计达到这个值时封禁
+const banThreshold = 100
+
+//各种违规的分数
+const (
+	//消息无法解析
+	scoreMalformed = 20
+	//区块头与已有的区块头不连续
+	scoreUnconnected = 20
+	//工作量证明、签名或者交易无效的区块和区块头，或者与区块头不符的区块
+	scoreInvalidBlock = 100
+	//签名无效等本身就无效的交易
+	scoreInvalidTx = 50
+)
+
+//运行中的节点把连接的节点写入这个文件
+const peersFile = "peers.dat"
+
+//写入peersFile的间隔
+const peersSnapshotInterval = 5 * time.Second
+
+//按错误种类计算违规分数，0表示不是对方的过错（例如连接断开、创世区块不同）
+//交易只有本身无效（ErrInvalidTx）时计分，因为交易池中的冲突或者还没有收到前面的交易而被拒绝时不计分
+//区块时间戳超前（ErrFutureBlock）可能只是时钟不同步，本地数据库出错也不是对方的过错，都不计分
+func misbehaviorScore(err error) int {
+	switch {
+	case errors.Is(err, ErrMalformedMessage):
+		return scoreMalformed
+	case errors.Is(err, ErrInvalidBlock):
+		return scoreInvalidBlock
+	case errors.Is(err, ErrInvalidTx):
+		return scoreInvalidTx
+	case errors.Is(err, ErrOrphanBlock):
+		return scoreUnconnected
+	}
+	return 0
+}
+
+//是否是回环地址（本机的节点）
+func isLoopback(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+//违规分数的key，一般是对方的ip，本机的节点是对方的地址
+//被动连接的地址包含对方临时的端口，所以本机节点断开重连之后分数重新计算
+func scoreKey(peer *Peer) string {
+	if isLoopback(peer.host) {
+		return peer.addr
+	}
+	return peer.host
+}
+
+//peersFile中的一个节点
+type PeerInfo struct {
+	Addr     string
+	Inbound  bool
+	Height   uint64
+	Score    int
+	ConnTime time.Time
+}
+
+//peersFile的内容
+type PeerSnapshot struct {
+	//节点监听的端口
+	Port int
+	//写入的时间，节点异常退出时文件不会被删除，可以据此判断
+	Time  time.Time
+	Peers []PeerInfo
+}
+
+//读取运行中的节点写入的peersFile，文件不存在（节点没有运行）时返回nil
+func LoadPeerSnapshot() (*PeerSnapshot, error) {
+	content, err := ioutil.ReadFile(peersFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w：%v", ErrPeerFile, err)
+	}
+	var snapshot PeerSnapshot
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(&snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("%w：%s已损坏：%v", ErrPeerFile, peersFile, err)
+	}
+	return &snapshot, nil
+}
+
+type PeerManager struct {
+	port        int
+	maxInbound  int
+	maxOutbound int
+
+	lock sync.Mutex
+	//已经建立的连接，包括还没有完成握手的
+	peers map[*Peer]bool
+	//违规分数，key见scoreKey
+	scores map[string]int
+	//封禁列表，以及读取时文件的修改时间，文件被命令修改后重新读取
+	bans       *BanList
+	banModTime time.Time
+	//上次写入peersFile的时间
+	snapshotTime time.Time
+}
+
+func NewPeerManager(port, maxInbound, maxOutbound int) (*PeerManager, error) {
+	pm := &PeerManager{
+		port:        port,
+		maxInbound:  maxInbound,
+		maxOutbound: maxOutbound,
+		peers:       make(map[*Peer]bool),
+		scores:      make(map[string]int),
+	}
+	pm.banModTime = banListModTime()
+	bans, err := LoadBanList()
+	if err != nil {
+		return nil, err
+	}
+	pm.bans = bans
+	return pm, nil
+}
+
+//封禁列表文件的修改时间，文件不存在时为零值
+func banListModTime() time.Time {
+	info, err := os.Stat(banListFile)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+//加入一个新的连接，对方被封禁或者连接数已满时返回错误
+func (pm *PeerManager) add(peer *Peer) error {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	if ban, ok := pm.bans.Banned(peer.host); ok {
+		return fmt.Errorf("%s已被封禁，到%s解除", peer.host, ban.Until.Format("2006-01-02 15:04:05"))
+	}
+	inbound, outbound := 0, 0
+	for p := range pm.peers {
+		if p.inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+	if peer.inbound && inbound >= pm.maxInbound {
+		return fmt.Errorf("被动连接已满（%d个）", pm.maxInbound)
+	}
+	if !peer.inbound && outbound >= pm.maxOutbound {
+		return fmt.Errorf("主动连接已满（%d个）", pm.maxOutbound)
+	}
+	pm.peers[peer] = true
+	return nil
+}
+
+func (pm *PeerManager) remove(peer *Peer) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	delete(pm.peers, peer)
+}
+
+//主动连接数是否已满，已满时不再连接配置的节点
+func (pm *PeerManager) outboundFull() bool {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	outbound := 0
+	for peer := range pm.peers {
+		if !peer.inbound {
+			outbound++
+		}
+	}
+	return outbound >= pm.maxOutbound
+}
+
+//是否已经与随机数为nonce的节点完成了握手
+func (pm *PeerManager) connected(nonce uint64) bool {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	for peer := range pm.peers {
+		if peer.handshakeDone() && peer.nonce() == nonce {
+			return true
+		}
+	}
+	return false
+}
+
+//所有完成握手的节点
+func (pm *PeerManager) ready() []*Peer {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	var peers []*Peer
+	for peer := range pm.peers {
+		if peer.handshakeDone() {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+//记录peer的违规，err不是对方的过错时忽略
+//分数达到banThreshold时封禁对方的ip，并断开这个ip的所有连接；本机的节点不封禁，只断开这个连接
+func (pm *PeerManager) misbehave(peer *Peer, err error) {
+	score := misbehaviorScore(err)
+	if score == 0 {
+		return
+	}
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	key := scoreKey(peer)
+	pm.scores[key] += score
+	total := pm.scores[key]
+	fmt.Printf("%s违规，分数增加%d，共%d分\n", peer, score, total)
+	if total < banThreshold {
+		return
+	}
+	delete(pm.scores, key)
+	if isLoopback(peer.host) {
+		fmt.Printf("断开本机节点%s：%v\n", peer, err)
+		peer.close()
+		return
+	}
+	fmt.Printf("封禁%s %s：%v\n", peer.host, defaultBanDuration, err)
+	err = pm.ban(peer.host, defaultBanDuration, err.Error())
+	if err != nil {
+		fmt.Printf("保存封禁列表失败：%v\n", err)
+	}
+}
+
+//封禁host并断开它的所有连接，调用时必须持有锁
+//先重新读取文件再写回，保留节点运行期间用命令做的修改，文件无法读写时只在内存中封禁
+func (pm *PeerManager) ban(host string, duration time.Duration, reason string) error {
+	bans, err := LoadBanList()
+	if err == nil {
+		pm.bans = bans
+	}
+	pm.bans.Ban(host, duration, reason)
+	pm.disconnectBanned()
+	if err != nil {
+		return err
+	}
+	err = pm.bans.Save()
+	if err != nil {
+		return err
+	}
+	pm.banModTime = banListModTime()
+	return nil
+}
+
+//断开被封禁的ip的连接，调用时必须持有锁
+func (pm *PeerManager) disconnectBanned() {
+	for peer := range pm.peers {
+		if _, ok := pm.bans.Banned(peer.host); ok {
+			fmt.Printf("%s已被封禁，断开连接\n", peer)
+			peer.close()
+		}
+	}
+}
+
+//每秒调用一次：封禁列表文件被修改时重新读取，并断开新封禁的ip的连接
+//每隔peersSnapshotInterval把完成握手的节点写入peersFile
+func (pm *PeerManager) maintain() {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	modTime := banListModTime()
+	if !modTime.Equal(pm.banModTime) {
+		//读取失败时也记录修改时间，文件再次修改之前不重复打印
+		pm.banModTime = modTime
+		bans, err := LoadBanList()
+		if err != nil {
+			fmt.Printf("读取封禁列表失败：%v\n", err)
+		} else {
+			pm.bans = bans
+			pm.disconnectBanned()
+		}
+	}
+	if time.Since(pm.snapshotTime) >= peersSnapshotInterval {
+		pm.snapshotTime = time.Now()
+		err := pm.saveSnapshot()
+		if err != nil {
+			fmt.Printf("保存节点列表失败：%v\n", err)
+		}
+	}
+}
+
+//把完成握手的节点写入peersFile，调用时必须持有锁
+func (pm *PeerManager) saveSnapshot() error {
+	snapshot := PeerSnapshot{Port: pm.port, Time: time.Now()}
+	for peer := range pm.peers {
+		if !peer.handshakeDone() {
+			continue
+		}
+		snapshot.Peers = append(snapshot.Peers, PeerInfo{
+			Addr:     peer.addr,
+			Inbound:  peer.inbound,
+			Height:   peer.height(),
+			Score:    pm.scores[scoreKey(peer)],
+			ConnTime: peer.connTime,
+		})
+	}
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(&snapshot)
+	if err != nil {
+		return fmt.Errorf("%w：%v", ErrPeerFile, err)
+	}
+	return writeFileAtomic(peersFile, buffer.Bytes())
+}
+
+//节点停止时删除peersFile
+func (pm *PeerManager) close() {
+	err := os.Remove(peersFile)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("删除%s失败：%v\n", peersFile, err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+//创建一个连接到内存管道的节点，返回对方一端
+func newTestPeer(t *testing.T, addr, host string, inbound bool) (*Peer, net.Conn) {
+	t.Helper()
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return &Peer{conn: local, addr: addr, inbound: inbound, host: host, connTime: time.Now()}, remote
+}
+
+//对方一端是否已经被断开
+func peerClosed(remote net.Conn) bool {
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := remote.Read(make([]byte, 1))
+	return err == io.EOF
+}
+
+//本机的节点违规时只断开这个连接，不封禁127.0.0.1，其他本机节点不受影响
+//其他ip的违规累计到上限时封禁这个ip
+func TestMisbehaveLoopback(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	pm, err := NewPeerManager(3000, defaultMaxInbound, defaultMaxOutbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad, badRemote := newTestPeer(t, "127.0.0.1:3001", "127.0.0.1", false)
+	good, goodRemote := newTestPeer(t, "127.0.0.1:3002", "127.0.0.1", false)
+	for _, peer := range []*Peer{bad, good} {
+		err = pm.add(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//违规分数按地址累计
+	malformed := fmt.Errorf("%w：测试", ErrMalformedMessage)
+	pm.misbehave(bad, malformed)
+	if pm.scores["127.0.0.1:3001"] != scoreMalformed || pm.scores["127.0.0.1:3002"] != 0 {
+		t.Fatalf("本机节点的违规分数没有按地址累计：%v", pm.scores)
+	}
+	pm.misbehave(bad, fmt.Errorf("%w：测试", ErrInvalidBlock))
+	if !peerClosed(badRemote) {
+		t.Fatal("违规的本机节点没有被断开")
+	}
+	if _, banned := pm.bans.Banned("127.0.0.1"); banned {
+		t.Fatal("本机ip被封禁")
+	}
+	if bans, err := LoadBanList(); err != nil || len(bans.Bans) != 0 {
+		t.Fatalf("本机ip被写入封禁列表：%v", err)
+	}
+	go goodRemote.Write([]byte{1})
+	if _, err = good.conn.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("其他本机节点被断开：%v", err)
+	}
+
+	remote, remoteConn := newTestPeer(t, "10.0.0.1:3000", "10.0.0.1", false)
+	err = pm.add(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < banThreshold/scoreMalformed; i++ {
+		pm.misbehave(remote, malformed)
+	}
+	if _, banned := pm.bans.Banned("10.0.0.1"); !banned {
+		t.Fatal("违规分数达到上限的ip没有被封禁")
+	}
+	if !peerClosed(remoteConn) {
+		t.Fatal("被封禁的节点没有被断开")
+	}
+}
+
+//只有对方的过错计分：本地数据库出错、时间戳超前、交易池冲突都不计分
+func TestMisbehaviorScore(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want int
+	}{
+		{fmt.Errorf("%w：测试", ErrMalformedMessage), scoreMalformed},
+		{fmt.Errorf("%w：测试", ErrInvalidBlock), scoreInvalidBlock},
+		{fmt.Errorf("%w：测试", ErrOrphanBlock), scoreUnconnected},
+		{fmt.Errorf("%w：交易签名无效", ErrInvalidTx), scoreInvalidTx},
+		{rejectBlockError([]byte{1}, fmt.Errorf("%w：测试", ErrFutureBlock)), 0},
+		{rejectBlockError([]byte{1}, fmt.Errorf("%w：测试", ErrDatabase)), 0},
+		{rejectBlockError([]byte{1}, errors.New("poa签名无效")), scoreInvalidBlock},
+		{fmt.Errorf("%w：测试", ErrMempoolConflict), 0},
+		{io.EOF, 0},
+	} {
+		if got := misbehaviorScore(c.err); got != c.want {
+			t.Errorf("%v的违规分数为%d，应为%d", c.err, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//权威证明（Proof of Authority）共识，用于内部测试网络，不需要挖矿
+//1.区块由一组授权的签名者轮流出块：高度为h的区块必须由signers[h%len(signers)]签名
+//2.签名者用钱包中的ECDSA私钥对区块哈希签名，公钥放在区块头的Signer字段
+//3.签名者出块时可以在区块头中投票增加或删除签名者，超过半数签名者投票后生效
+//poa.conf存在时区块链使用poa共识，初始的签名者在其中配置
+//初始的签名者是共识规则的一部分，创建区块链时写入metaBucket，之后打开区块链时使用数据库中记录的签名者
+//否则配置不同的节点，或者修改了配置的节点，会对哪些区块有效得出不同的结论
+
+const poaConfigFile = "poa.conf"
+
+//初始签名者在metaBucket中的key，value为创世区块之前的签名者公钥哈希（各20字节）按顺序拼接
+const poaSignersKey = "PoASigners"
+
+//每隔这么多个区块缓存一个签名者状态，计算其他区块的状态时从最近的缓存向后应用投票
+const poaSnapshotInterval = 64
+
+//最多缓存的签名者状态个数，超过时删除最早缓存的
+const maxPoASnapshots = 128
+
+//poa区块的难度固定为1，只是为了与pow的区块格式保持一致
+const poaDifficulty = 1
+
+//poa配置文件，每行一条配置，#开头为注释
+//	authority ADDRESS       初始的授权签名者，只在创建区块链时使用
+//	vote add ADDRESS        本节点出块时投票增加签名者
+//	vote remove ADDRESS     本节点出块时投票删除签名者
+type PoAConfig struct {
+	Authorities []string
+	Votes       []PoAVote
+}
+
+//一个投票提案
+type PoAVote struct {
+	Address string
+	Add     bool
+}
+
+//读取poa配置文件
+func LoadPoAConfig(path string) (*PoAConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config PoAConfig
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 2 && fields[0] == "authority":
+			if !IsValidAddress(fields[1]) {
+				return nil, fmt.Errorf("%s第%d行：%w：%s", path, lineNum, ErrInvalidAddress, fields[1])
+			}
+			config.Authorities = append(config.Authorities, fields[1])
+		case len(fields) == 3 && fields[0] == "vote" && (fields[1] == "add" || fields[1] == "remove"):
+			if !IsValidAddress(fields[2]) {
+				return nil, fmt.Errorf("%s第%d行：%w：%s", path, lineNum, ErrInvalidAddress, fields[2])
+			}
+			config.Votes = append(config.Votes, PoAVote{fields[2], fields[1] == "add"})
+		default:
+			return nil, fmt.Errorf("%s第%d行：无法识别的配置：%s", path, lineNum, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(config.Authorities) == 0 {
+		return nil, fmt.Errorf("%s中至少需要配置一个授权签名者", path)
+	}
+	return &config, nil
+}
+
+//在配置文件末尾追加一个投票
+func AppendPoAVote(path string, vote PoAVote) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	action := "remove"
+	if vote.Add {
+		action = "add"
+	}
+	_, err = fmt.Fprintf(file, "vote %s %s\n", action, vote.Address)
+	return err
+}
+
+//某个区块之后的签名者状态
+type poaSnapshot struct {
+	//授权签名者的公钥哈希，按字节序排序，决定轮流出块的顺序
+	signers [][]byte
+	//尚未生效的投票，key为提案，value为已投票的签名者公钥哈希集合
+	tally map[string]map[string]bool
+}
+
+//提案的key：1字节增加/删除标记 + 目标公钥哈希
+func proposalKey(target []byte, add bool) string {
+	flag := byte(0)
+	if add {
+		flag = 1
+	}
+	return string(append([]byte{flag}, target...))
+}
+
+func (snap *poaSnapshot) isSigner(pubKeyHash []byte) bool {
+	for _, signer := range snap.signers {
+		if bytes.Equal(signer, pubKeyHash) {
+			return true
+		}
+	}
+	return false
+}
+
+//高度为height的区块应该由哪个签名者出块
+func (snap *poaSnapshot) inTurn(height uint64) []byte {
+	return snap.signers[height%uint64(len(snap.signers))]
+}
+
+//投票是否有意义：只能增加不是签名者的地址，删除已经是签名者的地址，并且不能删除最后一个签名者
+func (snap *poaSnapshot) validVote(target []byte, add bool) bool {
+	if add {
+		return !snap.isSigner(target)
+	}
+	return snap.isSigner(target) && len(snap.signers) > 1
+}
+
+func (snap *poaSnapshot) copy() *poaSnapshot {
+	cpy := poaSnapshot{
+		signers: append([][]byte{}, snap.signers...),
+		tally:   make(map[string]map[string]bool),
+	}
+	for key, voters := range snap.tally {
+		cpy.tally[key] = make(map[string]bool)
+		for voter := range voters {
+			cpy.tally[key][voter] = true
+		}
+	}
+	return &cpy
+}
+
+//应用一个区块中的投票，返回新的状态
+func (snap *poaSnapshot) apply(block *Block) *poaSnapshot {
+	next := snap.copy()
+	if len(block.Vote) == 0 || !next.validVote(block.Vote, block.VoteAdd) {
+		return next
+	}
+
+	key := proposalKey(block.Vote, block.VoteAdd)
+	if next.tally[key] == nil {
+		next.tally[key] = make(map[string]bool)
+	}
+	//同一个签名者重复投票只算一次
+	next.tally[key][string(HashPubKey(block.Signer))] = true
+	if len(next.tally[key]) <= len(next.signers)/2 {
+		return next
+	}
+
+	//超过半数，投票生效，与这个地址相关的投票全部清空
+	delete(next.tally, proposalKey(block.Vote, true))
+	delete(next.tally, proposalKey(block.Vote, false))
+	if block.VoteAdd {
+		next.signers = append(next.signers, block.Vote)
+		sort.Slice(next.signers, func(i, j int) bool {
+			return bytes.Compare(next.signers[i], next.signers[j]) < 0
+		})
+	} else {
+		for i, signer := range next.signers {
+			if bytes.Equal(signer, block.Vote) {
+				next.signers = append(next.signers[:i], next.signers[i+1:]...)
+				break
+			}
+		}
+		//被删除的签名者之前投的票也作废
+		for _, voters := range next.tally {
+			delete(voters, string(block.Vote))
+		}
+	}
+	return next
+}
+
+//poa共识引擎
+type PoAEngine struct {
+	config *PoAConfig
+	//创世区块之前的签名者状态
+	genesis *poaSnapshot
+
+	//部分区块之后的签名者状态，key为区块哈希，order记录缓存的顺序，用于限制缓存的个数
+	lock      sync.Mutex
+	snapshots map[string]*poaSnapshot
+	order     []string
+}
+
+//创建poa共识引擎
+func NewPoAEngine(config *PoAConfig) (*PoAEngine, error) {
+	var signers [][]byte
+	for _, address := range config.Authorities {
+		pubKeyHash, err := GetPubKeyFromAddress(address)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, pubKeyHash)
+	}
+	engine := &PoAEngine{config: config}
+	engine.setGenesisSigners(signers)
+	return engine, nil
+}
+
+//设置创世区块之前的签名者，去掉重复的并排序，同时清空缓存的签名者状态
+func (engine *PoAEngine) setGenesisSigners(signers [][]byte) {
+	genesis := poaSnapshot{tally: make(map[string]map[string]bool)}
+	for _, signer := range signers {
+		if !genesis.isSigner(signer) {
+			genesis.signers = append(genesis.signers, signer)
+		}
+	}
+	sort.Slice(genesis.signers, func(i, j int) bool {
+		return bytes.Compare(genesis.signers[i], genesis.signers[j]) < 0
+	})
+
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	engine.genesis = &genesis
+	engine.snapshots = make(map[string]*poaSnapshot)
+	engine.order = nil
+}
+
+//创建区块链时把初始签名者写入metaBucket，不是poa共识时什么也不做，必须在创建区块链的bolt事务中调用
+func putPoASigners(tx *bolt.Tx, engine Consensus) error {
+	poa, ok := engine.(*PoAEngine)
+	if !ok {
+		return nil
+	}
+	return tx.Bucket([]byte(metaBucket)).Put([]byte(poaSignersKey), bytes.Join(poa.genesis.signers, nil))
+}
+
+//打开区块链时改用metaBucket中记录的初始签名者，配置文件中的authority与记录不同时打印提示
+//旧数据库中没有记录时把配置文件中的签名者写入，之后同样不再随配置文件改变
+func loadPoASigners(tx *bolt.Tx, engine Consensus) error {
+	poa, ok := engine.(*PoAEngine)
+	if !ok {
+		return nil
+	}
+	data := tx.Bucket([]byte(metaBucket)).Get([]byte(poaSignersKey))
+	if data == nil {
+		return putPoASigners(tx, engine)
+	}
+	if len(data) == 0 || len(data)%20 != 0 {
+		return fmt.Errorf("%w：初始签名者的长度不正确：%d", ErrDatabase, len(data))
+	}
+	var signers [][]byte
+	for i := 0; i < len(data); i += 20 {
+		signers = append(signers, append([]byte{}, data[i:i+20]...))
+	}
+	if !bytes.Equal(bytes.Join(poa.genesis.signers, nil), data) {
+		fmt.Printf("%s中的授权签名者与区块链创建时的不同，使用区块链中记录的签名者\n", poaConfigFile)
+	}
+	poa.setGenesisSigners(signers)
+	return nil
+}
+
+func (engine *PoAEngine) Name() string {
+	return "poa"
+}
+
+//缓存hash对应区块之后的签名者状态，超过maxPoASnapshots个时删除最早缓存的，调用时必须持有锁
+func (engine *PoAEngine) cache(hash []byte, snap *poaSnapshot) {
+	if _, ok := engine.snapshots[string(hash)]; ok {
+		return
+	}
+	engine.snapshots[string(hash)] = snap
+	engine.order = append(engine.order, string(hash))
+	if len(engine.order) > maxPoASnapshots {
+		delete(engine.snapshots, engine.order[0])
+		engine.order = engine.order[1:]
+	}
+}
+
+//计算hash对应区块之后的签名者状态
+//向前找到一个已经缓存的区块（或创世区块），再依次向后应用每个区块的投票
+//只缓存每poaSnapshotInterval个区块中的一个以及要查询的区块，被删除的缓存需要时重新计算
+func (engine *PoAEngine) snapshot(chain HeaderReader, hash []byte) (*poaSnapshot, error) {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	var blocks []*Block
+	var snap *poaSnapshot
+	for {
+		if len(hash) == 0 {
+			snap = engine.genesis
+			break
+		}
+		if cached, ok := engine.snapshots[string(hash)]; ok {
+			snap = cached
+			break
+		}
+		if chain == nil {
+			return nil, errors.New("计算签名者时找不到区块链")
+		}
+		block, err := chain.GetHeader(hash)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+		hash = block.PreHash
+	}
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		snap = snap.apply(blocks[i])
+		if i == 0 || blocks[i].Height%poaSnapshotInterval == 0 {
+			engine.cache(blocks[i].NowHash, snap)
+		}
+	}
+	return snap, nil
+}
+
+//返回hash对应区块之后的授权签名者地址
+func (engine *PoAEngine) Signers(chain *BlockChain, hash []byte) ([]string, error) {
+	snap, err := engine.snapshot(chain, hash)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, signer := range snap.signers {
+		addresses = append(addresses, PubKeyHashToAddress(signer))
+	}
+	return addresses, nil
+}
+
+//签名：找到轮到出块的签名者的私钥，对区块哈希签名
+func (engine *PoAEngine) Seal(ctx context.Context, chain *BlockChain, block *Block) error {
+	//创世区块时chain为nil，不能直接转换为接口，否则snapshot中无法判断
+	var reader HeaderReader
+	if chain != nil {
+		reader = chain
+	}
+	return engine.seal(ctx, reader, block)
+}
+
+//Seal的实现，祖先区块头从chain中查询
+func (engine *PoAEngine) seal(ctx context.Context, chain HeaderReader, block *Block) error {
+	snap, err := engine.snapshot(chain, block.PreHash)
+	if err != nil {
+		return err
+	}
+	signerHash := snap.inTurn(block.Height)
+
+	ws, err := NewWallets()
+	if err != nil {
+		return err
+	}
+	var wallet *Wallet
+	for _, w := range ws.WalletMap {
+		if bytes.Equal(HashPubKey(w.Pubkey), signerHash) {
+			wallet = w
+			break
+		}
+	}
+	if wallet == nil {
+		return fmt.Errorf("高度%d轮到%s出块，本地钱包中没有它的私钥", block.Height, PubKeyHashToAddress(signerHash))
+	}
+
+	//带上配置文件中第一个仍然有意义的投票
+	block.Vote = nil
+	block.VoteAdd = false
+	for _, vote := range engine.config.Votes {
+		target, err := GetPubKeyFromAddress(vote.Address)
+		if err != nil {
+			return err
+		}
+		if snap.validVote(target, vote.Add) {
+			block.Vote = target
+			block.VoteAdd = vote.Add
+			break
+		}
+	}
+
+	if ctx.Err() != nil {
+		return ErrMiningCancelled
+	}
+	return signPoABlock(block, wallet)
+}
+
+//用wallet的私钥对区块签名，设置Signer、NowHash和Signature
+func signPoABlock(block *Block, wallet *Wallet) error {
+	block.Signer = wallet.Pubkey
+	block.NowHash = block.CalcHash()
+	r, s, err := ecdsa.Sign(rand.Reader, wallet.Private, block.NowHash)
+	if err != nil {
+		return err
+	}
+	block.Signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return nil
+}
+
+//校验：签名者是轮到出块的授权签名者，并且签名有效
+func (engine *PoAEngine) VerifySeal(chain HeaderReader, block *Block) error {
+	if len(block.Signer) != 64 || len(block.Signature) != 64 {
+		return errors.New("区块没有poa签名")
+	}
+	if len(block.Vote) != 0 && len(block.Vote) != 20 {
+		return fmt.Errorf("无效的投票：%x", block.Vote)
+	}
+
+	//前一个区块已经找到，计算签名者时查询祖先失败是本地数据库的问题
+	snap, err := engine.snapshot(chain, block.PreHash)
+	if err != nil {
+		return fmt.Errorf("%w：%v", ErrDatabase, err)
+	}
+	signerHash := HashPubKey(block.Signer)
+	if !snap.isSigner(signerHash) {
+		return fmt.Errorf("%s不是授权签名者", PubKeyHashToAddress(signerHash))
+	}
+	if !bytes.Equal(snap.inTurn(block.Height), signerHash) {
+		return fmt.Errorf("高度%d不是轮到%s出块", block.Height, PubKeyHashToAddress(signerHash))
+	}
+
+	X := big.Int{}
+	Y := big.Int{}
+	X.SetBytes(block.Signer[:32])
+	Y.SetBytes(block.Signer[32:])
+	pubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: &X, Y: &Y}
+	r := big.Int{}
+	s := big.Int{}
+	r.SetBytes(block.Signature[:32])
+	s.SetBytes(block.Signature[32:])
+	if !ecdsa.Verify(&pubKey, block.CalcHash(), &r, &s) {
+		return errors.New("poa签名无效")
+	}
+	return nil
+}
+
+//poa不需要调整难度
+func (engine *PoAEngine) CalcDifficulty(chain HeaderReader, prev *Block) (uint64, error) {
+	return poaDifficulty, nil
+}
+
+//每个高度只有轮到的签名者可以出块，所有区块的工作量都是1，分叉时选择最长的分支
+func (engine *PoAEngine) BlockWork(block *Block) *big.Int {
+	return big.NewInt(1)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+)
+
+//在当前目录的钱包文件中创建n个钱包，按公钥哈希排序返回，即授权后轮流出块的顺序
+func newPoAWallets(t *testing.T, n int) []*Wallet {
+	t.Helper()
+	ws, err := NewWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wallets []*Wallet
+	for i := 0; i < n; i++ {
+		address, err := ws.CreateWallet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wallets = append(wallets, ws.WalletMap[address])
+	}
+	sort.Slice(wallets, func(i, j int) bool {
+		return bytes.Compare(HashPubKey(wallets[i].Pubkey), HashPubKey(wallets[j].Pubkey)) < 0
+	})
+	return wallets
+}
+
+//以wallets为初始签名者创建poa共识引擎
+func newTestPoAEngine(t *testing.T, wallets []*Wallet) *PoAEngine {
+	t.Helper()
+	config := &PoAConfig{}
+	for _, wallet := range wallets {
+		config.Authorities = append(config.Authorities, wallet.NewAddress())
+	}
+	engine, err := NewPoAEngine(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+//在parent之后创建一个由轮到的签名者签名的区块并加入headers，parent为nil时创建创世区块
+func sealPoABlock(t *testing.T, engine *PoAEngine, headers testHeaders, parent *Block) *Block {
+	t.Helper()
+	block := newPoABlock(parent)
+	err := engine.seal(context.Background(), headers, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers[string(block.NowHash)] = block
+	return block
+}
+
+//在parent之后创建一个还没有签名的区块
+func newPoABlock(parent *Block) *Block {
+	if parent == nil {
+		return NewBlock(nil, []byte{}, 0, poaDifficulty)
+	}
+	return NewBlock(nil, parent.NowHash, parent.Height+1, poaDifficulty)
+}
+
+//签名者按公钥哈希的顺序轮流出块，每个区块都能通过校验
+func TestPoAInTurn(t *testing.T) {
+	chdirTemp(t)
+	wallets := newPoAWallets(t, 3)
+	engine := newTestPoAEngine(t, wallets)
+	headers := make(testHeaders)
+
+	var parent *Block
+	for height := uint64(0); height < 7; height++ {
+		block := sealPoABlock(t, engine, headers, parent)
+		want := wallets[height%3]
+		if !bytes.Equal(block.Signer, want.Pubkey) {
+			t.Fatalf("高度%d由%s签名，应由%s签名", height, PubKeyHashToAddress(HashPubKey(block.Signer)), want.NewAddress())
+		}
+		err := engine.VerifySeal(headers, block)
+		if err != nil {
+			t.Fatalf("高度%d：%v", height, err)
+		}
+		parent = block
+	}
+}
+
+//投票统计：超过半数生效，同一个签名者重复投票只算一次，无效的投票被忽略，被删除的签名者的投票作废
+func TestPoASnapshotApply(t *testing.T) {
+	//签名者用公钥区分，快照中记录的是公钥哈希
+	pubKey := func(name string) []byte {
+		return []byte(strings.Repeat(name, 64))
+	}
+	hash := func(name string) []byte {
+		return HashPubKey(pubKey(name))
+	}
+	type vote struct {
+		signer, target string
+		add            bool
+	}
+	for _, c := range []struct {
+		name    string
+		signers string
+		votes   []vote
+		want    string
+		pending int
+	}{
+		{"一票不过半", "ABC", []vote{{"A", "D", true}}, "ABC", 1},
+		{"过半增加", "ABC", []vote{{"A", "D", true}, {"B", "D", true}}, "ABCD", 0},
+		{"重复投票只算一次", "ABC", []vote{{"A", "D", true}, {"A", "D", true}}, "ABC", 1},
+		{"过半删除", "ABC", []vote{{"A", "C", false}, {"B", "C", false}}, "AB", 0},
+		{"四个签名者两票不过半", "ABCD", []vote{{"A", "E", true}, {"B", "E", true}}, "ABCD", 2},
+		{"四个签名者三票过半", "ABCD", []vote{{"A", "E", true}, {"B", "E", true}, {"C", "E", true}}, "ABCDE", 0},
+		{"被删除的签名者的投票作废", "ABC", []vote{{"C", "D", true}, {"A", "C", false}, {"B", "C", false}, {"A", "D", true}}, "AB", 1},
+		{"不能增加已有的签名者", "ABC", []vote{{"A", "B", true}}, "ABC", 0},
+		{"不能删除不存在的签名者", "ABC", []vote{{"A", "D", false}}, "ABC", 0},
+		{"不能删除最后一个签名者", "A", []vote{{"A", "A", false}}, "A", 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var signers [][]byte
+			for _, name := range c.signers {
+				signers = append(signers, hash(string(name)))
+			}
+			engine := &PoAEngine{config: &PoAConfig{}}
+			engine.setGenesisSigners(signers)
+			snap := engine.genesis
+			for _, v := range c.votes {
+				snap = snap.apply(&Block{Signer: pubKey(v.signer), Vote: hash(v.target), VoteAdd: v.add})
+			}
+
+			var want [][]byte
+			for _, name := range c.want {
+				want = append(want, hash(string(name)))
+			}
+			sort.Slice(want, func(i, j int) bool {
+				return bytes.Compare(want[i], want[j]) < 0
+			})
+			if !bytes.Equal(bytes.Join(snap.signers, nil), bytes.Join(want, nil)) {
+				t.Fatalf("投票后有%d个签名者，应为%s", len(snap.signers), c.want)
+			}
+			pending := 0
+			for _, voters := range snap.tally {
+				pending += len(voters)
+			}
+			if pending != c.pending {
+				t.Fatalf("尚未生效的投票有%d票，应为%d票", pending, c.pending)
+			}
+			//apply不能修改原来的状态
+			if len(engine.genesis.signers) != len(c.signers) || len(engine.genesis.tally) != 0 {
+				t.Fatal("apply修改了之前的签名者状态")
+			}
+		})
+	}
+}
+
+//签名者出块时带上配置的投票，过半后新的签名者加入轮流出块
+func TestPoAVoteInBlocks(t *testing.T) {
+	chdirTemp(t)
+	wallets := newPoAWallets(t, 3)
+	engine := newTestPoAEngine(t, wallets[:2])
+	engine.config.Votes = []PoAVote{{wallets[2].NewAddress(), true}}
+	headers := make(testHeaders)
+
+	//两个签名者需要两票，高度0和1各投一票
+	genesis := sealPoABlock(t, engine, headers, nil)
+	block := sealPoABlock(t, engine, headers, genesis)
+	signers, err := engine.snapshot(headers, block.NowHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signers.isSigner(HashPubKey(wallets[2].Pubkey)) {
+		t.Fatal("投票过半后没有增加签名者")
+	}
+	//投票已经生效，之后的区块不再投票
+	next := sealPoABlock(t, engine, headers, block)
+	if len(next.Vote) != 0 {
+		t.Fatalf("投票生效后区块中仍然有投票：%x", next.Vote)
+	}
+	err = engine.VerifySeal(headers, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPoAVerifySeal(t *testing.T) {
+	chdirTemp(t)
+	wallets := newPoAWallets(t, 4)
+	//最后一个钱包不是授权签名者
+	signers, outsider := wallets[:3], wallets[3]
+	engine := newTestPoAEngine(t, signers)
+	headers := make(testHeaders)
+	genesis := sealPoABlock(t, engine, headers, nil)
+	parent := sealPoABlock(t, engine, headers, genesis)
+
+	//高度2轮到signers[2]
+	for _, c := range []struct {
+		name string
+		sign func(block *Block) error
+	}{
+		{"不是轮到的签名者", func(block *Block) error {
+			return signPoABlock(block, signers[0])
+		}},
+		{"不是授权签名者", func(block *Block) error {
+			return signPoABlock(block, outsider)
+		}},
+		{"签名无效", func(block *Block) error {
+			err := signPoABlock(block, signers[2])
+			block.Signature[10] ^= 1
+			return err
+		}},
+		{"签名后修改了区块头", func(block *Block) error {
+			err := signPoABlock(block, signers[2])
+			block.TimeStamp++
+			return err
+		}},
+		{"用其他签名者的私钥签名", func(block *Block) error {
+			err := signPoABlock(block, signers[0])
+			block.Signer = signers[2].Pubkey
+			return err
+		}},
+		{"没有签名", func(block *Block) error {
+			err := signPoABlock(block, signers[2])
+			block.Signature = nil
+			return err
+		}},
+		{"无效的投票", func(block *Block) error {
+			block.Vote = []byte{1, 2, 3}
+			return signPoABlock(block, signers[2])
+		}},
+	} {
+		block := newPoABlock(parent)
+		err := c.sign(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = engine.VerifySeal(headers, block)
+		if err == nil {
+			t.Errorf("%s：区块通过了校验", c.name)
+		}
+	}
+
+	block := newPoABlock(parent)
+	err := signPoABlock(block, signers[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = engine.VerifySeal(headers, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//签名者状态的缓存有上限，被删除的状态需要时重新计算
+func TestPoASnapshotCacheBounded(t *testing.T) {
+	chdirTemp(t)
+	engine := newTestPoAEngine(t, newPoAWallets(t, 1))
+	headers := make(testHeaders)
+	var chain []*Block
+	var parent *Block
+	for i := 0; i < 2*maxPoASnapshots+10; i++ {
+		parent = sealPoABlock(t, engine, headers, parent)
+		chain = append(chain, parent)
+		err := engine.VerifySeal(headers, parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(engine.snapshots) > maxPoASnapshots || len(engine.snapshots) != len(engine.order) {
+		t.Fatalf("缓存了%d个签名者状态，顺序记录%d个", len(engine.snapshots), len(engine.order))
+	}
+	if _, ok := engine.snapshots[string(chain[1].NowHash)]; ok {
+		t.Fatal("最早的签名者状态没有被删除")
+	}
+	err := engine.VerifySeal(headers, chain[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//初始签名者在创建区块链时写入数据库，修改poa.conf之后重新打开仍然使用创建时的签名者
+func TestPoASignersStored(t *testing.T) {
+	chdirTemp(t)
+	wallets := newPoAWallets(t, 3)
+	writeConfig := func(wallets []*Wallet) {
+		var lines []string
+		for _, wallet := range wallets {
+			lines = append(lines, fmt.Sprintf("authority %s", wallet.NewAddress()))
+		}
+		err := ioutil.WriteFile(poaConfigFile, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	open := func() *BlockChain {
+		engine, err := LoadConsensus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bc, err := NewBlockChain(engine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bc.db.NoSync = true
+		return bc
+	}
+
+	writeConfig(wallets[:2])
+	bc := open()
+	bc.Close()
+
+	writeConfig(wallets[2:])
+	bc = open()
+	defer bc.Close()
+	signers, err := bc.engine.(*PoAEngine).Signers(bc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 2 || signers[0] != wallets[0].NewAddress() || signers[1] != wallets[1].NewAddress() {
+		t.Fatalf("重新打开后的签名者为%v", signers)
+	}
+	err = bc.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,61 +1,136 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 //定义ProofOfWork
 type ProofOfWork struct {
 	block  *Block
 	target *big.Int
+	//nonce的最大值，用完之后修改时间戳，测试中调小以便覆盖整个nonce空间
+	maxNonce uint64
 }
 
+//挖矿被取消（ctx被取消，例如用户按下Ctrl-C）
+var ErrMiningCancelled = errors.New("挖矿已取消！")
+
 //创建pow的函数
 func newProofOfWork(block *Block) *ProofOfWork {
 	pow := ProofOfWork{
-		block: block,
+		block:    block,
+		maxNonce: math.MaxUint64,
 	}
-	//targetStr为指定的难度值
-	targetStr := "0000100000000000000000000000000000000000000000000000000000000000"
-	tmpInt := big.Int{}
-	tmpInt.SetString(targetStr, 16)
-	pow.target = &tmpInt
+	//难度值保存在区块中（紧凑格式）
+	pow.target = CompactToBig(blockBits(block))
 	return &pow
 }
 
 //提供计算不断计算hash,返回hash和nonce
-func (pow *ProofOfWork) run() ([]byte, uint64) {
-	//拼装数据（区块的数据，nonce）
-	var nonce uint64
-	var hash [32]byte
+//把nonce空间按GOMAXPROCS个协程交错切分，任何一个协程找到结果后所有协程停止
+//当前时间戳下nonce全部用完（0到maxNonce）仍然没有找到时，时间戳加1重新开始
+//ctx被取消时所有协程停止，返回ErrMiningCancelled
+func (pow *ProofOfWork) Mine(ctx context.Context) ([]byte, uint64, error) {
+	workers := runtime.GOMAXPROCS(0)
 	block := pow.block
+	start := time.Now()
+	var hashes uint64
 
 	for {
-		//拼装数据并hash
-		tmp := [][]byte{
-			uint64ToByte(block.Version),
-			block.PreHash,
-			block.MerKerTreeRoot,
-			uint64ToByte(nonce),
-			uint64ToByte(block.Difficulty),
-			uint64ToByte(block.TimeStamp),
-			//block.Data,
+		result, found := pow.search(ctx, workers, &hashes)
+		if found {
+			elapsed := time.Since(start)
+			fmt.Printf("挖矿成功，nonce：%d，用时：%v，算力：%.0f H/s（%d个协程）\n",
+				result.nonce, elapsed, float64(hashes)/elapsed.Seconds(), workers)
+			return result.hash, result.nonce, nil
 		}
-		blockInfo := bytes.Join(tmp, []byte{})
-		hash = sha256.Sum256(blockInfo)
-
-		//与pow中的target 比较
-		tmpInt := big.Int{}
-		tmpInt.SetBytes(hash[:])
-		if tmpInt.Cmp(pow.target) == -1 {
-			//tmpInt < pow.target //招到了
-			break
-		} else {
-			nonce++
+		if ctx.Err() != nil {
+			return nil, 0, ErrMiningCancelled
+		}
+		//nonce空间耗尽，修改区块头中的时间戳
+		block.TimeStamp++
+	}
+}
+
+//单个协程找到的结果
+type powResult struct {
+	hash  []byte
+	nonce uint64
+}
+
+//在当前区块头下用workers个协程搜索整个nonce空间，hashes累加计算过的hash次数
+func (pow *ProofOfWork) search(ctx context.Context, workers int, hashes *uint64) (powResult, bool) {
+	var stop int32
+	results := make(chan powResult, workers)
+	var wg sync.WaitGroup
+
+	//ctx取消时通知所有协程停止
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&stop, 1)
+		case <-finished:
 		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(first uint64) {
+			defer wg.Done()
+			step := uint64(workers)
+			//每个协程使用自己的区块头副本，只修改其中nonce的8个字节
+			data := pow.block.HeaderBytes(0)
+			offset := pow.block.NonceOffset()
+			var count uint64
+			defer func() { atomic.AddUint64(hashes, count) }()
+
+			tmpInt := big.Int{}
+			for nonce := first; nonce <= pow.maxNonce && atomic.LoadInt32(&stop) == 0; nonce += step {
+				binary.BigEndian.PutUint64(data[offset:], nonce)
+				hash := sha256.Sum256(data)
+				count++
+
+				//与pow中的target 比较
+				tmpInt.SetBytes(hash[:])
+				if tmpInt.Cmp(pow.target) == -1 {
+					//tmpInt < pow.target //招到了
+					if atomic.CompareAndSwapInt32(&stop, 0, 1) {
+						results <- powResult{hash[:], nonce}
+					}
+					return
+				}
+				//再加step就会超过maxNonce（或者溢出），这个协程负责的nonce已经用完
+				if pow.maxNonce-nonce < step {
+					return
+				}
+			}
+		}(uint64(i))
 	}
 
-	return hash[:], nonce
+	wg.Wait()
+	select {
+	case result := <-results:
+		return result, true
+	default:
+		return powResult{}, false
+	}
+}
+
+//校验区块哈希是否满足难度要求
+func (pow *ProofOfWork) IsValid(hash []byte) bool {
+	tmpInt := big.Int{}
+	tmpInt.SetBytes(hash)
+	return tmpInt.Cmp(pow.target) == -1
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"math/big"
+	"runtime"
+	"testing"
+)
+
+//区块头使用nonce时的哈希
+func powHash(block *Block, nonce uint64) *big.Int {
+	hash := sha256.Sum256(block.HeaderBytes(nonce))
+	return new(big.Int).SetBytes(hash[:])
+}
+
+//0到maxNonce中哈希最小的nonce
+func minHashNonce(block *Block, maxNonce uint64) (uint64, *big.Int) {
+	best, bestHash := uint64(0), powHash(block, 0)
+	for nonce := uint64(1); nonce <= maxNonce; nonce++ {
+		if hash := powHash(block, nonce); hash.Cmp(bestHash) < 0 {
+			best, bestHash = nonce, hash
+		}
+	}
+	return best, bestHash
+}
+
+//多个协程交错切分nonce空间：每个nonce只计算一次，并且都会被计算到
+func TestPowSearchCoversNonceSpace(t *testing.T) {
+	const maxNonce = 999
+	block := NewBlock(nil, []byte{}, 1, initialBits)
+	best, bestHash := minHashNonce(block, maxNonce)
+
+	for _, workers := range []int{1, 2, 3, 4, 7, maxNonce + 2} {
+		pow := newProofOfWork(block)
+		pow.maxNonce = maxNonce
+
+		//目标值为0时找不到，所有nonce都计算一遍
+		pow.target = big.NewInt(0)
+		var hashes uint64
+		_, found := pow.search(context.Background(), workers, &hashes)
+		if found {
+			t.Fatalf("%d个协程：目标值为0时找到了结果", workers)
+		}
+		if hashes != maxNonce+1 {
+			t.Fatalf("%d个协程：计算了%d次哈希，应为%d次", workers, hashes, maxNonce+1)
+		}
+
+		//只有哈希最小的nonce满足目标值，无论它由哪个协程负责都能找到
+		pow.target = new(big.Int).Add(bestHash, big.NewInt(1))
+		result, found := pow.search(context.Background(), workers, &hashes)
+		if !found || result.nonce != best {
+			t.Fatalf("%d个协程：找到的nonce为%d（%v），应为%d", workers, result.nonce, found, best)
+		}
+		if new(big.Int).SetBytes(result.hash).Cmp(bestHash) != 0 {
+			t.Fatalf("%d个协程：返回的哈希与nonce不符", workers)
+		}
+	}
+}
+
+//当前时间戳下nonce用完时时间戳加1继续挖矿，挖出的区块通过校验
+func TestPowMineRollsTimestamp(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	const maxNonce = 255
+	//每个nonce满足难度的概率为1/256
+	block := NewBlock(nil, []byte{}, 1, BigToCompact(new(big.Int).Lsh(big.NewInt(1), 248)))
+	target := CompactToBig(block.Difficulty)
+	//找一个时间戳T：T时没有任何nonce满足难度，T+1时有
+	for {
+		next := *block
+		next.TimeStamp++
+		_, hash := minHashNonce(block, maxNonce)
+		_, nextHash := minHashNonce(&next, maxNonce)
+		if hash.Cmp(target) >= 0 && nextHash.Cmp(target) < 0 {
+			break
+		}
+		block.TimeStamp++
+	}
+	timestamp := block.TimeStamp
+
+	pow := newProofOfWork(block)
+	pow.maxNonce = maxNonce
+	hash, nonce, err := pow.Mine(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.TimeStamp != timestamp+1 {
+		t.Fatalf("时间戳为%d，应为%d", block.TimeStamp, timestamp+1)
+	}
+	block.Nonce = nonce
+	block.NowHash = hash
+	if powHash(block, nonce).Cmp(new(big.Int).SetBytes(hash)) != 0 {
+		t.Fatal("返回的哈希与区块头不符")
+	}
+	err = NewPowEngine().VerifySeal(nil, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//多个协程挖矿，结果与区块头一致并且通过校验
+func TestPowSealParallel(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	engine := NewPowEngine()
+	for i := 0; i < 10; i++ {
+		//平均16次哈希就能找到
+		block := NewBlock(nil, []byte{}, uint64(i), BigToCompact(new(big.Int).Lsh(big.NewInt(1), 252)))
+		err := engine.Seal(context.Background(), nil, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if powHash(block, block.Nonce).Cmp(new(big.Int).SetBytes(block.NowHash)) != 0 {
+			t.Fatal("区块哈希与区块头不符")
+		}
+		err = engine.VerifySeal(nil, block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
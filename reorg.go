@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"math"
+	"math/big"
+)
+
+//分叉处理
+//收到的区块都保存在区块bucket中，不在主链上的区块就是侧链，高度索引、UTXO集合和交易索引只对应主链
+//每个区块记录从创世区块到它的累计工作量，累计工作量最大的分支就是主链，相同时保留先收到的分支
+//侧链的累计工作量超过主链时进行重组：
+//1.从主链尾部开始依次断开区块，直到分叉点：删除区块中交易的output，根据撤销记录恢复它们花费的output
+//2.从分叉点开始依次接入新分支的区块，与直接延长主链时的校验完全相同
+//3.断开的区块中的交易（铸币交易除外）放回交易池
+//整个过程在一个bolt事务中完成，新分支中任何一个区块校验失败都会整体回滚，失败的区块被标记为无效
+
+//每个区块（包括只有区块头的区块）的累计工作量，key是区块哈希，value是big.Int的字节
+const chainWorkBucket = "chainWorkBucket"
+
+//接入主链时校验失败的区块，key是区块哈希，以它为祖先的区块都不会再接受
+const invalidBlockBucket = "invalidBlockBucket"
+
+//区块已经保存过（主链或侧链）
+var ErrKnownBlock = errors.New("区块已经存在")
+
+//找不到区块的前一个区块，需要先获取它的祖先
+var ErrOrphanBlock = errors.New("找不到区块的前一个区块")
+
+//区块或者它的祖先校验失败
+var ErrInvalidBlock = errors.New("区块无效")
+
+//区块加入后主链的变化
+type ChainUpdate struct {
+	//从主链上断开的区块，从原来的尾部开始
+	Disconnected []*Block
+	//接入主链的区块，从分叉点之后开始，最后一个是新的尾部
+	Connected []*Block
+}
+
+//接入主链时校验失败，记录区块哈希用于标记无效
+type invalidBlockError struct {
+	hash []byte
+	err  error
+}
+
+func (e *invalidBlockError) Error() string {
+	return fmt.Sprintf("%v：%x：%v", ErrInvalidBlock, e.hash, e.err)
+}
+
+func (e *invalidBlockError) Is(target error) bool {
+	return target == ErrInvalidBlock
+}
+
+func (e *invalidBlockError) Unwrap() error {
+	return e.err
+}
+
+//包装写数据库之前的校验错误：区块本身的问题返回ErrInvalidBlock
+//时间戳超前（ErrFutureBlock）可能只是时钟不同步，数据库出错是本地的问题，都不认为区块无效
+func rejectBlockError(hash []byte, err error) error {
+	if errors.Is(err, ErrFutureBlock) || errors.Is(err, ErrDatabase) ||
+		errors.Is(err, ErrCorruptBlock) || errors.Is(err, ErrCorruptTx) {
+		return fmt.Errorf("%x：%w", hash, err)
+	}
+	return fmt.Errorf("%w：%x：%v", ErrInvalidBlock, hash, err)
+}
+
+//校验并保存一个区块，区块所在分支的累计工作量超过主链时切换主链
+//返回主链的变化，区块只保存在侧链上时Disconnected和Connected都为空
+//1.区块本身以及它与前一个区块的关系在写数据库之前校验，侧链上的区块也必须满足
+//2.交易只有在区块接入主链时才能校验（需要对应分支的UTXO集合）
+func (blockChain *BlockChain) AcceptBlock(block *Block) (*ChainUpdate, error) {
+	if len(block.PreHash) == 0 {
+		return nil, fmt.Errorf("%w：不接受新的创世区块", ErrInvalidBlock)
+	}
+	stored, invalid, err := blockChain.blockStatus(block.NowHash)
+	if err != nil {
+		return nil, err
+	}
+	if stored {
+		return nil, fmt.Errorf("%w：%x", ErrKnownBlock, block.NowHash)
+	}
+	if invalid {
+		return nil, fmt.Errorf("%w：%x之前已经校验失败", ErrInvalidBlock, block.NowHash)
+	}
+
+	parent, err := blockChain.GetBlockByHash(block.PreHash)
+	if errors.Is(err, ErrBlockNotFound) {
+		return nil, fmt.Errorf("%w：%x", ErrOrphanBlock, block.PreHash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, invalid, err = blockChain.blockStatus(parent.NowHash)
+	if err != nil {
+		return nil, err
+	}
+	if invalid {
+		err = blockChain.markInvalid(block.NowHash)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w：前一个区块%x无效", ErrInvalidBlock, parent.NowHash)
+	}
+	err = blockChain.checkBlockContext(blockChain, block, parent)
+	if err == nil {
+		err = ValidateBlock(blockChain, block)
+	}
+	if err != nil {
+		return nil, rejectBlockError(block.NowHash, err)
+	}
+	work := blockChain.engine.BlockWork(block)
+
+	//数据库中的主链和内存中的tail必须一起更新
+	blockChain.chainLock.Lock()
+	defer blockChain.chainLock.Unlock()
+
+	var update *ChainUpdate
+	err = blockChain.db.Update(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket([]byte(blockBucket))
+		if blocks.Get(block.NowHash) != nil {
+			return fmt.Errorf("%w：%x", ErrKnownBlock, block.NowHash)
+		}
+		parentWork, err := getChainWork(tx, block.PreHash)
+		if err != nil {
+			return err
+		}
+		total := new(big.Int).Add(parentWork, work)
+		err = blocks.Put(block.NowHash, block.Serialize())
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(chainWorkBucket)).Put(block.NowHash, total.Bytes())
+		if err != nil {
+			return err
+		}
+		//先同步了区块头时，区块体保存之后不再需要单独的区块头
+		err = tx.Bucket([]byte(headerBucket)).Delete(block.NowHash)
+		if err != nil {
+			return err
+		}
+
+		tipWork, err := getChainWork(tx, blocks.Get([]byte("LastHashKey")))
+		if err != nil {
+			return err
+		}
+		if total.Cmp(tipWork) <= 0 {
+			update = &ChainUpdate{}
+			return nil
+		}
+		update, err = reorganize(tx, block)
+		return err
+	})
+	if err != nil {
+		//数据库本身出错时不能认为区块无效
+		var invalidErr *invalidBlockError
+		if errors.As(err, &invalidErr) && !errors.Is(invalidErr.err, ErrDatabase) {
+			markErr := blockChain.markInvalid(invalidErr.hash)
+			if markErr != nil {
+				return nil, markErr
+			}
+		}
+		return nil, err
+	}
+
+	if len(update.Connected) > 0 {
+		tip := update.Connected[len(update.Connected)-1]
+		blockChain.tail = tip.NowHash
+		//通知正在进行的挖矿放弃，发生重组时所有的挖矿都已经过时
+		if len(update.Disconnected) > 0 {
+			blockChain.AbortMining(math.MaxUint64)
+		} else {
+			blockChain.AbortMining(tip.Height)
+		}
+	}
+	return update, nil
+}
+
+//区块是否已经保存，以及是否被标记为无效
+func (blockChain *BlockChain) blockStatus(hash []byte) (stored bool, invalid bool, err error) {
+	err = blockChain.db.View(func(tx *bolt.Tx) error {
+		stored = tx.Bucket([]byte(blockBucket)).Get(hash) != nil
+		invalid = tx.Bucket([]byte(invalidBlockBucket)).Get(hash) != nil
+		return nil
+	})
+	return stored, invalid, err
+}
+
+//把区块标记为无效
+func (blockChain *BlockChain) markInvalid(hash []byte) error {
+	return blockChain.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(invalidBlockBucket)).Put(hash, []byte{1})
+	})
+}
+
+//读取区块的累计工作量
+func getChainWork(tx *bolt.Tx, hash []byte) (*big.Int, error) {
+	bucket := tx.Bucket([]byte(chainWorkBucket))
+	if bucket == nil {
+		return nil, fmt.Errorf("%w：累计工作量bucket不存在", ErrDatabase)
+	}
+	data := bucket.Get(hash)
+	if data == nil {
+		return nil, fmt.Errorf("%w：没有区块%x的累计工作量", ErrDatabase, hash)
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+//为旧数据库计算主链上每个区块的累计工作量，旧数据库中只有主链
+func (blockChain *BlockChain) reindexChainWork() error {
+	err := blockChain.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(chainWorkBucket))
+		if err != nil {
+			return err
+		}
+		//高度索引的key是大端序，按key的顺序遍历就是从创世区块开始
+		total := new(big.Int)
+		c := tx.Bucket([]byte(heightBucket)).Cursor()
+		for k, hash := c.First(); k != nil; k, hash = c.Next() {
+			block, err := getBlock(tx, hash)
+			if err != nil {
+				return err
+			}
+			total.Add(total, blockChain.engine.BlockWork(block))
+			err = bucket.Put(hash, total.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("计算累计工作量失败：%w", err)
+	}
+	return nil
+}
+
+//把主链切换到以newTip结尾的分支，newTip已经保存在区块bucket中
+func reorganize(tx *bolt.Tx, newTip *Block) (*ChainUpdate, error) {
+	oldTip, err := getBlock(tx, tx.Bucket([]byte(blockBucket)).Get([]byte("LastHashKey")))
+	if err != nil {
+		return nil, err
+	}
+
+	//1.两个分支从尾部向前走，高的一方先走，直到走到同一个区块（分叉点）
+	update := &ChainUpdate{}
+	var connect []*Block
+	oldBranch, newBranch := oldTip, newTip
+	for !bytes.Equal(oldBranch.NowHash, newBranch.NowHash) {
+		if oldBranch.Height >= newBranch.Height {
+			update.Disconnected = append(update.Disconnected, oldBranch)
+			oldBranch, err = getBlock(tx, oldBranch.PreHash)
+		} else {
+			connect = append(connect, newBranch)
+			newBranch, err = getBlock(tx, newBranch.PreHash)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := len(connect) - 1; i >= 0; i-- {
+		update.Connected = append(update.Connected, connect[i])
+	}
+
+	//2.断开旧分支，从尾部开始
+	for _, block := range update.Disconnected {
+		err = disconnectBlock(tx, block)
+		if err != nil {
+			return nil, fmt.Errorf("断开区块%x失败：%w", block.NowHash, err)
+		}
+	}
+
+	//3.接入新分支，从分叉点之后开始
+	for _, block := range update.Connected {
+		err = connectBlock(tx, block)
+		if err != nil {
+			return nil, &invalidBlockError{block.NowHash, err}
+		}
+	}
+
+	//4.断开的交易放回交易池，加载交易池时会重新校验，已经在新分支中或者与新分支冲突的交易会被删除
+	pool := tx.Bucket([]byte(mempoolBucket))
+	for _, block := range update.Disconnected {
+		for _, transaction := range block.Transactions {
+			if transaction.IsCoinbase() {
+				continue
+			}
+			err = pool.Put(transaction.TXID, transaction.Serialize())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return update, nil
+}
+
+//把区块接入主链尾部：校验交易，更新UTXO集合、交易索引、高度索引以及LastHashKey
+//区块的前一个区块必须是当前主链的尾部
+func connectBlock(tx *bolt.Tx, block *Block) error {
+	blocks := tx.Bucket([]byte(blockBucket))
+	if !bytes.Equal(blocks.Get([]byte("LastHashKey")), block.PreHash) {
+		return errors.New("区块的前一个区块不是主链的尾部")
+	}
+
+	err := checkDuplicateTxs(tx, block)
+	if err != nil {
+		return err
+	}
+	err = verifyBlockSignatures(tx, block)
+	if err != nil {
+		return err
+	}
+	//UTXO集合校验金额、双花以及铸币交易成熟度
+	err = updateUTXOSet(tx, block)
+	if err != nil {
+		return err
+	}
+	err = updateTxIndex(tx, block)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte(heightBucket)).Put(uint64ToByte(block.Height), block.NowHash)
+	if err != nil {
+		return err
+	}
+	return blocks.Put([]byte("LastHashKey"), block.NowHash)
+}
+
+//校验区块中每个交易的签名，引用的交易在同一个区块前面的交易中或者主链上
+//迁移的旧区块中交易的签名无法校验，直接跳过
+func verifyBlockSignatures(tx *bolt.Tx, block *Block) error {
+	if isLegacyBlock(tx, block) {
+		return nil
+	}
+	pending := make(map[string]Transaction)
+	for i, transaction := range block.Transactions {
+		if !transaction.IsCoinbase() {
+			prevTXs := make(map[string]Transaction)
+			for _, input := range transaction.TXInputs {
+				prevTX, ok := pending[string(input.TXid)]
+				if !ok {
+					found, _, err := findTransaction(tx, input.TXid)
+					if err != nil {
+						return fmt.Errorf("第%d个交易找不到input引用的交易：%w", i, err)
+					}
+					prevTX = *found
+				}
+				prevTXs[string(input.TXid)] = prevTX
+			}
+			if !transaction.Verify(prevTXs) {
+				return fmt.Errorf("第%d个交易签名无效", i)
+			}
+		}
+		pending[string(transaction.TXID)] = *transaction
+	}
+	return nil
+}
+
+//断开主链尾部的区块：删除区块中交易的output，根据撤销记录恢复它们花费的output
+//同时删除交易索引、高度索引和撤销记录，LastHashKey指向前一个区块
+func disconnectBlock(tx *bolt.Tx, block *Block) error {
+	blocks := tx.Bucket([]byte(blockBucket))
+	if !bytes.Equal(blocks.Get([]byte("LastHashKey")), block.NowHash) {
+		return errors.New("只能断开主链尾部的区块")
+	}
+	if len(block.PreHash) == 0 {
+		return errors.New("不能断开创世区块")
+	}
+	utxos := tx.Bucket([]byte(utxoBucket))
+	if utxos == nil {
+		return fmt.Errorf("%w：UTXO bucket不存在，请先执行reindexUTXO", ErrDatabase)
+	}
+	index := tx.Bucket([]byte(txIndexBucket))
+
+	//1.删除区块中交易的output
+	//之后的区块都已经断开，这些output要么还在UTXO集合中，要么被同一个区块中的交易花费了
+	inBlock := make(map[string]bool)
+	for _, transaction := range block.Transactions {
+		inBlock[string(transaction.TXID)] = true
+		err := utxos.Delete(transaction.TXID)
+		if err != nil {
+			return err
+		}
+		if index != nil {
+			err = index.Delete(transaction.TXID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	//2.恢复区块花费的output，同一个区块中创建的output已经随着那个交易一起删除，不需要恢复
+	spentOutputs, found, err := getUndo(tx, block.NowHash)
+	if err != nil {
+		return err
+	}
+	if found {
+		for _, spent := range spentOutputs {
+			if inBlock[string(spent.TXid)] {
+				continue
+			}
+			err = putBackUTXO(tx, spent.TXid, spent.UTXO)
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Bucket([]byte(undoBucket)).Delete(block.NowHash)
+		if err != nil {
+			return err
+		}
+	} else {
+		//没有撤销记录的旧区块，在主链上查找被花费的交易
+		for _, transaction := range block.Transactions {
+			if transaction.IsCoinbase() {
+				continue
+			}
+			for _, input := range transaction.TXInputs {
+				if inBlock[string(input.TXid)] {
+					continue
+				}
+				err = restoreUTXO(tx, input)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	err = tx.Bucket([]byte(heightBucket)).Delete(uint64ToByte(block.Height))
+	if err != nil {
+		return err
+	}
+	return blocks.Put([]byte("LastHashKey"), block.PreHash)
+}
+
+//恢复被input花费的output：在主链上找到引用的交易以及它所在区块的高度，重新加入UTXO集合
+//只用于没有撤销记录的旧区块
+func restoreUTXO(tx *bolt.Tx, input TXInput) error {
+	prevTX, prevBlock, err := findTransaction(tx, input.TXid)
+	if err != nil {
+		return err
+	}
+	if input.Index < 0 || input.Index >= int64(len(prevTX.TXOutputs)) {
+		return fmt.Errorf("input引用的output不存在：%x[%d]", input.TXid, input.Index)
+	}
+	return putBackUTXO(tx, input.TXid, UTXO{input.Index, prevTX.TXOutputs[input.Index], prevBlock.Height, prevTX.IsCoinbase()})
+}
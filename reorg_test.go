@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+//侧链的累计工作量超过主链时切换主链：断开的交易回到交易池，UTXO集合与重建的结果相同
+func TestReorganize(t *testing.T) {
+	bc, miner := newTestChain(t)
+	pool, err := bc.LoadMempool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork := mineBlocks(t, bc, pool, miner, int(bc.subsidy.CoinbaseMaturity))
+	tx, err := NewTransaction(miner, miner, CoinUnit, 0, bc, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pool.Add(bc, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldTip := mineBlocks(t, bc, pool, miner, 1)
+
+	//第一个侧链区块与主链工作量相同，不切换
+	side1 := newTestBlock(t, fork, miner, "side1")
+	update, err := bc.AcceptBlock(side1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(update.Connected) != 0 || !bytes.Equal(bc.Tip(), oldTip.NowHash) {
+		t.Fatal("工作量相同时不应该切换主链")
+	}
+	side2 := newTestBlock(t, side1, miner, "side2")
+	update, err = bc.AcceptBlock(side2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(update.Disconnected) != 1 || !bytes.Equal(update.Disconnected[0].NowHash, oldTip.NowHash) {
+		t.Fatalf("断开了%d个区块，应该只断开原来的尾部", len(update.Disconnected))
+	}
+	if len(update.Connected) != 2 || !bytes.Equal(bc.Tip(), side2.NowHash) {
+		t.Fatalf("接入了%d个区块，应该接入两个侧链区块", len(update.Connected))
+	}
+	bestHeight, err := bc.BestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bestHeight != side2.Height {
+		t.Fatalf("重组之后的高度为%d，应该为%d", bestHeight, side2.Height)
+	}
+
+	//断开的交易回到交易池
+	pool, err = bc.LoadMempool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pool.Get(tx.TXID); !ok {
+		t.Fatal("断开的交易没有回到交易池")
+	}
+	if _, err = bc.FindTransactionByTXid(tx.TXID); !errors.Is(err, ErrTxNotFound) {
+		t.Fatalf("断开的交易仍然在交易索引中：%v", err)
+	}
+
+	live := readUTXOSet(t, bc)
+	_, err = bc.ReindexUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := readUTXOSet(t, bc)
+	if len(live) != len(rebuilt) {
+		t.Fatalf("重组之后UTXO集合有%d个交易，重建的有%d个", len(live), len(rebuilt))
+	}
+	for txid, data := range rebuilt {
+		if !bytes.Equal(live[txid], data) {
+			t.Errorf("交易%x的UTXO与重建的结果不同", txid)
+		}
+	}
+	err = bc.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//接入主链时校验失败的区块被标记为无效，主链保持不变，再次收到时直接拒绝
+func TestAcceptInvalidBlock(t *testing.T) {
+	bc, miner := newTestChain(t)
+	pool, err := bc.LoadMempool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip := mineBlocks(t, bc, pool, miner, 2)
+	before := readUTXOSet(t, bc)
+
+	//铸币交易的金额超过挖矿奖励，只有接入主链时才能发现
+	coinbase, err := NewCoinbaseTX(miner, "", tip.Height+1, defaultSubsidySchedule.Subsidy(tip.Height+1), 1000*CoinUnit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := NewBlock([]*Transaction{coinbase}, tip.NowHash, tip.Height+1, initialBits)
+	bad.NowHash = bad.CalcHash()
+	_, err = bc.AcceptBlock(bad)
+	if !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("铸币交易金额过大的区块应该返回ErrInvalidBlock：%v", err)
+	}
+	if !bytes.Equal(bc.Tip(), tip.NowHash) {
+		t.Fatal("无效区块改变了主链")
+	}
+	_, invalid, err := bc.blockStatus(bad.NowHash)
+	if err != nil || !invalid {
+		t.Fatalf("无效区块没有被标记：%v", err)
+	}
+	after := readUTXOSet(t, bc)
+	if len(after) != len(before) {
+		t.Fatal("无效区块修改了UTXO集合")
+	}
+
+	_, err = bc.AcceptBlock(bad)
+	if !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("再次收到无效区块应该返回ErrInvalidBlock：%v", err)
+	}
+}
+
+//时间戳超前太多的区块返回ErrFutureBlock，不认为区块无效，也不标记，之后还可以再次校验
+func TestAcceptFutureBlock(t *testing.T) {
+	bc, miner := newTestChain(t)
+	genesis, err := bc.GetBlockByHash(bc.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := newTestBlock(t, genesis, miner, "")
+	block.TimeStamp = uint64(time.Now().Unix()) + maxFutureBlockTime + 60
+	block.NowHash = block.CalcHash()
+
+	_, err = bc.AcceptBlock(block)
+	if !errors.Is(err, ErrFutureBlock) || errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("时间戳超前的区块返回%v", err)
+	}
+	if misbehaviorScore(err) != 0 {
+		t.Fatal("时间戳超前的区块计入了违规分数")
+	}
+	_, invalid, err := bc.blockStatus(block.NowHash)
+	if err != nil || invalid {
+		t.Fatalf("时间戳超前的区块被标记为无效：%v", err)
+	}
+	_, err = bc.AcceptHeaders([]*Block{block.Header()})
+	if !errors.Is(err, ErrFutureBlock) || errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("时间戳超前的区块头返回%v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//挖矿奖励（区块补贴）
+//与比特币一样，挖矿奖励每HalvingInterval个区块减半一次，减到0之后矿工只能领取手续费
+//铸币交易的output要经过CoinbaseMaturity个区块才能花费，与奖励计划一起配置和保存
+//奖励计划是共识规则的一部分，创建区块链时写入metaBucket，之后打开区块链时从数据库读取
+//创建区块链时工作目录中存在subsidy.conf则使用其中的参数，否则使用defaultSubsidySchedule
+//已经创建的区块链不再读取subsidy.conf，修改奖励计划需要重新创建区块链
+
+//奖励计划配置文件，每行一条配置，#开头为注释
+//	initialSubsidy AMOUNT   初始的挖矿奖励，单位为币，例如6.25
+//	halvingInterval N       每隔多少个区块奖励减半一次
+//	coinbaseMaturity N      铸币交易的output要经过多少个区块才能花费
+const subsidyConfigFile = "subsidy.conf"
+
+//奖励计划在metaBucket中的key，value为初始奖励、减半间隔和铸币交易成熟度（各8字节大端）
+//旧数据库中没有这个key，使用defaultSubsidySchedule；只有前两项时成熟度使用默认值
+const subsidyKey = "Subsidy"
+
+type SubsidySchedule struct {
+	//初始的挖矿奖励
+	InitialSubsidy Amount
+	//每隔多少个区块奖励减半一次
+	HalvingInterval uint64
+	//铸币交易的output要经过多少个区块才能花费（成熟度）
+	//区块链发生分叉时，铸币交易可能随着区块一起被丢弃，所以需要等待足够多的确认
+	CoinbaseMaturity uint64
+}
+
+//默认的奖励计划：初始6.25个币，每210000个区块减半，铸币交易经过100个区块成熟
+var defaultSubsidySchedule = SubsidySchedule{625000000, 210000, 100}
+
+//铸币交易成熟度的上限，成熟的高度不能溢出
+const maxCoinbaseMaturity = math.MaxUint32
+
+//检查参数：奖励和间隔都必须大于0，并且高度和发行总量不能溢出，成熟度可以为0
+//奖励最多减半63次，减到0的高度不超过 减半间隔*63
+//每个减半周期的发行量不超过上一个周期，总量小于 初始奖励*减半间隔*2
+func (s SubsidySchedule) check() error {
+	if s.InitialSubsidy <= 0 {
+		return fmt.Errorf("初始挖矿奖励必须大于0：%s", s.InitialSubsidy)
+	}
+	if s.HalvingInterval == 0 || s.HalvingInterval > math.MaxUint64/64 {
+		return fmt.Errorf("无效的减半间隔：%d", s.HalvingInterval)
+	}
+	if uint64(s.InitialSubsidy) > math.MaxInt64/2/s.HalvingInterval {
+		return fmt.Errorf("初始奖励%s与减半间隔%d的发行总量溢出", s.InitialSubsidy, s.HalvingInterval)
+	}
+	if s.CoinbaseMaturity > maxCoinbaseMaturity {
+		return fmt.Errorf("铸币交易成熟度%d超过上限%d", s.CoinbaseMaturity, uint64(maxCoinbaseMaturity))
+	}
+	return nil
+}
+
+//高度为height的区块的挖矿奖励
+func (s SubsidySchedule) Subsidy(height uint64) Amount {
+	halvings := height / s.HalvingInterval
+	//奖励不超过2^63，减半63次之后一定为0
+	if halvings >= 63 {
+		return 0
+	}
+	return s.InitialSubsidy >> halvings
+}
+
+//从创世区块到高度height（含）按奖励计划发行的币的总量
+//每个减半周期内奖励不变，按周期累加
+func (s SubsidySchedule) TotalSupply(height uint64) Amount {
+	var total Amount
+	for start := uint64(0); start <= height; start += s.HalvingInterval {
+		subsidy := s.Subsidy(start)
+		if subsidy == 0 {
+			break
+		}
+		end := start + s.HalvingInterval - 1
+		if end > height {
+			end = height
+		}
+		total += subsidy * Amount(end-start+1)
+	}
+	return total
+}
+
+//奖励减到0时按奖励计划发行的币的总量
+func (s SubsidySchedule) MaxSupply() Amount {
+	return s.TotalSupply(63*s.HalvingInterval - 1)
+}
+
+//读取奖励计划配置文件，没有配置的参数使用默认值
+func LoadSubsidySchedule(path string) (SubsidySchedule, error) {
+	schedule := defaultSubsidySchedule
+	file, err := os.Open(path)
+	if err != nil {
+		return schedule, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 2 && fields[0] == "initialSubsidy":
+			schedule.InitialSubsidy, err = ParseAmount(fields[1])
+			if err != nil {
+				return schedule, fmt.Errorf("%s第%d行：%v", path, lineNum, err)
+			}
+		case len(fields) == 2 && fields[0] == "halvingInterval":
+			schedule.HalvingInterval, err = strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return schedule, fmt.Errorf("%s第%d行：无效的减半间隔：%s", path, lineNum, fields[1])
+			}
+		case len(fields) == 2 && fields[0] == "coinbaseMaturity":
+			schedule.CoinbaseMaturity, err = strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return schedule, fmt.Errorf("%s第%d行：无效的铸币交易成熟度：%s", path, lineNum, fields[1])
+			}
+		default:
+			return schedule, fmt.Errorf("%s第%d行：无法识别的配置：%s", path, lineNum, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return schedule, err
+	}
+	err = schedule.check()
+	if err != nil {
+		return schedule, fmt.Errorf("%s：%v", path, err)
+	}
+	return schedule, nil
+}
+
+//创建区块链时使用的奖励计划：存在subsidy.conf时读取，否则使用默认值
+func newChainSubsidySchedule() (SubsidySchedule, error) {
+	_, err := os.Stat(subsidyConfigFile)
+	if os.IsNotExist(err) {
+		return defaultSubsidySchedule, nil
+	}
+	return LoadSubsidySchedule(subsidyConfigFile)
+}
+
+//编码后写入metaBucket
+func (s SubsidySchedule) Serialize() []byte {
+	data := append(uint64ToByte(uint64(s.InitialSubsidy)), uint64ToByte(s.HalvingInterval)...)
+	return append(data, uint64ToByte(s.CoinbaseMaturity)...)
+}
+
+//在bolt事务中读取区块链的奖励计划，旧数据库中没有记录时使用默认值
+func getSubsidySchedule(tx *bolt.Tx) (SubsidySchedule, error) {
+	meta := tx.Bucket([]byte(metaBucket))
+	if meta == nil {
+		return defaultSubsidySchedule, nil
+	}
+	data := meta.Get([]byte(subsidyKey))
+	if data == nil {
+		return defaultSubsidySchedule, nil
+	}
+	if len(data) != 16 && len(data) != 24 {
+		return SubsidySchedule{}, fmt.Errorf("%w：奖励计划的长度不正确：%d", ErrDatabase, len(data))
+	}
+	schedule := SubsidySchedule{Amount(binary.BigEndian.Uint64(data[:8])), binary.BigEndian.Uint64(data[8:16]), defaultSubsidySchedule.CoinbaseMaturity}
+	if len(data) == 24 {
+		schedule.CoinbaseMaturity = binary.BigEndian.Uint64(data[16:])
+	}
+	err := schedule.check()
+	if err != nil {
+		return SubsidySchedule{}, fmt.Errorf("%w：%v", ErrDatabase, err)
+	}
+	return schedule, nil
+}
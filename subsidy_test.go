@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestSubsidySchedule(t *testing.T) {
+	s := SubsidySchedule{100, 10, 0}
+	for _, c := range []struct {
+		height uint64
+		want   Amount
+	}{{0, 100}, {9, 100}, {10, 50}, {29, 25}, {30, 12}, {10 * 63, 0}} {
+		if got := s.Subsidy(c.height); got != c.want {
+			t.Errorf("Subsidy(%d) = %d, want %d", c.height, got, c.want)
+		}
+	}
+	//0到9每块100，10到11每块50
+	if got := s.TotalSupply(11); got != 1100 {
+		t.Errorf("TotalSupply(11) = %d, want 1100", got)
+	}
+	//100 50 25 12 6 3 1 之后为0
+	if got := s.MaxSupply(); got != 1970 {
+		t.Errorf("MaxSupply() = %d, want 1970", got)
+	}
+	if got := defaultSubsidySchedule.MaxSupply(); got >= 2*defaultSubsidySchedule.InitialSubsidy*Amount(defaultSubsidySchedule.HalvingInterval) {
+		t.Errorf("默认奖励计划的发行总量%s超过上限", got)
+	}
+}
+
+func TestLoadSubsidySchedule(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := dir + "/" + subsidyConfigFile
+		err := ioutil.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	s, err := LoadSubsidySchedule(write("# 测试\ninitialSubsidy 50\nhalvingInterval 100\ncoinbaseMaturity 0\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.InitialSubsidy != 50*CoinUnit || s.HalvingInterval != 100 || s.CoinbaseMaturity != 0 {
+		t.Fatalf("读取的奖励计划为%+v", s)
+	}
+
+	//没有配置的参数使用默认值
+	s, err = LoadSubsidySchedule(write("halvingInterval 5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.InitialSubsidy != defaultSubsidySchedule.InitialSubsidy || s.HalvingInterval != 5 || s.CoinbaseMaturity != defaultSubsidySchedule.CoinbaseMaturity {
+		t.Fatalf("读取的奖励计划为%+v", s)
+	}
+
+	for _, content := range []string{
+		"halvingInterval 0\n",
+		"initialSubsidy 0\n",
+		"initialSubsidy -1\n",
+		"halvingInterval abc\n",
+		"initialSubsidy 90000000000 \nhalvingInterval 210000\n",
+		"blockReward 50\n",
+		"coinbaseMaturity -1\n",
+		"coinbaseMaturity 5000000000\n",
+	} {
+		_, err = LoadSubsidySchedule(write(content))
+		if err == nil {
+			t.Errorf("配置%q没有返回错误", content)
+		}
+	}
+}
+
+//创建区块链时读取subsidy.conf并写入数据库，挖矿和校验都使用这个奖励计划
+func TestChainSubsidySchedule(t *testing.T) {
+	chdirTemp(t)
+	err := ioutil.WriteFile(subsidyConfigFile, []byte("initialSubsidy 8\nhalvingInterval 3\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := openTestChain(t)
+	want := SubsidySchedule{8 * CoinUnit, 3, defaultSubsidySchedule.CoinbaseMaturity}
+	if bc.subsidy != want {
+		t.Fatalf("区块链的奖励计划为%+v，应为%+v", bc.subsidy, want)
+	}
+	ws, err := NewWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	miner := ws.ListAddresses()[0]
+
+	pool, err := bc.LoadMempool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip := mineBlocks(t, bc, pool, miner, 4)
+	if got := tip.Transactions[0].TXOutputs[0].Value; got != 4*CoinUnit {
+		t.Fatalf("高度4的挖矿奖励为%s，应为%s", got, Amount(4*CoinUnit))
+	}
+	issued, err := bc.IssuedSupply()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issued != want.TotalSupply(4) {
+		t.Fatalf("已发行总量为%s，应为%s", issued, want.TotalSupply(4))
+	}
+	err = bc.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//按默认奖励计划领取的铸币交易超过了这条链的奖励
+	block := newTestBlock(t, tip, miner, "")
+	_, err = bc.AcceptBlock(block)
+	if err == nil {
+		t.Fatal("超过奖励计划的铸币交易被接受")
+	}
+
+	//重新打开时从数据库读取，不再读取配置文件
+	bc.Close()
+	err = ioutil.WriteFile(subsidyConfigFile, []byte("initialSubsidy 1\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc = openTestChain(t)
+	if bc.subsidy != want {
+		t.Fatalf("重新打开后的奖励计划为%+v，应为%+v", bc.subsidy, want)
+	}
+}
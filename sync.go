@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//headers-first同步
+//直接按inv逐个下载整个区块时，只能按顺序从一个节点下载，而且在校验之前对方可以发送任意多的无效区块
+//所以先同步区块头，再并行下载区块体：
+//1.向一个节点（区块头同步节点）发送getheaders，对方回复主链上分叉点之后最多maxHeadersPerMsg个区块头，满了继续请求
+//2.区块头校验工作量证明（或poa签名）、前区块哈希、高度、时间戳和难度之后保存（见header.go）
+//3.区块头所在分支的累计工作量超过本地主链时，下载这个分支上还没有的区块体：
+//  同时向多个节点请求，每个节点最多maxBlocksInFlight个，超时没有收到的重新分配给其他节点
+//4.收到的区块必须与已经校验过的区块头完全相同，并且重新计算的默克尔树根与区块头中的相同，否则断开这个节点
+//5.区块按高度顺序由AcceptBlock校验交易并加入区块链，定期打印同步进度
+
+//每个节点同时下载的最多区块个数
+const maxBlocksInFlight = 16
+
+//只从待下载区块的前面这么多个中分配，防止等待接入的区块在内存中堆积太多
+const downloadWindow = 1024
+
+//请求的区块超过这个时间没有收到时，重新分配给其他节点
+const blockDownloadTimeout = 30 * time.Second
+
+//请求的区块头超过这个时间没有收到时，换一个节点同步区块头
+const headersTimeout = 60 * time.Second
+
+//打印同步进度的最小间隔
+const progressInterval = 2 * time.Second
+
+//正在下载的一个区块
+type blockRequest struct {
+	peer *Peer
+	time time.Time
+}
+
+//已经下载的一个区块，区块无效时记录发送者的违规
+type receivedBlock struct {
+	block *Block
+	peer  *Peer
+}
+
+type blockSync struct {
+	node *Node
+
+	lock sync.Mutex
+	//正在同步区块头的节点，以及最近一次请求的时间
+	headerPeer *Peer
+	headerTime time.Time
+	//需要下载区块体的区块头，从低到高排序，接入主链之后从头部删除
+	pending []*Block
+	//pending中的区块头，key为区块哈希
+	pendingSet map[string]*Block
+	//正在下载的区块
+	inFlight map[string]*blockRequest
+	//已经下载、等待前面的区块接入主链的区块
+	received map[string]*receivedBlock
+
+	//是否正在进行一轮同步：从发现更重的区块头分支开始，到区块全部接入并且区块头同步结束
+	syncing bool
+	//本轮同步开始的时间和高度，以及上次打印进度的时间
+	startTime   time.Time
+	startHeight uint64
+	lastReport  time.Time
+}
+
+func newBlockSync(node *Node) *blockSync {
+	return &blockSync{
+		node:       node,
+		pendingSet: make(map[string]*Block),
+		inFlight:   make(map[string]*blockRequest),
+		received:   make(map[string]*receivedBlock),
+	}
+}
+
+//没有正在同步区块头时，开始从peer同步
+func (s *blockSync) start(peer *Peer) error {
+	s.lock.Lock()
+	if s.headerPeer != nil {
+		s.lock.Unlock()
+		return nil
+	}
+	s.headerPeer = peer
+	s.headerTime = time.Now()
+	s.lock.Unlock()
+
+	locator, err := s.node.bc.BlockLocator()
+	if err != nil {
+		fmt.Printf("生成区块定位器失败：%v\n", err)
+		s.stopHeaders(peer)
+		return nil
+	}
+	return peer.send(cmdGetHeaders, &getHeadersMsg{Locator: locator})
+}
+
+//peer的区块头同步结束（完成、出错或者断开）
+func (s *blockSync) stopHeaders(peer *Peer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.headerPeer == peer {
+		s.headerPeer = nil
+	}
+}
+
+//区块是否在待下载的分支上
+func (s *blockSync) isPending(hash []byte) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.pendingSet[string(hash)]
+	return ok
+}
+
+//处理headers消息，返回错误表示对方发送了无效的区块头
+func (s *blockSync) handleHeaders(peer *Peer, headers []*Block) error {
+	s.lock.Lock()
+	requested := s.headerPeer == peer
+	s.lock.Unlock()
+	if !requested {
+		return nil
+	}
+	if len(headers) == 0 {
+		s.stopHeaders(peer)
+		s.maybeFinish()
+		return nil
+	}
+
+	//最后一个区块头已经有了说明整组都已经有了（例如区块定位器的间隔较大），不再打印
+	last := headers[len(headers)-1]
+	_, err := s.node.bc.GetHeader(last.NowHash)
+	known := err == nil
+	total, err := s.node.bc.AcceptHeaders(headers)
+	if errors.Is(err, ErrInvalidBlock) || errors.Is(err, ErrOrphanBlock) {
+		s.stopHeaders(peer)
+		return fmt.Errorf("区块头无效：%w", err)
+	}
+	if err != nil {
+		fmt.Printf("保存区块头失败：%v\n", err)
+		s.stopHeaders(peer)
+		return nil
+	}
+	peer.updateHeight(last.Height)
+	if !known {
+		fmt.Printf("已校验%s发送的区块头，高度%d到%d\n", peer, headers[0].Height, last.Height)
+	}
+
+	//区块头分支比主链重时才下载区块体，与AcceptBlock一样，工作量相同时保留主链
+	tipWork, err := s.node.bc.ChainWork(s.node.bc.Tip())
+	if err != nil {
+		fmt.Printf("读取主链的累计工作量失败：%v\n", err)
+		s.stopHeaders(peer)
+		return nil
+	}
+	if total.Cmp(tipWork) > 0 {
+		missing, err := s.node.bc.MissingBodies(last.NowHash)
+		if err != nil {
+			fmt.Printf("查找需要下载的区块失败：%v\n", err)
+		} else {
+			s.setPending(missing)
+		}
+	}
+
+	if len(headers) == maxHeadersPerMsg {
+		s.lock.Lock()
+		s.headerTime = time.Now()
+		s.lock.Unlock()
+		err = peer.send(cmdGetHeaders, &getHeadersMsg{Locator: [][]byte{last.NowHash}})
+		if err != nil {
+			return err
+		}
+	} else {
+		s.stopHeaders(peer)
+		s.maybeFinish()
+	}
+	s.assign()
+	return nil
+}
+
+//设置需要下载区块体的分支，已经下载的区块如果还在新分支上就保留
+func (s *blockSync) setPending(headers []*Block) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.syncing && len(headers) > 0 {
+		s.syncing = true
+		s.startTime = time.Now()
+		s.startHeight = headers[0].Height - 1
+		s.lastReport = time.Now()
+	}
+	s.pending = headers
+	s.pendingSet = make(map[string]*Block)
+	for _, header := range headers {
+		s.pendingSet[string(header.NowHash)] = header
+	}
+	for hash := range s.received {
+		if _, ok := s.pendingSet[hash]; !ok {
+			delete(s.received, hash)
+		}
+	}
+	for hash := range s.inFlight {
+		if _, ok := s.pendingSet[hash]; !ok {
+			delete(s.inFlight, hash)
+		}
+	}
+}
+
+//把待下载的区块分配给完成握手的节点，每次分给正在下载最少的节点
+//只分配给高度不低于区块高度的节点
+func (s *blockSync) assign() {
+	peers := s.node.peers.ready()
+	requests := make(map[*Peer][][]byte)
+
+	s.lock.Lock()
+	counts := make(map[*Peer]int)
+	for _, request := range s.inFlight {
+		counts[request.peer]++
+	}
+	heights := make(map[*Peer]uint64)
+	for _, peer := range peers {
+		heights[peer] = peer.height()
+	}
+	end := len(s.pending)
+	if end > downloadWindow {
+		end = downloadWindow
+	}
+	for _, header := range s.pending[:end] {
+		key := string(header.NowHash)
+		if s.received[key] != nil || s.inFlight[key] != nil {
+			continue
+		}
+		var best *Peer
+		for _, peer := range peers {
+			if counts[peer] >= maxBlocksInFlight || heights[peer] < header.Height {
+				continue
+			}
+			if best == nil || counts[peer] < counts[best] {
+				best = peer
+			}
+		}
+		if best == nil {
+			continue
+		}
+		counts[best]++
+		s.inFlight[key] = &blockRequest{best, time.Now()}
+		requests[best] = append(requests[best], header.NowHash)
+	}
+	s.lock.Unlock()
+
+	for peer, hashes := range requests {
+		err := peer.send(cmdGetData, &invMsg{invTypeBlock, hashes})
+		if err != nil {
+			fmt.Printf("向%s请求区块失败：%v\n", peer, err)
+		}
+	}
+}
+
+//处理收到的区块，不是同步中的区块时handled为false，由调用方按普通区块处理
+//返回错误表示对方发送的区块与区块头不符
+func (s *blockSync) handleBlock(peer *Peer, block *Block) (handled bool, err error) {
+	s.lock.Lock()
+	key := string(block.NowHash)
+	header, ok := s.pendingSet[key]
+	if !ok {
+		s.lock.Unlock()
+		return false, nil
+	}
+	delete(s.inFlight, key)
+	if !bytes.Equal(block.Header().Serialize(), header.Serialize()) ||
+		!bytes.Equal(block.MakeMerkelTreeRoot(), header.MerKerTreeRoot) {
+		s.lock.Unlock()
+		s.assign()
+		return true, fmt.Errorf("%w：区块%x与已经校验的区块头不符", ErrInvalidBlock, block.NowHash)
+	}
+	s.received[key] = &receivedBlock{block, peer}
+	s.connectReceived()
+	s.lock.Unlock()
+
+	s.maybeFinish()
+	s.assign()
+	return true, nil
+}
+
+//按高度顺序把已经下载的区块加入区块链，调用时必须持有锁
+func (s *blockSync) connectReceived() {
+	for len(s.pending) > 0 {
+		key := string(s.pending[0].NowHash)
+		received := s.received[key]
+		if received == nil {
+			break
+		}
+		block := received.block
+		s.pending = s.pending[1:]
+		delete(s.pendingSet, key)
+		delete(s.received, key)
+
+		update, err := s.node.bc.AcceptBlock(block)
+		if errors.Is(err, ErrKnownBlock) {
+			continue
+		}
+		if err != nil {
+			//区块与区块头一致但是交易无效，整个分支都不能再用
+			fmt.Printf("同步的区块%d无效，放弃这个分支：%v\n", block.Height, err)
+			s.node.peers.misbehave(received.peer, err)
+			s.pending = nil
+			s.pendingSet = make(map[string]*Block)
+			s.received = make(map[string]*receivedBlock)
+			s.inFlight = make(map[string]*blockRequest)
+			s.syncing = false
+			return
+		}
+		if len(update.Disconnected) > 0 {
+			fmt.Printf("主链发生重组，断开%d个区块，接入%d个区块\n", len(update.Disconnected), len(update.Connected))
+		}
+		if len(update.Connected) > 0 {
+			//区块已经上链，交易池更新失败时只是留下一些已经失效的交易，下次加载时会被清理
+			err = s.node.pool.Reorganize(s.node.bc, update)
+			if err != nil {
+				fmt.Printf("更新交易池失败：%v\n", err)
+			}
+		}
+	}
+	if len(s.pending) > 0 && time.Since(s.lastReport) >= progressInterval {
+		s.lastReport = time.Now()
+		s.reportProgress()
+	}
+}
+
+//打印同步进度，调用时必须持有锁
+func (s *blockSync) reportProgress() {
+	bestHeight, err := s.node.bc.BestHeight()
+	if err != nil {
+		return
+	}
+	target := s.pending[len(s.pending)-1].Height
+	percent := 100.0
+	if target > s.startHeight && bestHeight >= s.startHeight {
+		percent = float64(bestHeight-s.startHeight) * 100 / float64(target-s.startHeight)
+	}
+	peers := make(map[*Peer]bool)
+	for _, request := range s.inFlight {
+		peers[request.peer] = true
+	}
+	fmt.Printf("同步进度：高度%d/%d（%.1f%%），正在从%d个节点下载%d个区块\n", bestHeight, target, percent, len(peers), len(s.inFlight))
+}
+
+//区块全部接入并且区块头同步结束时，这一轮同步完成：通告新的主链尾部，通知挖矿
+func (s *blockSync) maybeFinish() {
+	s.lock.Lock()
+	done := s.syncing && len(s.pending) == 0 && s.headerPeer == nil
+	if done {
+		s.syncing = false
+	}
+	elapsed := time.Since(s.startTime).Round(time.Millisecond)
+	s.lock.Unlock()
+	if !done {
+		return
+	}
+	bestHeight, err := s.node.bc.BestHeight()
+	if err != nil {
+		return
+	}
+	fmt.Printf("同步完成，当前高度%d，用时%s\n", bestHeight, elapsed)
+	s.node.broadcastInv(nil, invTypeBlock, [][]byte{s.node.bc.Tip()})
+	s.node.signalMiner()
+}
+
+//节点断开时，它正在下载的区块重新分配，正在同步区块头时换一个节点
+func (s *blockSync) removePeer(peer *Peer) {
+	s.lock.Lock()
+	for hash, request := range s.inFlight {
+		if request.peer == peer {
+			delete(s.inFlight, hash)
+		}
+	}
+	s.lock.Unlock()
+	s.stopHeaders(peer)
+	s.restartHeaders(peer)
+	s.maybeFinish()
+	s.assign()
+}
+
+//定期检查超时的请求
+func (s *blockSync) checkTimeouts() {
+	now := time.Now()
+	s.lock.Lock()
+	for hash, request := range s.inFlight {
+		if now.Sub(request.time) > blockDownloadTimeout {
+			fmt.Printf("从%s下载区块%x超时\n", request.peer, hash)
+			delete(s.inFlight, hash)
+		}
+	}
+	stale := s.headerPeer
+	if stale != nil && now.Sub(s.headerTime) > headersTimeout {
+		fmt.Printf("从%s同步区块头超时\n", stale)
+		s.headerPeer = nil
+	} else {
+		stale = nil
+	}
+	s.lock.Unlock()
+
+	if stale != nil {
+		s.restartHeaders(stale)
+		s.maybeFinish()
+	}
+	s.assign()
+}
+
+//没有正在同步区块头时，从除了except之外高度最高的节点重新开始
+//只在对方比自己高的时候同步，相同高度上的分叉由新区块的通告处理
+func (s *blockSync) restartHeaders(except *Peer) {
+	bestHeight, err := s.node.bc.BestHeight()
+	if err != nil {
+		return
+	}
+	var best *Peer
+	for _, peer := range s.node.peers.ready() {
+		if peer != except && peer.height() > bestHeight && (best == nil || peer.height() > best.height()) {
+			best = peer
+		}
+	}
+	if best == nil {
+		return
+	}
+	err = s.start(best)
+	if err != nil {
+		fmt.Printf("向%s请求区块头失败：%v\n", best, err)
+	}
+}
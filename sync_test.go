@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+//对方一端收到的一个消息
+type testMessage struct {
+	command string
+	data    []byte
+}
+
+//在后台读取对方一端收到的消息，连接关闭时关闭返回的channel
+func readTestMessages(remote io.Reader) <-chan testMessage {
+	messages := make(chan testMessage, 16)
+	go func() {
+		defer close(messages)
+		for {
+			command, data, err := readMessage(remote)
+			if err != nil {
+				return
+			}
+			messages <- testMessage{command, data}
+		}
+	}()
+	return messages
+}
+
+//等待对方收到command消息，跳过其他消息
+func waitMessage(t *testing.T, messages <-chan testMessage, command string) []byte {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				t.Fatalf("等待%s消息时连接被关闭", command)
+			}
+			if msg.command == command {
+				return msg.data
+			}
+		case <-timeout:
+			t.Fatalf("等待%s消息超时", command)
+		}
+	}
+}
+
+//区块头分支不比主链重时不下载区块体；更重时按高度顺序请求这个分支的区块，
+//与区块头不符的区块被拒绝，全部收到之后切换到这个分支
+func TestSyncFollowsBestHeaders(t *testing.T) {
+	bc, miner := newTestChain(t)
+	node := newTestNode(t, bc, 3000)
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, node.pool, miner, 2)
+	fork := newTestBranch(t, genesis, miner, "fork", 3)
+
+	peer, remote := newTestPeer(t, "127.0.0.1:40001", "127.0.0.1", false)
+	peer.version = &versionMsg{protocolVersion, 1, node.genesis, bc.engine.Name(), 0, 3001}
+	peer.verack = true
+	err = node.peers.add(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := readTestMessages(remote)
+	receiveHeaders := func(headers []*Block) {
+		t.Helper()
+		node.sync.headerPeer = peer
+		err := node.sync.handleHeaders(peer, headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//分叉的前两个区块与主链工作量相同，保留主链
+	receiveHeaders(headersOf(fork[:2]))
+	if len(node.sync.pending) != 0 || len(node.sync.inFlight) != 0 {
+		t.Fatalf("工作量相同的分支需要下载%d个区块", len(node.sync.pending))
+	}
+
+	receiveHeaders(headersOf(fork[2:]))
+	data := waitMessage(t, messages, cmdGetData)
+	var request invMsg
+	err = decodePayload(data, &request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Type != invTypeBlock || len(request.Hashes) != len(fork) {
+		t.Fatalf("请求了%d个类型为%d的数据，应为%d个区块", len(request.Hashes), request.Type, len(fork))
+	}
+	for i, hash := range request.Hashes {
+		if !bytes.Equal(hash, fork[i].NowHash) {
+			t.Fatalf("请求的第%d个区块不是分叉上高度%d的区块", i, fork[i].Height)
+		}
+	}
+
+	//区块头相同但是交易不同的区块
+	other := newTestBlock(t, genesis, miner, "other")
+	tampered := *fork[0]
+	tampered.Transactions = other.Transactions
+	handled, err := node.sync.handleBlock(peer, &tampered)
+	if !handled || !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("与区块头不符的区块返回%v，%v", handled, err)
+	}
+	//不在待下载分支上的区块由调用方按普通区块处理
+	handled, err = node.sync.handleBlock(peer, other)
+	if handled || err != nil {
+		t.Fatalf("不在分支上的区块返回%v，%v", handled, err)
+	}
+
+	for _, block := range fork {
+		handled, err = node.sync.handleBlock(peer, block)
+		if !handled || err != nil {
+			t.Fatalf("高度%d的区块返回%v，%v", block.Height, handled, err)
+		}
+	}
+	if !bytes.Equal(bc.Tip(), fork[2].NowHash) {
+		t.Fatal("收到全部区块之后没有切换到更重的分支")
+	}
+	//同步完成后通告新的主链尾部
+	data = waitMessage(t, messages, cmdInv)
+	var inv invMsg
+	err = decodePayload(data, &inv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.Type != invTypeBlock || len(inv.Hashes) != 1 || !bytes.Equal(inv.Hashes[0], fork[2].NowHash) {
+		t.Fatal("同步完成后没有通告新的主链尾部")
+	}
+}
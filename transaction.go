@@ -6,14 +6,13 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 )
 
-const reward = 6.25
-
 //1.定义交易结构
 type Transaction struct {
 	TXID      []byte     //交易ID
@@ -32,39 +31,74 @@ type TXInput struct {
 
 //定义交易输出
 type TXOutput struct {
-	Value float64 //转账金额
+	Value Amount //转账金额，以最小单位表示
 	//PubKeyHash string  //锁定脚本，我们用地址模拟（对方的公钥hash）
 	PubKeyHash []byte //收款方的公钥的哈希
 }
 
 //由于现在存储的字段是地址的公钥哈希，所以无法直接创建TXOutput
 //为了能够得到公钥哈希，我们需要处理一下，写一个Lock函数
-func (output *TXOutput) Lock(address string) {
-	pubKeyHash := GetPubKeyFromAddress(address)
+func (output *TXOutput) Lock(address string) error {
+	pubKeyHash, err := GetPubKeyFromAddress(address)
+	if err != nil {
+		return err
+	}
 	//真正的锁定动作
 	output.PubKeyHash = pubKeyHash
+	return nil
 }
 
 //给TXOutput提供一个创建的方法，否则无法调用Lock
-func NewTXOutput(value float64, address string) *TXOutput {
+func NewTXOutput(value Amount, address string) (*TXOutput, error) {
 	output := TXOutput{
 		Value: value,
 	}
-	output.Lock(address)
-	return &output
+	err := output.Lock(address)
+	if err != nil {
+		return nil, err
+	}
+	return &output, nil
 }
 
 //设置交易ID(对tx先编码再hash)
 func (tx *Transaction) SetHash() {
+	hash := sha256.Sum256(tx.Serialize())
+	tx.TXID = hash[:]
+}
+
+//编码(序列化)交易，格式见encoding.go
+func (tx *Transaction) Serialize() []byte {
 	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-	err := encoder.Encode(tx)
+	err := tx.Encode(&buffer)
 	if err != nil {
-		log.Panic("编码出错！")
+		log.Panic("编码出错！", err)
 	}
-	data := buffer.Bytes()
-	hash := sha256.Sum256(data)
-	tx.TXID = hash[:]
+	return buffer.Bytes()
+}
+
+//解码(反序列化)交易，数据损坏时返回ErrCorruptTx
+func DeserializeTransaction(data []byte) (Transaction, error) {
+	var tx Transaction
+	reader := bytes.NewReader(data)
+	err := tx.Decode(reader)
+	if err == nil && reader.Len() != 0 {
+		err = errors.New("编码后面有多余的数据")
+	}
+	if err != nil {
+		return Transaction{}, fmt.Errorf("%w：%v", ErrCorruptTx, err)
+	}
+	return tx, nil
+}
+
+//重新计算交易ID，用于校验存储的交易没有被篡改
+//交易ID是在签名之前、TXID为空时计算的，所以这里要去掉签名和TXID
+func (tx *Transaction) Hash() []byte {
+	txCopy := Transaction{[]byte{}, nil, tx.TXOutputs}
+	for _, input := range tx.TXInputs {
+		txCopy.TXInputs = append(txCopy.TXInputs, TXInput{input.TXid, input.Index, nil, input.PubKey})
+	}
+	txCopy.SetHash()
+	return txCopy.TXID
 }
 
 //实现一个函数，判断当前的交易是否为挖矿交易
@@ -81,21 +115,55 @@ func (tx *Transaction) IsCoinbase() bool {
 	return false
 }
 
+//铸币交易input的PubKey字段开头是8字节的区块高度和8字节的额外随机数，后面才是矿工填写的数据
+//这样同一个矿工在不同高度（或者同一高度的不同分叉上）挖出的铸币交易ID都不相同
+const coinbasePrefixLen = 16
+
 //2.提供创建交易的方法（铸币交易）
-func NewCoinbaseTX(address string, data string) *Transaction {
+//subsidy是区块高度height按奖励计划对应的挖矿奖励，fees是区块中其他交易的手续费总额，矿工可以连同挖矿奖励一起领取
+func NewCoinbaseTX(address string, data string, height uint64, subsidy, fees Amount) (*Transaction, error) {
 	//铸币交易的特点
 	//1.只有一个input
 	//2.无需引用交易id
 	//3.无需引用index
 	//矿工由于挖矿时无需指定签名，所以这个PubKey字段可以由矿工自由填写数据，一般填写矿池名字
 	//签名先填写为空，后面创建完整交易后，最后做一次签名即可
-	input := TXInput{[]byte{}, -1, nil, []byte(data)}
+	//数据前面加上区块高度和额外随机数
+	extraNonce := make([]byte, 8)
+	_, err := rand.Read(extraNonce)
+	if err != nil {
+		return nil, err
+	}
+	script := append(uint64ToByte(height), extraNonce...)
+	script = append(script, []byte(data)...)
+	input := TXInput{[]byte{}, -1, nil, script}
 	//output := TXOutput{reward, address}
-	output := NewTXOutput(reward, address)
+	output, err := NewTXOutput(subsidy+fees, address)
+	if err != nil {
+		return nil, err
+	}
 	//对于铸币交易，只有一个input,一个output
 	tx := Transaction{[]byte{}, []TXInput{input}, []TXOutput{*output}}
 	tx.SetHash()
-	return &tx
+	return &tx, nil
+}
+
+//铸币交易中记录的区块高度，不是铸币交易或者数据太短时返回false
+func (tx *Transaction) CoinbaseHeight() (uint64, bool) {
+	if !tx.IsCoinbase() || len(tx.TXInputs[0].PubKey) < coinbasePrefixLen {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(tx.TXInputs[0].PubKey[:8]), true
+}
+
+//铸币交易中矿工填写的数据，去掉高度和额外随机数
+//旧版本的铸币交易没有这个前缀，记录的高度与height对不上时原样返回
+func (tx *Transaction) CoinbaseData(height uint64) []byte {
+	script := tx.TXInputs[0].PubKey
+	if h, ok := tx.CoinbaseHeight(); ok && h == height {
+		return script[coinbasePrefixLen:]
+	}
+	return script
 }
 
 //创建普通的转账交易
@@ -103,14 +171,21 @@ func NewCoinbaseTX(address string, data string) *Transaction {
 //2.将这些UTXO逐一转成inputs
 //3.创建outputs
 //4.如果有零钱，找零
-func NewTransaction(from, to string, amount float64, bc *BlockChain) *Transaction {
+//inputs总额减去outputs总额就是付给矿工的手续费fee
+//钱包中没有from时返回ErrWalletNotFound，可用余额不够时返回ErrInsufficientFunds
+func NewTransaction(from, to string, amount, fee Amount, bc *BlockChain, pool *Mempool) (*Transaction, error) {
+	if !IsValidAddress(from) {
+		return nil, fmt.Errorf("%w：%s", ErrInvalidAddress, from)
+	}
 	//1.创建交易之后要进行数字签名->所以需要私钥->打开钱包（NewWallets()）
-	ws := NewWallets()
+	ws, err := NewWallets()
+	if err != nil {
+		return nil, err
+	}
 	//2.找到自己的钱包，根据地址返回自己的wallet
 	wallet := ws.WalletMap[from]
 	if wallet == nil {
-		fmt.Printf("没有找到该地址的钱包，交易创建失败！\n")
-		return nil
+		return nil, fmt.Errorf("%w：%s", ErrWalletNotFound, from)
 	}
 	//3.得到对应的公钥，私钥
 	pubKey := wallet.Pubkey
@@ -118,13 +193,20 @@ func NewTransaction(from, to string, amount float64, bc *BlockChain) *Transactio
 
 	pubKeyHash := HashPubKey(pubKey)
 
-	//1.找到最合理UTXO集合 map[string][]uint64
-	utxos, resValue := bc.FindNeedUTXOs(pubKeyHash, amount)
+	//需要的总额是转账金额加上手续费
+	total, err := AddAmount(amount, fee)
+	if err != nil {
+		return nil, err
+	}
 
-	fmt.Printf("resValue:%f\n", resValue) //6.25
-	if resValue < amount {
-		fmt.Printf("余额不足，交易失败！剩余金额为:%f\n", resValue)
-		return nil
+	//1.找到最合理UTXO集合 map[string][]uint64
+	//交易池中排队的交易已经花费的output不能再用，未确认的找零可以继续花费
+	utxos, resValue, err := bc.FindNeedUTXOs(pubKeyHash, total, pool)
+	if err != nil {
+		return nil, err
+	}
+	if resValue < total {
+		return nil, fmt.Errorf("%w：需要%s，可用余额为%s", ErrInsufficientFunds, total, resValue)
 	}
 
 	var inputs []TXInput
@@ -133,7 +215,6 @@ func NewTransaction(from, to string, amount float64, bc *BlockChain) *Transactio
 	//2.将这些UTXOs转化为inputs
 	for id, indexArray := range utxos {
 		for _, i := range indexArray {
-			fmt.Printf("id:%x\n", id)
 			input := TXInput{[]byte(id), int64(i), nil, pubKey}
 			inputs = append(inputs, input)
 		}
@@ -141,13 +222,19 @@ func NewTransaction(from, to string, amount float64, bc *BlockChain) *Transactio
 
 	//3.创建outputs
 	//output := TXOutput{amount, to}
-	output := NewTXOutput(amount, to)
+	output, err := NewTXOutput(amount, to)
+	if err != nil {
+		return nil, err
+	}
 	outputs = append(outputs, *output)
 
-	if resValue > amount {
-		//找零
+	if resValue > total {
+		//找零，扣除手续费
 		//outputs = append(outputs, TXOutput{resValue - amount, from})
-		output = NewTXOutput(resValue-amount, from)
+		output, err = NewTXOutput(resValue-total, from)
+		if err != nil {
+			return nil, err
+		}
 		outputs = append(outputs, *output)
 	}
 
@@ -155,15 +242,22 @@ func NewTransaction(from, to string, amount float64, bc *BlockChain) *Transactio
 	tx.SetHash()
 
 	//创建交易的最后进行签名
-	bc.SignTransaction(&tx, privateKey)
-	return &tx
+	var pending map[string]Transaction
+	if pool != nil {
+		pending = pool.Transactions()
+	}
+	err = bc.SignTransaction(&tx, privateKey, pending)
+	if err != nil {
+		return nil, err
+	}
+	return &tx, nil
 }
 
 //签名的具体实现,参数：私钥，inputs里面所有引用的交易的结构map[string]Transaction
-func (tx *Transaction) Sign(privateKey *ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+func (tx *Transaction) Sign(privateKey *ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
 
 	if tx.IsCoinbase() {
-		return
+		return nil
 	}
 
 	//1.创建一个当前交易的copy:TrimmedCopy：要把Signature和PubKey字段设置为nil
@@ -171,8 +265,8 @@ func (tx *Transaction) Sign(privateKey *ecdsa.PrivateKey, prevTXs map[string]Tra
 	//2.循环遍历txCopy的input索引的output的公钥哈希
 	for i, input := range txCopy.TXInputs {
 		prevTX := prevTXs[string(input.TXid)]
-		if len(prevTX.TXID) == 0 {
-			log.Panic("引用的交易无效")
+		if len(prevTX.TXID) == 0 || input.Index < 0 || input.Index >= int64(len(prevTX.TXOutputs)) {
+			return fmt.Errorf("%w：input引用的output%x[%d]", ErrTxNotFound, input.TXid, input.Index)
 		}
 		//不要对input进行赋值，这是一个副本，要对txCopy.TXInputs[xx]进行操作，否则无法把pubKeyHash传进去
 		txCopy.TXInputs[i].PubKey = prevTX.TXOutputs[input.Index].PubKeyHash
@@ -188,14 +282,15 @@ func (tx *Transaction) Sign(privateKey *ecdsa.PrivateKey, prevTXs map[string]Tra
 		//4.执行签名动作的到r，s字节流
 		r, s, err := ecdsa.Sign(rand.Reader, privateKey, signDataHash)
 		if err != nil {
-			log.Panic(err)
+			return err
 		}
 
 		//5.放到我们所签名的input的Signature中
-		signature := append(r.Bytes(), s.Bytes()...)
+		//r，s各补齐到32字节，否则有前导0时校验端平均拆分会出错
+		signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
 		tx.TXInputs[i].Signature = signature
 	}
-
+	return nil
 }
 
 //创建一个当前交易的copy
@@ -215,6 +310,7 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 //校验
 //所需要的数据：公钥、数据（txCopy，生成哈希），签名
 //我们要对每一个签名过的input进行校验
+//引用的交易不在prevTXs中，或者签名、公钥的格式不对时也返回false
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	if tx.IsCoinbase() {
 		return true
@@ -224,11 +320,13 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 
 	for i, input := range tx.TXInputs {
 		prevTX := prevTXs[string(input.TXid)]
-		if len(prevTX.TXID) == 0 {
-			log.Panic("引用的交易无效!")
+		if len(prevTX.TXID) == 0 || input.Index < 0 || input.Index >= int64(len(prevTX.TXOutputs)) {
+			return false
 		}
 		txCopy.TXInputs[i].PubKey = prevTX.TXOutputs[input.Index].PubKeyHash
 		txCopy.SetHash()
+		//与签名时一样还原，以免影响后面input的校验
+		txCopy.TXInputs[i].PubKey = nil
 		dataHash := txCopy.TXID
 		//2.得到Signature，反推r，s
 		signature := input.Signature //拆r,s
@@ -249,7 +347,7 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		//b.拆分我们signature，平均分，前半部分给r，后半部分给s
 		X.SetBytes(pubKey[:len(pubKey)/2])
 		Y.SetBytes(pubKey[len(pubKey)/2:])
-		pubKeyOrigin := ecdsa.PublicKey{elliptic.P256(), &X, &Y}
+		pubKeyOrigin := ecdsa.PublicKey{Curve: elliptic.P256(), X: &X, Y: &Y}
 
 		//4.Verify
 		if !ecdsa.Verify(&pubKeyOrigin, dataHash, &r, &s) {
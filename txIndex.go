@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+)
+
+//交易索引，key是交易ID，value是交易所在区块的哈希以及在区块中的位置
+//可以用setTxIndex命令关闭（写入metaBucket的txIndexKey，打开区块链时读取），关闭后删除索引，节省磁盘空间和写区块的时间，代价是：
+//1.getTransaction、签名和计算手续费时查找交易（FindTransactionByTXid）退回到从尾部遍历整个主链，区块链越长越慢
+//2.Mempool.Add不能再通过索引判断交易是否已经在区块链中，改为查询UTXO集合（见isTxOnChain）
+//3.新区块中的交易ID只与UTXO集合比较是否重复，与已经花费完的旧交易重复时发现不了（见checkDuplicateTxs）
+const txIndexBucket = "txIndexBucket"
+
+//交易索引开关的key，value为txIndexOn或txIndexOff，没有这个key时（新数据库和旧数据库）启用
+const txIndexKey = "TxIndex"
+const txIndexOn = "on"
+const txIndexOff = "off"
+
+//交易在区块链中的位置
+type TxLocation struct {
+	BlockHash []byte //所在区块的哈希
+	Position  uint64 //在区块交易数组中的下标
+}
+
+//编码(序列化)
+func (location *TxLocation) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(location)
+	if err != nil {
+		log.Panic("交易索引编码出错！")
+	}
+	return buffer.Bytes()
+}
+
+//解码(反序列化)
+func DeserializeTxLocation(data []byte) (TxLocation, error) {
+	var location TxLocation
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&location)
+	if err != nil {
+		return TxLocation{}, fmt.Errorf("%w：交易索引解码出错：%v", ErrDatabase, err)
+	}
+	return location, nil
+}
+
+//把区块中的交易写入索引，必须在写区块的同一个bolt事务中调用
+//索引没有启用（bucket不存在）时什么也不做
+func updateTxIndex(tx *bolt.Tx, block *Block) error {
+	bucket := tx.Bucket([]byte(txIndexBucket))
+	if bucket == nil {
+		return nil
+	}
+	for i, transaction := range block.Transactions {
+		location := TxLocation{block.NowHash, uint64(i)}
+		err := bucket.Put(transaction.TXID, location.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//从头重建交易索引
+func (blockChain *BlockChain) reindexTx() error {
+	err := blockChain.db.Update(rebuildTxIndex)
+	if err != nil {
+		return fmt.Errorf("重建交易索引失败：%w", err)
+	}
+	return nil
+}
+
+//打开或关闭交易索引：修改txIndexKey，并在同一个事务中重建或删除索引
+func (blockChain *BlockChain) SetTxIndex(enabled bool) error {
+	value := txIndexOff
+	if enabled {
+		value = txIndexOn
+	}
+	err := blockChain.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte(metaBucket)).Put([]byte(txIndexKey), []byte(value))
+		if err != nil {
+			return err
+		}
+		if enabled {
+			return rebuildTxIndex(tx)
+		}
+		if tx.Bucket([]byte(txIndexBucket)) == nil {
+			return nil
+		}
+		return tx.DeleteBucket([]byte(txIndexBucket))
+	})
+	if err != nil {
+		return fmt.Errorf("修改交易索引失败：%w", err)
+	}
+	return nil
+}
+
+//交易索引是否启用，必须在bolt事务中调用
+func txIndexEnabled(tx *bolt.Tx) bool {
+	meta := tx.Bucket([]byte(metaBucket))
+	return meta == nil || string(meta.Get([]byte(txIndexKey))) != txIndexOff
+}
+
+//交易是否已经在主链上，Mempool.Add用来拒绝已经上链的交易
+//启用交易索引时直接查询索引；关闭时查询UTXO集合，交易的output全部被花费时UTXO集合中没有它，
+//但这时它的input在UTXO集合中也已经被花费，加入交易池时同样会被拒绝
+func (blockChain *BlockChain) isTxOnChain(id []byte) (bool, error) {
+	location, indexed, err := blockChain.findTxLocation(id)
+	if err != nil || indexed {
+		return location != nil, err
+	}
+	var found bool
+	err = blockChain.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket([]byte(utxoBucket)).Get(id) != nil
+		return nil
+	})
+	return found, err
+}
+
+//在bolt事务中删除旧的索引，遍历主链重新写入
+func rebuildTxIndex(tx *bolt.Tx) error {
+	if tx.Bucket([]byte(txIndexBucket)) != nil {
+		err := tx.DeleteBucket([]byte(txIndexBucket))
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.CreateBucket([]byte(txIndexBucket))
+	if err != nil {
+		return err
+	}
+
+	//在同一个事务中直接读取区块，不能再使用迭代器（迭代器会另开事务）
+	blocks := tx.Bucket([]byte(blockBucket))
+	hash := blocks.Get([]byte("LastHashKey"))
+	for len(hash) != 0 {
+		block, err := Deserialize(blocks.Get(hash))
+		if err != nil {
+			return err
+		}
+		err = updateTxIndex(tx, &block)
+		if err != nil {
+			return err
+		}
+		hash = block.PreHash
+	}
+	return nil
+}
+
+//通过交易索引查找交易的位置，索引没有启用时indexed为false，索引中没有这个交易时location为nil
+func (blockChain *BlockChain) findTxLocation(id []byte) (location *TxLocation, indexed bool, err error) {
+	err = blockChain.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(txIndexBucket))
+		if bucket == nil {
+			return nil
+		}
+		indexed = true
+		data := bucket.Get(id)
+		if data == nil {
+			return nil
+		}
+		found, err := DeserializeTxLocation(data)
+		if err != nil {
+			return err
+		}
+		location = &found
+		return nil
+	})
+	return location, indexed, err
+}
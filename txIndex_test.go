@@ -0,0 +1,71 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+	"strings"
+	"testing"
+)
+
+//关闭交易索引后仍然能找到交易并拒绝已经上链的交易，重新打开区块链时保持关闭，打开时重建索引
+func TestSetTxIndex(t *testing.T) {
+	bc, miner := newTestChain(t)
+	pool, err := bc.LoadMempool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, pool, miner, int(bc.subsidy.CoinbaseMaturity))
+	tx, err := NewTransaction(miner, miner, CoinUnit, 0, bc, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pool.Add(bc, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mineBlocks(t, bc, pool, miner, 1)
+
+	err = bc.SetTxIndex(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, indexed, _ := bc.findTxLocation(tx.TXID); indexed {
+		t.Fatal("关闭之后交易索引没有删除")
+	}
+	_, err = bc.FindTransactionByTXid(tx.TXID)
+	if err != nil {
+		t.Fatalf("没有交易索引时找不到交易：%v", err)
+	}
+	err = pool.Add(bc, tx)
+	if err == nil || !strings.Contains(err.Error(), "已经在区块链中") {
+		t.Fatalf("已经上链的交易应该被拒绝：%v", err)
+	}
+
+	//重新打开区块链时不会重建索引
+	bc.Close()
+	bc, err = NewBlockChain(&testEngine{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	err = bc.db.View(func(boltTx *bolt.Tx) error {
+		if boltTx.Bucket([]byte(txIndexBucket)) != nil {
+			t.Error("重新打开区块链时重建了关闭的交易索引")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = bc.SetTxIndex(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, indexed, err := bc.findTxLocation(tx.TXID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !indexed || location == nil || location.Position != 1 {
+		t.Fatalf("打开之后交易索引没有重建：%v", location)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+	"math"
+	"sort"
+)
+
+//区块的撤销记录，key是区块哈希，value是区块花费的所有output（包括所在交易的ID、区块高度等UTXO信息）
+//区块接入主链时在更新UTXO集合的同一个事务中写入，断开区块时直接把这些output放回UTXO集合，不需要再去查找被花费的交易
+//这个功能之前接入的区块没有撤销记录，断开时退回到在主链上查找被花费的交易
+const undoBucket = "undoBucket"
+
+//区块花费的一个output
+type SpentOutput struct {
+	TXid []byte //output所在交易的ID
+	UTXO UTXO
+}
+
+//编码(序列化)
+func SerializeSpentOutputs(spent []SpentOutput) []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(spent)
+	if err != nil {
+		log.Panic("撤销记录编码出错！")
+	}
+	return buffer.Bytes()
+}
+
+//解码(反序列化)
+func DeserializeSpentOutputs(data []byte) ([]SpentOutput, error) {
+	var spent []SpentOutput
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&spent)
+	if err != nil {
+		return nil, fmt.Errorf("%w：撤销记录解码出错：%v", ErrDatabase, err)
+	}
+	return spent, nil
+}
+
+//写入区块的撤销记录，必须在更新UTXO集合的同一个bolt事务中调用
+//没有花费任何output的区块（例如只有铸币交易）也写入一条空记录，表示这个区块有撤销记录
+func putUndo(tx *bolt.Tx, block *Block, spent []SpentOutput) error {
+	bucket := tx.Bucket([]byte(undoBucket))
+	if bucket == nil {
+		return fmt.Errorf("%w：撤销记录bucket不存在", ErrDatabase)
+	}
+	return bucket.Put(block.NowHash, SerializeSpentOutputs(spent))
+}
+
+//读取区块的撤销记录，没有记录时found为false
+func getUndo(tx *bolt.Tx, hash []byte) (spent []SpentOutput, found bool, err error) {
+	bucket := tx.Bucket([]byte(undoBucket))
+	if bucket == nil {
+		return nil, false, nil
+	}
+	data := bucket.Get(hash)
+	if data == nil {
+		return nil, false, nil
+	}
+	spent, err = DeserializeSpentOutputs(data)
+	if err != nil {
+		return nil, false, err
+	}
+	return spent, true, nil
+}
+
+//把一个已花费的output放回UTXO集合，这个output当前不能在UTXO集合中
+func putBackUTXO(tx *bolt.Tx, txid []byte, spent UTXO) error {
+	bucket := tx.Bucket([]byte(utxoBucket))
+	var utxos []UTXO
+	if data := bucket.Get(txid); data != nil {
+		var err error
+		utxos, err = DeserializeUTXOs(data)
+		if err != nil {
+			return err
+		}
+	}
+	for _, utxo := range utxos {
+		if utxo.Index == spent.Index {
+			return fmt.Errorf("%w：要恢复的output没有被花费：%x[%d]", ErrDatabase, txid, spent.Index)
+		}
+	}
+	utxos = append(utxos, spent)
+	sort.Slice(utxos, func(i, j int) bool {
+		return utxos[i].Index < utxos[j].Index
+	})
+	return bucket.Put(txid, SerializeUTXOs(utxos))
+}
+
+//从主链尾部回退n个区块，用于删除错误的测试区块
+//与重组时断开区块相同：恢复UTXO集合，删除交易索引和高度索引，LastHashKey指向前一个区块，交易放回交易池
+//与重组不同的是回退的区块以及它们的累计工作量和撤销记录会被删除，之后可以重新挖出或者重新接收这些区块
+//保存在侧链上的后代区块和只有区块头的后代也一起删除（见pruneBlocks）
+//返回回退的区块（从原来的尾部开始）以及删除的后代个数
+func (blockChain *BlockChain) Rollback(n uint64) ([]*Block, int, error) {
+	if n == 0 {
+		return nil, 0, errors.New("回退的区块个数必须大于0")
+	}
+
+	blockChain.chainLock.Lock()
+	defer blockChain.chainLock.Unlock()
+
+	var removed []*Block
+	var pruned int
+	var tip []byte
+	err := blockChain.db.Update(func(tx *bolt.Tx) error {
+		blocks := tx.Bucket([]byte(blockBucket))
+		block, err := getBlock(tx, blocks.Get([]byte("LastHashKey")))
+		if err != nil {
+			return err
+		}
+		if n > block.Height {
+			return fmt.Errorf("当前高度为%d，最多只能回退%d个区块（不能回退创世区块）", block.Height, block.Height)
+		}
+
+		pool := tx.Bucket([]byte(mempoolBucket))
+		for i := uint64(0); i < n; i++ {
+			err = disconnectBlock(tx, block)
+			if err != nil {
+				return fmt.Errorf("断开区块%x失败：%w", block.NowHash, err)
+			}
+			//加载交易池时会重新校验这些交易
+			for _, transaction := range block.Transactions {
+				if transaction.IsCoinbase() {
+					continue
+				}
+				err = pool.Put(transaction.TXID, transaction.Serialize())
+				if err != nil {
+					return err
+				}
+			}
+			removed = append(removed, block)
+
+			block, err = getBlock(tx, block.PreHash)
+			if err != nil {
+				return err
+			}
+		}
+		tip = block.NowHash
+
+		var hashes [][]byte
+		for _, block := range removed {
+			hashes = append(hashes, block.NowHash)
+		}
+		pruned, err = pruneBlocks(tx, hashes)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	blockChain.tail = tip
+	//正在进行的挖矿都基于被删除的区块
+	blockChain.AbortMining(math.MaxUint64)
+	return removed, pruned, nil
+}
+
+//删除hashes中的区块以及数据库中保存的所有后代（侧链上的区块和只有区块头的区块）
+//后代的前一个区块被删除之后它们再也无法接入主链，留下来只会成为找不到前一个区块的孤块
+//侧链没有高度索引，所以读取所有区块和区块头，按高度从低到高找出前一个区块已经被删除的区块
+//区块、区块头、累计工作量、撤销记录以及迁移记录一起删除，返回删除的后代个数（不包括hashes本身）
+func pruneBlocks(tx *bolt.Tx, hashes [][]byte) (int, error) {
+	doomed := make(map[string]bool)
+	for _, hash := range hashes {
+		doomed[string(hash)] = true
+	}
+
+	type storedBlock struct {
+		hash    string
+		preHash string
+		height  uint64
+	}
+	var stored []storedBlock
+	for _, name := range []string{blockBucket, headerBucket} {
+		err := tx.Bucket([]byte(name)).ForEach(func(k, v []byte) error {
+			if string(k) == "LastHashKey" || doomed[string(k)] {
+				return nil
+			}
+			block, err := Deserialize(v)
+			if err != nil {
+				return err
+			}
+			stored = append(stored, storedBlock{string(k), string(block.PreHash), block.Height})
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].height < stored[j].height
+	})
+	descendants := 0
+	for _, block := range stored {
+		if doomed[block.preHash] && !doomed[block.hash] {
+			doomed[block.hash] = true
+			descendants++
+		}
+	}
+
+	for hash := range doomed {
+		for _, name := range []string{blockBucket, headerBucket, chainWorkBucket, undoBucket, legacyBlockBucket} {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				continue
+			}
+			err := bucket.Delete([]byte(hash))
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	return descendants, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+//回退之后UTXO集合恢复原样，保存在侧链上的后代区块和只有区块头的后代一起删除
+func TestRollbackPrunesDescendants(t *testing.T) {
+	bc, miner := newTestChain(t)
+	pool, err := bc.LoadMempool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fork := mineBlocks(t, bc, pool, miner, 1)
+	before := readUTXOSet(t, bc)
+	parent := mineBlocks(t, bc, pool, miner, 1)
+	mineBlocks(t, bc, pool, miner, 1)
+
+	//侧链：parent <- side <- sideHeader，累计工作量与主链相同，不会切换主链
+	//parent被回退之后侧链也要删除，fork上的区块则保留
+	side := newTestBlock(t, parent, miner, "side")
+	update, err := bc.AcceptBlock(side)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(update.Connected) != 0 {
+		t.Fatal("侧链区块不应该接入主链")
+	}
+	sideHeader := newTestBlock(t, side, miner, "header").Header()
+	_, err = bc.AcceptHeaders([]*Block{sideHeader})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := newTestBlock(t, fork, miner, "kept")
+	_, err = bc.AcceptBlock(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, pruned, err := bc.Rollback(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || pruned != 2 {
+		t.Fatalf("回退了%d个区块，删除了%d个后代，应该都是2", len(removed), pruned)
+	}
+	if !bytes.Equal(bc.Tip(), fork.NowHash) {
+		t.Fatalf("回退之后的尾部不是分叉点")
+	}
+	for _, hash := range [][]byte{removed[0].NowHash, removed[1].NowHash, side.NowHash, sideHeader.NowHash} {
+		_, err = bc.GetHeader(hash)
+		if !errors.Is(err, ErrBlockNotFound) {
+			t.Errorf("区块%x没有被删除：%v", hash, err)
+		}
+		_, err = bc.ChainWork(hash)
+		if err == nil {
+			t.Errorf("区块%x的累计工作量没有被删除", hash)
+		}
+	}
+
+	after := readUTXOSet(t, bc)
+	if len(after) != len(before) {
+		t.Fatalf("回退之后UTXO集合有%d个交易，回退之前有%d个", len(after), len(before))
+	}
+	for txid, data := range before {
+		if !bytes.Equal(after[txid], data) {
+			t.Errorf("交易%x的UTXO没有恢复", txid)
+		}
+	}
+
+	_, err = bc.GetHeader(kept.NowHash)
+	if err != nil {
+		t.Fatalf("分叉点之后的侧链区块不应该被删除：%v", err)
+	}
+	//删除的区块可以重新接收
+	_, err = bc.AcceptBlock(removed[1])
+	if err != nil {
+		t.Fatalf("重新接收回退的区块失败：%v", err)
+	}
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+	"sort"
+)
+
+//UTXO集合单独存放在一个bucket中，key是交易ID，value是这个交易中尚未花费的output数组
+//区块接入主链时在同一个db.Update里面增量更新（分叉重组时断开的区块会恢复它花费的output），查询余额时不再需要遍历整个区块链
+const utxoBucket = "utxoBucket"
+
+//UTXO集合的格式，旧格式的UTXO中没有区块高度，需要重建
+const utxoFormatKey = "utxoFormat"
+const utxoFormatMaturity = "maturity"
+
+//UTXO集合中的一个条目，记录output本身以及它在所属交易中的索引
+//同时记录所属交易所在区块的高度，以及是否为铸币交易，用于判断是否成熟
+type UTXO struct {
+	Index    int64
+	Output   TXOutput
+	Height   uint64
+	Coinbase bool
+}
+
+//这个output能否在高度为height的区块中被花费：铸币交易的output需要经过maturity个区块（见SubsidySchedule）
+func (utxo *UTXO) IsMature(height, maturity uint64) bool {
+	return !utxo.Coinbase || height >= utxo.Height+maturity
+}
+
+//编码(序列化)一个交易中所有未花费的output
+func SerializeUTXOs(utxos []UTXO) []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(utxos)
+	if err != nil {
+		log.Panic("UTXO编码出错！")
+	}
+	return buffer.Bytes()
+}
+
+//解码(反序列化)
+func DeserializeUTXOs(data []byte) ([]UTXO, error) {
+	var utxos []UTXO
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&utxos)
+	if err != nil {
+		return nil, fmt.Errorf("%w：UTXO解码出错：%v", ErrDatabase, err)
+	}
+	return utxos, nil
+}
+
+//根据一个新区块更新UTXO集合，必须在写区块的同一个bolt事务中调用
+//1.删除区块中每个input引用的output
+//2.把区块中每个交易的output加进来
+//同一个区块内后面的交易可以花费前面交易的output，所以按交易顺序逐个处理
+//处理的同时统计手续费，铸币交易的金额不能超过挖矿奖励加上手续费总额，并且不能花费未成熟的铸币交易output
+//被删除的output写入区块的撤销记录，断开区块时用来恢复
+//迁移的旧区块产生时还没有成熟度的规则，不检查成熟度
+func updateUTXOSet(tx *bolt.Tx, block *Block) error {
+	bucket := tx.Bucket([]byte(utxoBucket))
+	if bucket == nil {
+		return fmt.Errorf("%w：UTXO bucket不存在，请先执行reindexUTXO", ErrDatabase)
+	}
+	legacy := isLegacyBlock(tx, block)
+	subsidy, err := getSubsidySchedule(tx)
+	if err != nil {
+		return err
+	}
+
+	var totalFees Amount
+	var spentOutputs []SpentOutput
+	for _, transaction := range block.Transactions {
+		if !transaction.IsCoinbase() {
+			var inputSum Amount
+			for _, input := range transaction.TXInputs {
+				data := bucket.Get(input.TXid)
+				if data == nil {
+					return fmt.Errorf("input引用的output不存在或已被花费：%x[%d]", input.TXid, input.Index)
+				}
+				stored, err := DeserializeUTXOs(data)
+				if err != nil {
+					return err
+				}
+				var remain []UTXO
+				var spent *UTXO
+				for _, utxo := range stored {
+					if utxo.Index == input.Index {
+						found := utxo
+						spent = &found
+						continue
+					}
+					remain = append(remain, utxo)
+				}
+				if spent == nil {
+					return fmt.Errorf("input引用的output不存在或已被花费：%x[%d]", input.TXid, input.Index)
+				}
+				if !legacy && !spent.IsMature(block.Height, subsidy.CoinbaseMaturity) {
+					return fmt.Errorf("input引用的铸币交易output尚未成熟：%x[%d]", input.TXid, input.Index)
+				}
+				//input中的公钥必须是output的收款方
+				if !bytes.Equal(HashPubKey(input.PubKey), spent.Output.PubKeyHash) {
+					return fmt.Errorf("input公钥与引用的output不符：%x[%d]", input.TXid, input.Index)
+				}
+
+				inputSum, err = AddAmount(inputSum, spent.Output.Value)
+				if err != nil {
+					return err
+				}
+				spentOutputs = append(spentOutputs, SpentOutput{input.TXid, *spent})
+				if len(remain) == 0 {
+					err = bucket.Delete(input.TXid)
+				} else {
+					err = bucket.Put(input.TXid, SerializeUTXOs(remain))
+				}
+				if err != nil {
+					return err
+				}
+			}
+
+			outputSum, err := transaction.OutputSum()
+			if err != nil {
+				return err
+			}
+			if inputSum < outputSum {
+				return fmt.Errorf("交易%x的output总额%s大于input总额%s", transaction.TXID, outputSum, inputSum)
+			}
+			totalFees, err = AddAmount(totalFees, inputSum-outputSum)
+			if err != nil {
+				return err
+			}
+		}
+
+		var utxos []UTXO
+		for i, output := range transaction.TXOutputs {
+			utxos = append(utxos, UTXO{int64(i), output, block.Height, transaction.IsCoinbase()})
+		}
+		err := bucket.Put(transaction.TXID, SerializeUTXOs(utxos))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = checkCoinbaseValue(block, totalFees, subsidy)
+	if err != nil {
+		return err
+	}
+	return putUndo(tx, block, spentOutputs)
+}
+
+//铸币交易的金额不能超过区块高度按奖励计划schedule对应的挖矿奖励加上区块中所有交易的手续费
+func checkCoinbaseValue(block *Block, totalFees Amount, schedule SubsidySchedule) error {
+	if len(block.Transactions) == 0 || !block.Transactions[0].IsCoinbase() {
+		return errors.New("第一个交易不是铸币交易")
+	}
+	subsidy := schedule.Subsidy(block.Height)
+	limit, err := AddAmount(subsidy, totalFees)
+	if err != nil {
+		return err
+	}
+	value, err := block.Transactions[0].OutputSum()
+	if err != nil {
+		return err
+	}
+	if value > limit {
+		return fmt.Errorf("铸币交易金额%s超过了挖矿奖励%s加手续费%s", value, subsidy, totalFees)
+	}
+	return nil
+}
+
+//遍历整个区块链，找到所有未花费的output，key是交易id
+//仅在重建UTXO集合时使用
+func (blockChain *BlockChain) FindAllUTXOs() (map[string][]UTXO, error) {
+	UTXOs := make(map[string][]UTXO)
+	//key是output所在交易的id，value是已经被花费的索引
+	spendOutputs := make(map[string][]int64)
+
+	//从尾部向前遍历，花费某个output的交易一定先于这个output被遍历到
+	it := blockChain.NewIterator()
+	for {
+		block, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		//区块内后面的交易可以花费前面交易的output，所以区块内也从后向前遍历，与updateUTXOSet的结果一致
+		for k := len(block.Transactions) - 1; k >= 0; k-- {
+			tx := block.Transactions[k]
+		OUTPUT:
+			for i, output := range tx.TXOutputs {
+				for _, j := range spendOutputs[string(tx.TXID)] {
+					if int64(i) == j {
+						continue OUTPUT
+					}
+				}
+				UTXOs[string(tx.TXID)] = append(UTXOs[string(tx.TXID)], UTXO{int64(i), output, block.Height, tx.IsCoinbase()})
+			}
+
+			if !tx.IsCoinbase() {
+				for _, input := range tx.TXInputs {
+					spendOutputs[string(input.TXid)] = append(spendOutputs[string(input.TXid)], input.Index)
+				}
+			}
+		}
+
+		if len(block.PreHash) == 0 {
+			break
+		}
+	}
+	return UTXOs, nil
+}
+
+//从头重建UTXO集合，返回包含未花费output的交易个数
+func (blockChain *BlockChain) ReindexUTXO() (int, error) {
+	UTXOs, err := blockChain.FindAllUTXOs()
+	if err != nil {
+		return 0, err
+	}
+
+	err = blockChain.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(utxoBucket)) != nil {
+			err := tx.DeleteBucket([]byte(utxoBucket))
+			if err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket([]byte(utxoBucket))
+		if err != nil {
+			return err
+		}
+		for txid, utxos := range UTXOs {
+			err = bucket.Put([]byte(txid), SerializeUTXOs(utxos))
+			if err != nil {
+				return err
+			}
+		}
+		meta, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+		if err != nil {
+			return err
+		}
+		return meta.Put([]byte(utxoFormatKey), []byte(utxoFormatMaturity))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("重建UTXO集合失败：%w", err)
+	}
+	return len(UTXOs), nil
+}
+
+//在UTXO集合中查找一个未花费的output，不存在或已被花费时found为false
+func (blockChain *BlockChain) FindUTXOByOutpoint(txid []byte, index int64) (output UTXO, found bool, err error) {
+	err = blockChain.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(utxoBucket))
+		if bucket == nil {
+			return fmt.Errorf("%w：UTXO bucket不存在，请执行reindexUTXO", ErrDatabase)
+		}
+		data := bucket.Get(txid)
+		if data == nil {
+			return nil
+		}
+		utxos, err := DeserializeUTXOs(data)
+		if err != nil {
+			return err
+		}
+		for _, utxo := range utxos {
+			if utxo.Index == index {
+				output = utxo
+				found = true
+				break
+			}
+		}
+		return nil
+	})
+	return output, found, err
+}
+
+//当前实际发行的币的总量，即UTXO集合中所有output的总额
+//手续费会转到铸币交易中，所以这个总量就是主链上所有铸币交易实际领取的挖矿奖励之和
+//矿工没有领取全部奖励时会小于奖励计划的总量
+func (blockChain *BlockChain) IssuedSupply() (Amount, error) {
+	var total Amount
+	err := blockChain.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(utxoBucket))
+		if bucket == nil {
+			return fmt.Errorf("%w：UTXO bucket不存在，请执行reindexUTXO", ErrDatabase)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			utxos, err := DeserializeUTXOs(v)
+			if err != nil {
+				return err
+			}
+			for _, utxo := range utxos {
+				total, err = AddAmount(total, utxo.Output.Value)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	return total, err
+}
+
+//找到指定公钥哈希所有的utxo
+func (blockChain *BlockChain) FindUTXO(senderPubKeyHash []byte) ([]UTXO, error) {
+	var UTXOs []UTXO
+
+	err := blockChain.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(utxoBucket))
+		if bucket == nil {
+			return fmt.Errorf("%w：UTXO bucket不存在，请执行reindexUTXO", ErrDatabase)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			utxos, err := DeserializeUTXOs(v)
+			if err != nil {
+				return err
+			}
+			for _, utxo := range utxos {
+				if bytes.Equal(senderPubKeyHash, utxo.Output.PubKeyHash) {
+					UTXOs = append(UTXOs, utxo)
+				}
+			}
+			return nil
+		})
+	})
+
+	return UTXOs, err
+}
+
+//统计指定公钥哈希的余额，未成熟的铸币交易output单独统计，它们在下一个区块中还不能花费
+func (blockChain *BlockChain) Balance(pubKeyHash []byte) (mature, immature Amount, err error) {
+	utxos, err := blockChain.FindUTXO(pubKeyHash)
+	if err != nil {
+		return 0, 0, err
+	}
+	bestHeight, err := blockChain.BestHeight()
+	if err != nil {
+		return 0, 0, err
+	}
+	nextHeight := bestHeight + 1
+	for _, utxo := range utxos {
+		if utxo.IsMature(nextHeight, blockChain.subsidy.CoinbaseMaturity) {
+			mature, err = AddAmount(mature, utxo.Output.Value)
+		} else {
+			immature, err = AddAmount(immature, utxo.Output.Value)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return mature, immature, nil
+}
+
+//找到满足转账金额的utxo集合，key是交易id，value是output的索引数组
+//交易最早被打包进下一个区块，在下一个区块中还不能花费的铸币交易output不会被选中
+//pool不为空时，跳过已经被交易池中的交易花费的output，UTXO集合不够时再使用交易池中未花费的output（例如未确认的找零）
+func (blockChain *BlockChain) FindNeedUTXOs(senderPubKeyHash []byte, amount Amount, pool *Mempool) (map[string][]uint64, Amount, error) {
+	utxos := make(map[string][]uint64)
+	var calc Amount
+	bestHeight, err := blockChain.BestHeight()
+	if err != nil {
+		return nil, 0, err
+	}
+	nextHeight := bestHeight + 1
+
+	err = blockChain.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(utxoBucket))
+		if bucket == nil {
+			return fmt.Errorf("%w：UTXO bucket不存在，请执行reindexUTXO", ErrDatabase)
+		}
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			stored, err := DeserializeUTXOs(v)
+			if err != nil {
+				return err
+			}
+			for _, utxo := range stored {
+				if pool != nil && pool.IsSpent(k, utxo.Index) {
+					continue
+				}
+				if bytes.Equal(senderPubKeyHash, utxo.Output.PubKeyHash) && utxo.IsMature(nextHeight, blockChain.subsidy.CoinbaseMaturity) {
+					//1.把utxo加进来
+					utxos[string(k)] = append(utxos[string(k)], uint64(utxo.Index))
+					//2.统计一下当前utxo得总额
+					calc, err = AddAmount(calc, utxo.Output.Value)
+					if err != nil {
+						return err
+					}
+					//3.满足转账需求的话直接返回
+					if calc >= amount {
+						return nil
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if calc >= amount || pool == nil {
+		return utxos, calc, nil
+	}
+
+	//交易池中的交易按id排序，每次选中的output相同
+	pending := pool.Transactions()
+	var ids []string
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for i, output := range pending[id].TXOutputs {
+			if !bytes.Equal(senderPubKeyHash, output.PubKeyHash) || pool.IsSpent([]byte(id), int64(i)) {
+				continue
+			}
+			utxos[id] = append(utxos[id], uint64(i))
+			calc, err = AddAmount(calc, output.Value)
+			if err != nil {
+				return nil, 0, err
+			}
+			if calc >= amount {
+				return utxos, calc, nil
+			}
+		}
+	}
+	return utxos, calc, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+//同一个区块中子交易花费父交易的output时，重建的UTXO集合必须与增量更新的结果相同
+func TestReindexUTXOWithChainedTransactions(t *testing.T) {
+	bc, miner := newTestChain(t)
+	pool, err := bc.LoadMempool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//创世区块的铸币交易成熟之后才能花费
+	mineBlocks(t, bc, pool, miner, int(bc.subsidy.CoinbaseMaturity))
+
+	ws, err := NewWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := ws.CreateWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := NewTransaction(miner, receiver, 2*CoinUnit, 0, bc, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pool.Add(bc, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//子交易花费父交易给receiver的output
+	wallet := ws.WalletMap[receiver]
+	output, err := NewTXOutput(CoinUnit, miner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := Transaction{nil, []TXInput{{parent.TXID, 0, nil, wallet.Pubkey}}, []TXOutput{*output}}
+	child.SetHash()
+	err = child.Sign(wallet.Private, map[string]Transaction{string(parent.TXID): *parent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pool.Add(bc, &child)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := mineBlocks(t, bc, pool, miner, 1)
+	if len(block.Transactions) != 3 {
+		t.Fatalf("区块中有%d个交易，应该有3个", len(block.Transactions))
+	}
+
+	live := readUTXOSet(t, bc)
+	if _, found, _ := bc.FindUTXOByOutpoint(parent.TXID, 0); found {
+		t.Fatalf("父交易被同一个区块花费的output仍然在UTXO集合中")
+	}
+	_, err = bc.ReindexUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := readUTXOSet(t, bc)
+	if len(rebuilt) != len(live) {
+		t.Fatalf("重建的UTXO集合有%d个交易，增量更新的有%d个", len(rebuilt), len(live))
+	}
+	for txid, data := range live {
+		if !bytes.Equal(rebuilt[txid], data) {
+			t.Errorf("交易%x的UTXO不一致", txid)
+		}
+	}
+}
+
+//铸币交易的成熟度从subsidy.conf读取并保存在数据库中
+//未成熟的铸币交易output不能被区块中的交易花费，FindNeedUTXOs不选择它们，余额中单独统计
+func TestCoinbaseMaturity(t *testing.T) {
+	chdirTemp(t)
+	err := ioutil.WriteFile(subsidyConfigFile, []byte("coinbaseMaturity 3\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := openTestChain(t)
+	if bc.subsidy.CoinbaseMaturity != 3 {
+		t.Fatalf("铸币交易成熟度为%d，应为3", bc.subsidy.CoinbaseMaturity)
+	}
+	ws, err := NewWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	miner := ws.ListAddresses()[0]
+	wallet := ws.WalletMap[miner]
+	pubKeyHash := HashPubKey(wallet.Pubkey)
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reward := genesis.Transactions[0]
+
+	//花费创世区块铸币交易的区块
+	spendBlock := func(parent *Block) *Block {
+		t.Helper()
+		output, err := NewTXOutput(CoinUnit, miner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spend := Transaction{nil, []TXInput{{reward.TXID, 0, nil, wallet.Pubkey}}, []TXOutput{*output}}
+		spend.SetHash()
+		err = spend.Sign(wallet.Private, map[string]Transaction{string(reward.TXID): *reward})
+		if err != nil {
+			t.Fatal(err)
+		}
+		height := parent.Height + 1
+		fee := reward.TXOutputs[0].Value - CoinUnit
+		coinbase, err := NewCoinbaseTX(miner, "", height, bc.subsidy.Subsidy(height), fee)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := NewBlock([]*Transaction{coinbase, &spend}, parent.NowHash, height, initialBits)
+		block.NowHash = block.CalcHash()
+		return block
+	}
+	checkBalance := func(wantMature, wantImmature Amount) {
+		t.Helper()
+		mature, immature, err := bc.Balance(pubKeyHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mature != wantMature || immature != wantImmature {
+			t.Fatalf("可用余额%s，未成熟%s，应为%s和%s", mature, immature, wantMature, wantImmature)
+		}
+		utxos, calc, err := bc.FindNeedUTXOs(pubKeyHash, wantMature+wantImmature, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calc != wantMature {
+			t.Fatalf("FindNeedUTXOs选择了%s，应只选择成熟的%s", calc, wantMature)
+		}
+		for txid := range utxos {
+			if txid != string(reward.TXID) {
+				t.Fatalf("FindNeedUTXOs选择了未成熟的铸币交易%x", txid)
+			}
+		}
+	}
+
+	//下一个区块的高度为1，创世区块的铸币交易还没有成熟
+	checkBalance(0, reward.TXOutputs[0].Value)
+	_, err = bc.AcceptBlock(spendBlock(genesis))
+	if !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("花费未成熟的铸币交易的区块返回%v", err)
+	}
+
+	pool, err := bc.LoadMempool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip := mineBlocks(t, bc, pool, miner, 2)
+	//下一个区块的高度为3，只有创世区块的铸币交易成熟
+	checkBalance(reward.TXOutputs[0].Value, bc.subsidy.TotalSupply(2)-bc.subsidy.Subsidy(0))
+	_, err = bc.AcceptBlock(spendBlock(tip))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//重新打开时从数据库读取，不再读取配置文件
+	bc.Close()
+	err = ioutil.WriteFile(subsidyConfigFile, []byte("coinbaseMaturity 50\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc = openTestChain(t)
+	if bc.subsidy.CoinbaseMaturity != 3 {
+		t.Fatalf("重新打开后的铸币交易成熟度为%d，应为3", bc.subsidy.CoinbaseMaturity)
+	}
+}
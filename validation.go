@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"time"
+)
+
+//校验单个区块本身（只有共识引擎需要通过区块链查询祖先区块）
+//1.铸币交易必须是第一个并且只能有一个，其中记录的高度与区块高度一致
+//2.重新计算每个交易的ID，并且区块中没有重复的交易ID
+//3.重新计算默克尔树根
+//4.重新计算区块哈希
+//5.区块的封装满足共识规则（pow中为满足区块中记录的难度，难度是否正确需要结合区块链校验）
+//任何一个交易被篡改都会导致交易ID、默克尔树根、区块哈希依次对不上
+//migrateEncoding迁移的旧区块只校验交易的位置和重复，交易ID、铸币交易中的高度、默克尔树根和区块哈希
+//都是按旧的规则计算的，无法重新校验（见legacyHeightKey）
+func ValidateBlock(blockChain *BlockChain, block *Block) error {
+	if len(block.Transactions) == 0 {
+		return errors.New("区块中没有交易")
+	}
+	legacy, err := blockChain.isLegacyBlock(block)
+	if err != nil {
+		return fmt.Errorf("%w：%v", ErrDatabase, err)
+	}
+
+	seen := make(map[string]bool)
+	for i, tx := range block.Transactions {
+		if i == 0 && !tx.IsCoinbase() {
+			return errors.New("第一个交易不是铸币交易")
+		}
+		if i > 0 && tx.IsCoinbase() {
+			return fmt.Errorf("第%d个交易是多余的铸币交易", i)
+		}
+		if !legacy && !bytes.Equal(tx.Hash(), tx.TXID) {
+			return fmt.Errorf("第%d个交易的ID与内容不符：%x", i, tx.TXID)
+		}
+		if seen[string(tx.TXID)] {
+			return fmt.Errorf("第%d个交易的ID重复：%x", i, tx.TXID)
+		}
+		seen[string(tx.TXID)] = true
+	}
+	if height, ok := block.Transactions[0].CoinbaseHeight(); !legacy && (!ok || height != block.Height) {
+		return fmt.Errorf("铸币交易中记录的高度与区块高度%d不符", block.Height)
+	}
+	if legacy {
+		return nil
+	}
+
+	if !bytes.Equal(block.MakeMerkelTreeRoot(), block.MerKerTreeRoot) {
+		return fmt.Errorf("默克尔树根不正确：%x", block.MerKerTreeRoot)
+	}
+
+	if !bytes.Equal(block.CalcHash(), block.NowHash) {
+		return fmt.Errorf("区块哈希不正确：%x", block.NowHash)
+	}
+
+	return blockChain.engine.VerifySeal(blockChain, block)
+}
+
+//区块时间戳最多允许超前本地时间的秒数
+const maxFutureBlockTime = 2 * 60 * 60
+
+//区块时间戳超前本地时间太多，可能只是双方的时钟不同步，过一段时间后区块可能变为有效
+//所以不认为区块无效，也不计入对方的违规分数
+var ErrFutureBlock = errors.New("区块时间戳超前太多")
+
+//区块链校验失败时返回的错误，记录第一个出错区块的高度和原因
+type ChainValidationError struct {
+	Height uint64
+	Hash   []byte
+	Reason string
+}
+
+func (e *ChainValidationError) Error() string {
+	return fmt.Sprintf("高度%d的区块(%x)校验失败：%s", e.Height, e.Hash, e.Reason)
+}
+
+//从创世区块到最后一个区块校验整个区块链，返回第一个出错的区块
+//1.高度索引和前区块哈希的链接
+//2.区块本身（交易ID、默克尔树根、区块哈希、pow难度）
+//3.时间戳以及难度调整
+//4.交易签名、金额、双花以及铸币交易成熟度
+//5.铸币交易金额不超过挖矿奖励加手续费
+func (blockChain *BlockChain) Validate() (err error) {
+	var height uint64
+	var hash []byte
+	//解码错误已经通过返回值处理，这里只是防止损坏的区块触发校验代码中意外的panic
+	defer func() {
+		if r := recover(); r != nil {
+			err = &ChainValidationError{height, hash, fmt.Sprint(r)}
+		}
+	}()
+
+	//校验过程中在内存中维护的UTXO集合和所有交易
+	utxos := make(map[string]map[int64]UTXO)
+	txs := make(map[string]Transaction)
+
+	bestHeight, err := blockChain.BestHeight()
+	if err != nil {
+		return err
+	}
+	var prevBlock *Block
+	for height = 0; height <= bestHeight; height++ {
+		block, err := blockChain.GetBlockByHeight(height)
+		if err != nil {
+			return &ChainValidationError{height, nil, err.Error()}
+		}
+		hash = block.NowHash
+		fail := func(format string, a ...interface{}) error {
+			return &ChainValidationError{height, block.NowHash, fmt.Sprintf(format, a...)}
+		}
+
+		if block.Height != height {
+			return fail("区块中记录的高度为%d", block.Height)
+		}
+		err = blockChain.checkBlockContext(blockChain, block, prevBlock)
+		if err != nil {
+			return fail("%v", err)
+		}
+
+		err = ValidateBlock(blockChain, block)
+		if err != nil {
+			return fail("%v", err)
+		}
+
+		legacy, err := blockChain.isLegacyBlock(block)
+		if err != nil {
+			return fail("%v", err)
+		}
+		err = validateBlockTransactions(block, utxos, txs, legacy, blockChain.subsidy)
+		if err != nil {
+			return fail("%v", err)
+		}
+		prevBlock = block
+	}
+
+	if !bytes.Equal(prevBlock.NowHash, blockChain.Tip()) {
+		return &ChainValidationError{bestHeight, prevBlock.NowHash, "最后一个区块与LastHashKey不符"}
+	}
+	return nil
+}
+
+//校验区块与前一个区块的关系：版本、高度、前区块哈希、时间戳以及难度，prev为nil时block是创世区块
+//难度沿着PreHash计算，所以侧链上的区块也可以校验，chain用来查询祖先区块头
+func (blockChain *BlockChain) checkBlockContext(chain HeaderReader, block, prev *Block) error {
+	if block.Version < blockVersionConcat || block.Version > blockVersion {
+		return fmt.Errorf("不支持的区块版本：%d", block.Version)
+	}
+	if prev == nil {
+		if block.Height != 0 || len(block.PreHash) != 0 {
+			return errors.New("创世区块不应该有前区块哈希")
+		}
+	} else {
+		//已经使用带长度前缀的区块头之后，不能再退回到直接拼接的版本
+		if block.Version < prev.Version {
+			return fmt.Errorf("区块版本%d低于上一个区块的版本%d", block.Version, prev.Version)
+		}
+		if !bytes.Equal(block.PreHash, prev.NowHash) {
+			return fmt.Errorf("前区块哈希%x与上一个区块不符", block.PreHash)
+		}
+		if block.Height != prev.Height+1 {
+			return fmt.Errorf("区块高度%d与上一个区块的高度%d不连续", block.Height, prev.Height)
+		}
+		if block.TimeStamp < prev.TimeStamp {
+			return errors.New("时间戳早于上一个区块")
+		}
+	}
+	if block.TimeStamp > uint64(time.Now().Unix())+maxFutureBlockTime {
+		return fmt.Errorf("%w：%d", ErrFutureBlock, block.TimeStamp)
+	}
+	//迁移的旧区块没有记录难度
+	legacy, err := blockChain.isLegacyBlock(block)
+	if err != nil {
+		return fmt.Errorf("%w：%v", ErrDatabase, err)
+	}
+	if legacy {
+		return nil
+	}
+
+	//prev已经找到，查询更早的祖先失败是本地数据库的问题
+	expectedBits, err := blockChain.engine.CalcDifficulty(chain, prev)
+	if err != nil {
+		return fmt.Errorf("%w：%v", ErrDatabase, err)
+	}
+	if blockBits(block) != expectedBits {
+		return fmt.Errorf("难度%08x与期望的难度%08x不符", block.Difficulty, expectedBits)
+	}
+	return nil
+}
+
+//在内存中的UTXO集合上校验并应用区块中的交易
+//utxos的key是交易id，value是这个交易未花费的output（key为索引）；txs保存所有已经校验过的交易，用于签名校验
+//legacy为true时是迁移的旧区块，旧交易的签名无法校验，当时也还没有铸币交易成熟度的规则
+//subsidy是区块链的奖励计划，用于检查铸币交易的金额
+func validateBlockTransactions(block *Block, utxos map[string]map[int64]UTXO, txs map[string]Transaction, legacy bool, subsidy SubsidySchedule) error {
+	var totalFees Amount
+	for i, tx := range block.Transactions {
+		//1.铸币交易的位置已经在ValidateBlock中校验过
+		if len(tx.TXOutputs) == 0 {
+			return fmt.Errorf("第%d个交易没有output", i)
+		}
+		outputSum, err := tx.OutputSum()
+		if err != nil {
+			return fmt.Errorf("第%d个交易：%v", i, err)
+		}
+
+		if !tx.IsCoinbase() {
+			//2.找到每个input引用的output，并且从UTXO集合中删除，重复引用即为双花
+			prevTXs := make(map[string]Transaction)
+			var inputSum Amount
+			for _, input := range tx.TXInputs {
+				utxo, ok := utxos[string(input.TXid)][input.Index]
+				if !ok {
+					return fmt.Errorf("第%d个交易引用的output不存在或已被花费：%x[%d]", i, input.TXid, input.Index)
+				}
+				//铸币交易的output必须成熟之后才能花费
+				if !legacy && !utxo.IsMature(block.Height, subsidy.CoinbaseMaturity) {
+					return fmt.Errorf("第%d个交易引用的铸币交易output尚未成熟：%x[%d]", i, input.TXid, input.Index)
+				}
+				output := utxo.Output
+				//input中的公钥必须是output的收款方
+				if !bytes.Equal(HashPubKey(input.PubKey), output.PubKeyHash) {
+					return fmt.Errorf("第%d个交易的input公钥与引用的output不符：%x[%d]", i, input.TXid, input.Index)
+				}
+				delete(utxos[string(input.TXid)], input.Index)
+				inputSum, err = AddAmount(inputSum, output.Value)
+				if err != nil {
+					return fmt.Errorf("第%d个交易：%v", i, err)
+				}
+				prevTXs[string(input.TXid)] = txs[string(input.TXid)]
+			}
+			if inputSum < outputSum {
+				return fmt.Errorf("第%d个交易的output总额%s大于input总额%s", i, outputSum, inputSum)
+			}
+			totalFees, err = AddAmount(totalFees, inputSum-outputSum)
+			if err != nil {
+				return fmt.Errorf("第%d个交易：%v", i, err)
+			}
+
+			//3.校验签名
+			if !legacy && !tx.Verify(prevTXs) {
+				return fmt.Errorf("第%d个交易签名无效", i)
+			}
+		}
+
+		//4.把当前交易的output加入UTXO集合，交易ID不能与之前的任何交易重复
+		if _, ok := txs[string(tx.TXID)]; ok {
+			return fmt.Errorf("第%d个交易的ID已经存在：%x", i, tx.TXID)
+		}
+		utxos[string(tx.TXID)] = make(map[int64]UTXO)
+		for j, output := range tx.TXOutputs {
+			utxos[string(tx.TXID)][int64(j)] = UTXO{int64(j), output, block.Height, tx.IsCoinbase()}
+		}
+		txs[string(tx.TXID)] = *tx
+	}
+
+	//5.铸币交易金额不能超过挖矿奖励加手续费
+	return checkCoinbaseValue(block, totalFees, subsidy)
+}
+
+//区块中的交易ID不能与区块链中已有的交易重复，必须在写区块的同一个bolt事务中调用
+//否则UTXO集合和交易索引中以交易ID为key的记录会被覆盖
+//UTXO集合中只有尚未花费完的交易，启用交易索引时还会检查所有已上链的交易
+func checkDuplicateTxs(tx *bolt.Tx, block *Block) error {
+	utxos := tx.Bucket([]byte(utxoBucket))
+	index := tx.Bucket([]byte(txIndexBucket))
+	for _, transaction := range block.Transactions {
+		if (utxos != nil && utxos.Get(transaction.TXID) != nil) || (index != nil && index.Get(transaction.TXID) != nil) {
+			return fmt.Errorf("交易ID已经存在于区块链中：%x", transaction.TXID)
+		}
+	}
+	return nil
+}
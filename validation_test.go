@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+//创建铸币交易立即成熟的区块链，创世区块的铸币交易可以在下一个区块中花费
+func newValidationTestChain(t *testing.T) (*BlockChain, *Wallet, *Block) {
+	t.Helper()
+	chdirTemp(t)
+	err := ioutil.WriteFile(subsidyConfigFile, []byte("coinbaseMaturity 0\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc := openTestChain(t)
+	ws, err := NewWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bc, ws.WalletMap[ws.ListAddresses()[0]], genesis
+}
+
+//wallet花费prev的第一个output，每个金额一个output，都付给wallet自己
+func newSpendTx(t *testing.T, wallet *Wallet, prev *Transaction, values ...Amount) *Transaction {
+	t.Helper()
+	var outputs []TXOutput
+	for _, value := range values {
+		output, err := NewTXOutput(value, wallet.NewAddress())
+		if err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, *output)
+	}
+	tx := Transaction{nil, []TXInput{{prev.TXID, 0, nil, wallet.Pubkey}}, outputs}
+	tx.SetHash()
+	err := tx.Sign(wallet.Private, map[string]Transaction{string(prev.TXID): *prev})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tx
+}
+
+//在parent之后创建包含txs的区块，铸币交易的金额为reward
+func newBlockWithTxs(t *testing.T, parent *Block, miner string, reward Amount, txs ...*Transaction) *Block {
+	t.Helper()
+	coinbase, err := NewCoinbaseTX(miner, "", parent.Height+1, reward, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := NewBlock(append([]*Transaction{coinbase}, txs...), parent.NowHash, parent.Height+1, initialBits)
+	block.NowHash = block.CalcHash()
+	return block
+}
+
+//在只有创世区块的UTXO集合上校验区块中的交易，与Validate重新校验区块链时相同
+func validateAfterGenesis(bc *BlockChain, genesis, block *Block) error {
+	reward := genesis.Transactions[0]
+	utxos := map[string]map[int64]UTXO{string(reward.TXID): {0: {0, reward.TXOutputs[0], 0, true}}}
+	txs := map[string]Transaction{string(reward.TXID): *reward}
+	return validateBlockTransactions(block, utxos, txs, false, bc.subsidy)
+}
+
+//铸币交易最多领取挖矿奖励加上区块中所有交易的手续费，交易的output总额不能超过input总额
+//接入主链时（AcceptBlock）和重新校验区块链时（validateBlockTransactions）都要拒绝
+func TestBlockCoinbaseAndFees(t *testing.T) {
+	bc, wallet, genesis := newValidationTestChain(t)
+	miner := wallet.NewAddress()
+	reward := genesis.Transactions[0]
+	value := reward.TXOutputs[0].Value
+	fee := Amount(CoinUnit)
+	subsidy := bc.subsidy.Subsidy(1)
+	pays := newSpendTx(t, wallet, reward, value-fee)
+
+	for _, c := range []struct {
+		name  string
+		block *Block
+	}{
+		{"铸币交易超过挖矿奖励加手续费", newBlockWithTxs(t, genesis, miner, subsidy+fee+1, pays)},
+		{"没有手续费时铸币交易超过挖矿奖励", newBlockWithTxs(t, genesis, miner, subsidy+1)},
+		{"交易的output总额大于input总额", newBlockWithTxs(t, genesis, miner, subsidy, newSpendTx(t, wallet, reward, value, 1))},
+	} {
+		err := validateAfterGenesis(bc, genesis, c.block)
+		if err == nil {
+			t.Errorf("%s：validateBlockTransactions没有返回错误", c.name)
+		}
+		_, err = bc.AcceptBlock(c.block)
+		if !errors.Is(err, ErrInvalidBlock) {
+			t.Errorf("%s：AcceptBlock返回%v", c.name, err)
+		}
+	}
+
+	//铸币交易正好领取挖矿奖励加手续费
+	block := newBlockWithTxs(t, genesis, miner, subsidy+fee, pays)
+	err := validateAfterGenesis(bc, genesis, block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bc.AcceptBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bc.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//相同参数的铸币交易ID也不相同；区块内重复的交易ID，以及与区块链中已有交易重复的交易ID都被拒绝
+func TestBlockDuplicateTxids(t *testing.T) {
+	bc, wallet, genesis := newValidationTestChain(t)
+	miner := wallet.NewAddress()
+	reward := genesis.Transactions[0]
+	subsidy := bc.subsidy.Subsidy(1)
+
+	first, err := NewCoinbaseTX(miner, "", 1, subsidy, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewCoinbaseTX(miner, "", 1, subsidy, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first.TXID, second.TXID) {
+		t.Fatal("相同高度、地址和数据的铸币交易ID相同")
+	}
+
+	//同一个交易在区块中出现两次
+	spend := newSpendTx(t, wallet, reward, reward.TXOutputs[0].Value)
+	block := newBlockWithTxs(t, genesis, miner, subsidy, spend, spend)
+	err = ValidateBlock(bc, block)
+	if err == nil {
+		t.Fatal("ValidateBlock接受了重复的交易ID")
+	}
+	err = validateAfterGenesis(bc, genesis, block)
+	if err == nil {
+		t.Fatal("validateBlockTransactions接受了重复的交易ID")
+	}
+	_, err = bc.AcceptBlock(block)
+	if !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("区块内重复的交易ID返回%v", err)
+	}
+
+	//交易ID与主链上还有未花费output的交易相同
+	parent := newBlockWithTxs(t, genesis, miner, subsidy, spend)
+	_, err = bc.AcceptBlock(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block = newBlockWithTxs(t, parent, miner, bc.subsidy.Subsidy(2), spend)
+	_, err = bc.AcceptBlock(block)
+	if !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("与区块链中已有交易重复的交易ID返回%v", err)
+	}
+	if !bytes.Equal(bc.Tip(), parent.NowHash) {
+		t.Fatal("包含重复交易ID的区块被接入了主链")
+	}
+}
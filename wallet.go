@@ -8,7 +8,6 @@ import (
 	"crypto/sha256"
 	"github.com/mr-tron/base58"
 	"golang.org/x/crypto/ripemd160"
-	"log"
 )
 
 //这里的钱包是一结构，每个钱包保存了公钥、私钥对
@@ -21,18 +20,23 @@ type Wallet struct {
 }
 
 //创建钱包
-func NewWallet() *Wallet {
+func NewWallet() (*Wallet, error) {
 	//创建曲线
 	curve := elliptic.P256()
 	//生成私钥
 	privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
+	return newWalletFromKey(privateKey), nil
+}
+
+//由私钥生成钱包，读取钱包文件时也用来重新计算公钥
+func newWalletFromKey(privateKey *ecdsa.PrivateKey) *Wallet {
 	//生成公钥
 	pubKeyOrig := privateKey.PublicKey
-	//拼接X.Y
-	pubKey := append(pubKeyOrig.X.Bytes(), pubKeyOrig.Y.Bytes()...)
+	//拼接X.Y，各补齐到32字节，保证校验时可以平均拆分
+	pubKey := append(pubKeyOrig.X.FillBytes(make([]byte, 32)), pubKeyOrig.Y.FillBytes(make([]byte, 32))...)
 
 	return &Wallet{Private: privateKey, Pubkey: pubKey}
 }
@@ -46,6 +50,11 @@ func NewWallet() *Wallet {
 func (w *Wallet) NewAddress() string {
 	pubKey := w.Pubkey
 	rip160HashValue := HashPubKey(pubKey)
+	return PubKeyHashToAddress(rip160HashValue)
+}
+
+//由公钥哈希生成地址，即NewAddress的2-5步
+func PubKeyHashToAddress(rip160HashValue []byte) string {
 	version := byte(00)
 	payload := append([]byte{version}, rip160HashValue...)
 
@@ -64,12 +73,9 @@ func (w *Wallet) NewAddress() string {
 func HashPubKey(pubKey []byte) []byte {
 	hash := sha256.Sum256(pubKey)
 
-	//理解为编码器
+	//理解为编码器，hash.Hash的Write不会返回错误
 	rip160hasher := ripemd160.New()
-	_, err := rip160hasher.Write(hash[:])
-	if err != nil {
-		log.Panic(err)
-	}
+	rip160hasher.Write(hash[:])
 
 	//返回rip160的哈希结果
 	return rip160hasher.Sum(nil)
@@ -82,13 +88,11 @@ func CheckSum(payload []byte) []byte {
 	return chekCode
 }
 
+//地址是否合法：base58解码成功，长度为25字节（1字节版本+20字节公钥哈希+4字节校验码），并且校验码正确
 func IsValidAddress(address string) bool {
 	//1.解码
 	addressByte, err := base58.Decode(address)
-	if err != nil {
-		log.Panic(err)
-	}
-	if len(addressByte) < 4 {
+	if err != nil || len(addressByte) != 25 {
 		return false
 	}
 	//2.取数据
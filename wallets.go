@@ -2,11 +2,11 @@ package main
 
 import (
 	"bytes"
-	"crypto/elliptic"
+	"crypto/x509"
 	"encoding/gob"
+	"fmt"
 	"github.com/mr-tron/base58"
 	"io/ioutil"
-	"log"
 	"os"
 )
 
@@ -20,68 +20,107 @@ type Wallets struct {
 }
 
 //创建方法
-func NewWallets() *Wallets {
+func NewWallets() (*Wallets, error) {
 	var ws Wallets
 	ws.WalletMap = make(map[string]*Wallet)
-	ws.loadFile()
-	return &ws
+	err := ws.loadFile()
+	if err != nil {
+		return nil, err
+	}
+	return &ws, nil
 }
 
-func (ws *Wallets) CreateWallet() string {
-	wallet := NewWallet()
+func (ws *Wallets) CreateWallet() (string, error) {
+	wallet, err := NewWallet()
+	if err != nil {
+		return "", err
+	}
 	address := wallet.NewAddress()
 
 	//var wallets Wallets
 	//wallets.WalletMap = make(map[string]*Wallet)
 	ws.WalletMap[address] = wallet
 
-	ws.saveToFile()
-	return address
+	err = ws.saveToFile()
+	if err != nil {
+		return "", err
+	}
+	return address, nil
+
+}
 
+//钱包文件的内容
+//ecdsa.PrivateKey中的曲线类型没有导出字段，gob无法直接编码，所以每个私钥按SEC 1（x509.MarshalECPrivateKey）编码成字节保存
+//读取时由私钥重新计算公钥，并检查与地址一致
+type walletFileContent struct {
+	//map[地址]私钥
+	Keys map[string][]byte
 }
 
 //保存方法，把新建的wallet添加进去
-func (ws *Wallets) saveToFile() {
-	var buffer bytes.Buffer
+func (ws *Wallets) saveToFile() error {
+	content := walletFileContent{make(map[string][]byte)}
+	for address, wallet := range ws.WalletMap {
+		key, err := x509.MarshalECPrivateKey(wallet.Private)
+		if err != nil {
+			return fmt.Errorf("%w：%s的私钥无法编码：%v", ErrWalletFile, address, err)
+		}
+		content.Keys[address] = key
+	}
 
-	gob.Register(elliptic.P256())
+	var buffer bytes.Buffer
 	encoder := gob.NewEncoder(&buffer)
-	err := encoder.Encode(ws)
+	err := encoder.Encode(&content)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w：%v", ErrWalletFile, err)
 	}
 
-	ioutil.WriteFile(walletFile, buffer.Bytes(), 0600)
+	err = ioutil.WriteFile(walletFile, buffer.Bytes(), 0600)
+	if err != nil {
+		return fmt.Errorf("%w：%v", ErrWalletFile, err)
+	}
+	return nil
 }
 
 //读取文件方法，把所有的wallet读出来
-func (ws *Wallets) loadFile() {
+func (ws *Wallets) loadFile() error {
 	//在读取之前，要确认文件是否存在,如果不存在，直接推测出
 	_, err := os.Stat(walletFile)
 	if os.IsNotExist(err) {
 		ws.WalletMap = make(map[string]*Wallet)
-		return
+		return nil
 	}
 
 	content, err := ioutil.ReadFile(walletFile)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w：%v", ErrWalletFile, err)
 	}
 
 	//解码
-	gob.Register(elliptic.P256())
-
+	//旧版本直接用gob编码ecdsa.PrivateKey，新版本的Go无法读写这种格式，解码时会因为字段不匹配而失败
 	decoder := gob.NewDecoder(bytes.NewReader(content))
 
-	var wsLocal Wallets
+	var fileContent walletFileContent
 
-	err = decoder.Decode(&wsLocal)
+	err = decoder.Decode(&fileContent)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%w：%s已损坏或者是不支持的旧格式：%v", ErrWalletFile, walletFile, err)
+	}
+	walletMap := make(map[string]*Wallet)
+	for address, key := range fileContent.Keys {
+		privateKey, err := x509.ParseECPrivateKey(key)
+		if err != nil {
+			return fmt.Errorf("%w：%s中%s的私钥已损坏：%v", ErrWalletFile, walletFile, address, err)
+		}
+		wallet := newWalletFromKey(privateKey)
+		if wallet.NewAddress() != address {
+			return fmt.Errorf("%w：%s中%s的私钥与地址不符", ErrWalletFile, walletFile, address)
+		}
+		walletMap[address] = wallet
 	}
-	//ws = &wsLocal
 	//对于结构来说，里面有map的，要指定复制，不要在最外层直接赋值
-	ws.WalletMap = wsLocal.WalletMap
+	ws.WalletMap = walletMap
+	return nil
 }
 
 func (ws *Wallets) ListAddresses() []string {
@@ -92,15 +131,15 @@ func (ws *Wallets) ListAddresses() []string {
 	return addresses
 }
 
-//通过地址返回公钥的hash值
-func GetPubKeyFromAddress(address string) []byte {
+//通过地址返回公钥的hash值，地址无效时返回ErrInvalidAddress
+func GetPubKeyFromAddress(address string) ([]byte, error) {
+	if !IsValidAddress(address) {
+		return nil, fmt.Errorf("%w：%s", ErrInvalidAddress, address)
+	}
 	//1.解码
 	//2.截取出公钥哈希，取出version(1字节)，去除校验码(4字节)
-	addressByte, err := base58.Decode(address) //25字节
-	if err != nil {
-		log.Panic(err)
-	}
+	addressByte, _ := base58.Decode(address) //25字节
 	len := len(addressByte)
 	pubKeyHash := addressByte[1 : len-4]
-	return pubKeyHash
+	return pubKeyHash, nil
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+//钱包保存到文件后重新读取，私钥、公钥和地址都不变，读出的私钥可以签名
+func TestWalletsSaveAndLoad(t *testing.T) {
+	chdirTemp(t)
+	ws, err := NewWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addresses []string
+	for i := 0; i < 3; i++ {
+		address, err := ws.CreateWallet()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses = append(addresses, address)
+	}
+
+	loaded, err := NewWallets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.WalletMap) != len(addresses) {
+		t.Fatalf("读出%d个钱包，应为%d个", len(loaded.WalletMap), len(addresses))
+	}
+	hash := sha256.Sum256([]byte("test"))
+	for _, address := range addresses {
+		want := ws.WalletMap[address]
+		got, ok := loaded.WalletMap[address]
+		if !ok {
+			t.Fatalf("没有读出%s", address)
+		}
+		if got.Private.D.Cmp(want.Private.D) != 0 || string(got.Pubkey) != string(want.Pubkey) {
+			t.Fatalf("%s的密钥与保存的不同", address)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, got.Private, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ecdsa.Verify(&want.Private.PublicKey, hash[:], r, s) {
+			t.Fatalf("%s读出的私钥签名无效", address)
+		}
+	}
+}
+
+//文件损坏或者私钥与地址不符时返回ErrWalletFile
+func TestWalletsLoadCorrupt(t *testing.T) {
+	chdirTemp(t)
+	err := ioutil.WriteFile(walletFile, []byte("not a wallet file"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewWallets()
+	if !errors.Is(err, ErrWalletFile) {
+		t.Fatalf("损坏的钱包文件返回%v", err)
+	}
+
+	//把一个私钥保存在另一个地址下
+	ws := &Wallets{make(map[string]*Wallet)}
+	a, err := NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws.WalletMap[a.NewAddress()] = b
+	err = ws.saveToFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewWallets()
+	if !errors.Is(err, ErrWalletFile) {
+		t.Fatalf("私钥与地址不符时返回%v", err)
+	}
+}